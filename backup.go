@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Backup artifacts =====
+
+// backupManifest is written next to every archive as <archive>.manifest.json.
+type backupManifest struct {
+	File          string    `json:"file"` // archive name, relative to the manifest
+	Format        string    `json:"format"`
+	Container     string    `json:"container"`
+	Database      string    `json:"database"`
+	ServerVersion string    `json:"server_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	Encrypted     bool      `json:"encrypted,omitempty"`
+	Compression   string    `json:"compression"`
+	TOC           []string  `json:"toc"` // entries of "pg_restore -l"
+}
+
+// retentionPolicy limits the archives kept per container and database.
+type retentionPolicy struct {
+	Keep   int           `json:"keep,omitempty"`    // newest archives to keep, 0 = unlimited
+	MaxAge time.Duration `json:"max_age,omitempty"` // remove older archives, 0 = never
+}
+
+const manifestSuffix = ".manifest.json"
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// createBackup writes a custom-format archive of db into dir, streamed from
+// pg_dump through the Go process, and records it in a manifest. The archive
+// keeps owners and privileges so it can serve as a rollback point.
+func createBackup(ctx context.Context, container containerRef, user, pass, db, dir string, comp compression) (*backupManifest, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	created := time.Now().UTC()
+	name := fmt.Sprintf("%s_%s_%s.dump",
+		unsafeFileChars.ReplaceAllString(container.Name, "_"),
+		unsafeFileChars.ReplaceAllString(db, "_"),
+		created.Format("20060102T150405Z"))
+	path := filepath.Join(dir, name)
+	logf("Writing backup archive '%s'...\n", path)
+	size, sum, err := dumpToFile(ctx, container, user, pass, db, path, comp, "-Fc")
+	if err != nil {
+		return nil, err
+	}
+	reportBytes("backup", size)
+
+	m := &backupManifest{
+		File:        name,
+		Format:      "custom",
+		Container:   container.Name,
+		Database:    db,
+		CreatedAt:   created,
+		Size:        size,
+		SHA256:      sum,
+		Encrypted:   artifactKey != nil,
+		Compression: comp.String(),
+	}
+	var rows []struct {
+		Version string `json:"version"`
+	}
+	if err := queryJSON(ctx, container, user, pass, db, "SELECT current_setting('server_version') AS version", &rows); err == nil && len(rows) == 1 {
+		m.ServerVersion = rows[0].Version
+	}
+	if m.TOC, err = archiveTOC(ctx, container, path); err != nil {
+		return nil, fmt.Errorf("reading archive TOC failed: %w", err)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+manifestSuffix, data, 0o600); err != nil {
+		return nil, err
+	}
+	logf("Backup of '%s' kept: %s (%s, sha256 %s).\n", db, path, formatBytes(m.Size), m.SHA256[:12])
+	return m, nil
+}
+
+// archiveTOC lists the archive with pg_restore -l of container, which matches
+// the pg_dump version that wrote it. The archive is fed through stdin.
+func archiveTOC(ctx context.Context, container containerRef, path string) ([]string, error) {
+	f, err := openDump(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cmd := engineCommand(ctx, container.Engine, "exec", "-i", container.Name, "pg_restore", "-l")
+	cmd.Stdin = f
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v - %s", err, stderr.String())
+	}
+	var toc []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// skip the header comments
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		toc = append(toc, line)
+	}
+	return toc, nil
+}
+
+// uploadBackup copies an archive and its manifest below the s3:// prefix.
+func uploadBackup(ctx context.Context, dir string, m *backupManifest, prefix string) error {
+	path := filepath.Join(dir, m.File)
+	if _, err := uploadFile(ctx, path, joinObjectURL(prefix, m.File)); err != nil {
+		return err
+	}
+	_, err := uploadFile(ctx, path+manifestSuffix, joinObjectURL(prefix, m.File+manifestSuffix))
+	return err
+}
+
+// loadManifests reads all manifests in dir.
+func loadManifests(dir string) ([]*backupManifest, []string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+manifestSuffix))
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifests []*backupManifest
+	var manifestPaths []string
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		m := &backupManifest{}
+		if err := json.Unmarshal(data, m); err != nil {
+			logf("Ignoring unreadable manifest '%s': %v\n", p, err)
+			continue
+		}
+		manifests = append(manifests, m)
+		manifestPaths = append(manifestPaths, p)
+	}
+	return manifests, manifestPaths, nil
+}
+
+// applyRetention removes the archives of container/db in dir that exceed the
+// policy. The newest archive is always kept.
+func applyRetention(dir string, container containerRef, db string, policy retentionPolicy) error {
+	if policy.Keep <= 0 && policy.MaxAge <= 0 {
+		return nil
+	}
+	manifests, paths, err := loadManifests(dir)
+	if err != nil {
+		return err
+	}
+	var idx []int
+	for i, m := range manifests {
+		if m.Container == container.Name && m.Database == db {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(a, b int) bool {
+		return manifests[idx[a]].CreatedAt.After(manifests[idx[b]].CreatedAt)
+	})
+	for n, i := range idx {
+		m := manifests[i]
+		tooMany := policy.Keep > 0 && n >= policy.Keep
+		tooOld := policy.MaxAge > 0 && time.Since(m.CreatedAt) > policy.MaxAge
+		if n == 0 || !(tooMany || tooOld) {
+			continue
+		}
+		logf("Removing old backup '%s' from %s.\n", m.File, m.CreatedAt.Local().Format("2006-01-02 15:04"))
+		if err := os.Remove(filepath.Join(dir, m.File)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAge parses a retention age; besides Go durations it accepts days ("30d").
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "30d", want: 30 * 24 * time.Hour},
+		{in: "0d", want: 0},
+		{in: "36h", want: 36 * time.Hour},
+		{in: "90m", want: 90 * time.Minute},
+		{in: "-1d", wantErr: true},
+		{in: "-2h", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "week", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseAge(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Now().UTC()
+	archives := []struct {
+		name, container, db string
+		age                 time.Duration
+	}{
+		{"pg_app_1.dump", "pg", "app", 1 * time.Hour},
+		{"pg_app_2.dump", "pg", "app", 2 * 24 * time.Hour},
+		{"pg_app_3.dump", "pg", "app", 10 * 24 * time.Hour},
+		{"pg_app_4.dump", "pg", "app", 40 * 24 * time.Hour},
+		{"pg_shop_1.dump", "pg", "shop", 50 * 24 * time.Hour},
+		{"other_app_1.dump", "other", "app", 60 * 24 * time.Hour},
+	}
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		want   []string
+	}{
+		{
+			name:   "no policy",
+			policy: retentionPolicy{},
+			want:   []string{"other_app_1.dump", "pg_app_1.dump", "pg_app_2.dump", "pg_app_3.dump", "pg_app_4.dump", "pg_shop_1.dump"},
+		},
+		{
+			name:   "keep newest",
+			policy: retentionPolicy{Keep: 2},
+			want:   []string{"other_app_1.dump", "pg_app_1.dump", "pg_app_2.dump", "pg_shop_1.dump"},
+		},
+		{
+			name:   "max age",
+			policy: retentionPolicy{MaxAge: 7 * 24 * time.Hour},
+			want:   []string{"other_app_1.dump", "pg_app_1.dump", "pg_app_2.dump", "pg_shop_1.dump"},
+		},
+		{
+			name:   "both",
+			policy: retentionPolicy{Keep: 3, MaxAge: 30 * 24 * time.Hour},
+			want:   []string{"other_app_1.dump", "pg_app_1.dump", "pg_app_2.dump", "pg_app_3.dump", "pg_shop_1.dump"},
+		},
+		{
+			name:   "newest is always kept",
+			policy: retentionPolicy{MaxAge: time.Minute},
+			want:   []string{"other_app_1.dump", "pg_app_1.dump", "pg_shop_1.dump"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, a := range archives {
+				m := backupManifest{File: a.name, Format: "custom", Container: a.container, Database: a.db, CreatedAt: now.Add(-a.age)}
+				data, err := json.Marshal(m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, a.name), []byte("archive"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, a.name+manifestSuffix), data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := applyRetention(dir, onEngine("pg", dockerEngine{}), "app", tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				name := e.Name()
+				if filepath.Ext(name) == ".dump" {
+					got = append(got, name)
+					if _, err := os.Stat(filepath.Join(dir, name+manifestSuffix)); err != nil {
+						t.Errorf("manifest of %s: %v", name, err)
+					}
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("kept %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
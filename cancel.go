@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ===== Cancellation =====
+
+// sessionAppName is the application_name of every PostgreSQL session the tool
+// opens (via PGAPPNAME), so they can be found in pg_stat_activity and
+// terminated on Ctrl-C.
+var sessionAppName = fmt.Sprintf("%s-%d", appname, os.Getpid())
+
+// interruptCleanupTimeout bounds the cleanup that runs after Ctrl-C.
+const interruptCleanupTimeout = 60 * time.Second
+
+var (
+	interruptMu  sync.Mutex
+	interruptFns = map[int]interruptAction{}
+	interruptSeq int
+)
+
+type interruptAction struct {
+	name string
+	fn   func(ctx context.Context)
+}
+
+// interruptSelf starts the same shutdown as a signal; set by handleInterrupts.
+var interruptSelf = func() {}
+
+// handleInterrupts returns a context that is cancelled on SIGINT/SIGTERM.
+// Cancellation kills the local docker clients; the registered cleanup actions
+// then stop the work inside the containers and the process exits with 130.
+// A second signal exits at once.
+func handleInterrupts() context.Context {
+	base, cancel := context.WithCancel(context.Background())
+	interruptSelf = cancel
+	ctx, stop := signal.NotifyContext(base, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		logf("Interrupted; stopping work inside the containers (press Ctrl-C again to force)...\n")
+		runInterruptCleanup()
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// exitIfInterrupted blocks when ctx was cancelled by a signal, leaving the
+// exit to the cleanup started by handleInterrupts.
+func exitIfInterrupted(ctx context.Context) {
+	if ctx.Err() != nil {
+		select {}
+	}
+}
+
+// onInterrupt registers fn to run if the run is interrupted. Call the returned
+// release function once the action is no longer needed (e.g. the resource it
+// would remove has been handed over to the user).
+func onInterrupt(name string, fn func(ctx context.Context)) (release func()) {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	interruptSeq++
+	id := interruptSeq
+	interruptFns[id] = interruptAction{name: name, fn: fn}
+	return func() {
+		interruptMu.Lock()
+		defer interruptMu.Unlock()
+		delete(interruptFns, id)
+	}
+}
+
+// runInterruptCleanup runs the registered actions, newest first.
+func runInterruptCleanup() {
+	interruptMu.Lock()
+	var ids []int
+	for id := range interruptFns {
+		ids = append(ids, id)
+	}
+	actions := interruptFns
+	interruptFns = map[int]interruptAction{}
+	interruptMu.Unlock()
+
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	ctx, cancel := context.WithTimeout(context.Background(), interruptCleanupTimeout)
+	defer cancel()
+	for _, id := range ids {
+		a := actions[id]
+		logf("Cleanup: %s\n", a.name)
+		a.fn(ctx)
+	}
+}
+
+// terminateSessions ends every backend opened by this process in container.
+func terminateSessions(ctx context.Context, container containerRef, user, pass string) {
+	sql := fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE application_name = '%s' AND pid <> pg_backend_pid()", sessionAppName)
+	cmd := engineCommand(ctx, container.Engine, "exec", "-e", "PGPASSWORD="+pass, container.Name, "psql", "-X", "-U", user, "-d", "postgres", "-t", "-A", "-c", sql)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logf("Terminating sessions in '%s' failed: %v - %s\n", container, err, out)
+	}
+}
+
+// watchSessions makes an interrupt terminate this process' sessions in
+// container. The returned function unregisters it.
+func watchSessions(container containerRef, user, pass string) (release func()) {
+	return onInterrupt(fmt.Sprintf("terminate migration sessions in '%s'", container), func(ctx context.Context) {
+		terminateSessions(ctx, container, user, pass)
+	})
+}
+
+// warnPartialRestore reminds the user on interrupt that the destination
+// database holds an incomplete restore.
+func warnPartialRestore(container containerRef, db string) (release func()) {
+	return onInterrupt("check destination database", func(ctx context.Context) {
+		logf("Database '%s' on container '%s' is only partially restored; rerun the migration or drop it.\n", db, container)
+	})
+}
+
+// pgExec builds the "docker exec" call running a PostgreSQL client tool in
+// container. stdin keeps the container's stdin open (-i).
+func pgExec(container containerRef, pass string, stdin bool, tool ...string) dockerCall {
+	return pgExecEnv(container, pass, nil, stdin, tool...)
+}
+
+// pgExecEnv is pgExec with additional environment variables (NAME=value).
+func pgExecEnv(container containerRef, pass string, env []string, stdin bool, tool ...string) dockerCall {
+	args := []string{"exec", "-e", "PGPASSWORD=" + pass, "-e", "PGAPPNAME=" + sessionAppName}
+	for _, v := range env {
+		args = append(args, "-e", v)
+	}
+	if stdin {
+		args = append(args, "-i")
+	}
+	args = append(args, container.Name)
+	return dockerCall{Engine: container.Engine, Args: append(args, tool...)}
+}
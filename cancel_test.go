@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestRunInterruptCleanup(t *testing.T) {
+	var ran []string
+	action := func(name string) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("%s: cleanup context has no deadline", name)
+			}
+			ran = append(ran, name)
+		}
+	}
+	onInterrupt("remove container", action("remove container"))
+	release := onInterrupt("stop dump", action("stop dump"))
+	onInterrupt("terminate sessions", action("terminate sessions"))
+	release()
+
+	runInterruptCleanup()
+	if want := []string{"terminate sessions", "remove container"}; !slices.Equal(ran, want) {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+	ran = nil
+	runInterruptCleanup()
+	if len(ran) != 0 {
+		t.Errorf("second cleanup ran %q again", ran)
+	}
+}
+
+func TestEngineCommandCancelled(t *testing.T) {
+	fakeDocker(t, "sleep 10")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := engineCommand(ctx, dockerEngine{}, "exec", "pg", "psql").Run(); err == nil {
+		t.Error("command ran despite a cancelled context")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ===== Non-interactive subcommands =====
+
+// subcommands maps the first CLI argument to its handler. Each handler
+// receives the remaining arguments and returns the process exit code.
+var subcommands = map[string]func(ctx context.Context, args []string) int{
+	"verify":    runVerifyCommand,
+	"resume":    runResumeCommand,
+	"export":    runExportCommand,
+	"import":    runImportCommand,
+	"replicate": runReplicateCommand,
+	"rehearse":  runRehearseCommand,
+	"inventory": runInventoryCommand,
+	"fleet":     runFleetCommand,
+	// started by fleet for each container, not listed in the usage
+	"fleet-member": runFleetMemberCommand,
+}
+
+// globalFlagArgs are the global flags as given, passed on to child processes.
+var globalFlagArgs []string
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [--output text|json] [--compress method[:level]] [--encryption-key-file file] [--hook event=command]... [command] [flags]\n\n", appname)
+	fmt.Fprintln(os.Stderr, "Without a command the interactive migration is started.")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  verify    compare two containers (schema, row counts, smoke tests)")
+	fmt.Fprintln(os.Stderr, "  export    dump a database to a file or directory on the host")
+	fmt.Fprintln(os.Stderr, "  import    load an archive or SQL file from the host into a container")
+	fmt.Fprintln(os.Stderr, "  replicate near-zero-downtime migration via logical replication")
+	fmt.Fprintln(os.Stderr, "  fleet     upgrade many containers to a target image, several at a time")
+	fmt.Fprintln(os.Stderr, "  inventory list all PostgreSQL containers with versions, sizes and end-of-life status")
+	fmt.Fprintln(os.Stderr, "  rehearse  migrate into a throwaway container and report timings and warnings")
+	fmt.Fprintln(os.Stderr, "  resume    continue an interrupted migration from its state file")
+	fmt.Fprintln(os.Stderr, "Global flags:")
+	fmt.Fprintln(os.Stderr, "  --output  text (default) or json: newline-delimited events on stdout")
+	fmt.Fprintln(os.Stderr, "  --compress  none (default), gzip[:level] or pg_dump[:level] for dump files and the stream")
+	fmt.Fprintln(os.Stderr, "  --encryption-key-file  AES-256 key for dump files on the host (or $"+encryptionKeyEnv+")")
+	fmt.Fprintln(os.Stderr, "  --hook  event=command, run at "+strings.Join(hookEvents, ", ")+" (repeatable)")
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", appname)
+}
+
+// parseGlobalFlags handles the flags placed before the command and returns
+// the remaining arguments.
+func parseGlobalFlags(args []string) []string {
+	fs := flag.NewFlagSet(appname, flag.ExitOnError)
+	fs.Usage = printUsage
+	output := fs.String("output", "text", "output format: text or json")
+	compress := fs.String("compress", "none", "compression of dump files and the stream: none, gzip[:level] or pg_dump[:level]")
+	keyFile := fs.String("encryption-key-file", "", "encrypt dump files on the host with this AES-256 key (default: $"+encryptionKeyEnv+")")
+	fs.Var(globalHooks, "hook", "run a shell command at a migration event: event=command (repeatable; "+strings.Join(hookEvents, ", ")+")")
+	fs.Parse(args)
+	globalFlagArgs = args[:len(args)-len(fs.Args())]
+	switch *output {
+	case "text":
+	case "json":
+		outputJSON = true
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format '%s'.\n", *output)
+		printUsage()
+		os.Exit(2)
+	}
+	key, err := loadArtifactKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid encryption key: %v\n", err)
+		os.Exit(2)
+	}
+	artifactKey = key
+	if defaultCompression, err = parseCompression(*compress); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid compression: %v\n", err)
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+// printBanner shows name and build information, or emits it as a "start"
+// event in JSON mode.
+func printBanner() {
+	if outputJSON {
+		info := fmt.Sprintf("%s %s", appname, version)
+		if Tag != "" {
+			info += " tag=" + Tag
+		}
+		if Commit != "" {
+			info += " commit=" + Commit
+		}
+		emit(event{Type: "start", Message: info})
+		return
+	}
+	fmt.Println("====================================")
+	fmt.Printf(" %s\n", appname)
+	fmt.Printf(" Version: %s\n", version)
+	if Tag != "" {
+		fmt.Printf(" Tag: %s\n", Tag)
+	}
+	if Commit != "" {
+		fmt.Printf(" Commit: %s\n", Commit)
+	}
+	if BuildTime != "" {
+		fmt.Printf(" BuildTime: %s\n", BuildTime)
+	}
+	fmt.Printf(" Developed by: %s\n", author)
+	fmt.Println("====================================")
+}
+
+// connFlags holds the flags describing one PostgreSQL container.
+type connFlags struct {
+	name      string
+	container *string
+	user      *string
+	password  *string
+	docker    *string
+}
+
+// addConnFlags registers -<prefix>, -<prefix>-user, -<prefix>-password and
+// -<prefix>-docker. The password defaults to $PGUPGRADE_<PREFIX>_PASSWORD so
+// it does not have to appear in the process list.
+func addConnFlags(fs *flag.FlagSet, prefix, desc string) connFlags {
+	envName := "PGUPGRADE_" + strings.ToUpper(prefix) + "_PASSWORD"
+	// the env value is read in resolve so it never shows up in -h output
+	return connFlags{
+		name:      prefix,
+		container: fs.String(prefix, "", desc+" container name"),
+		user:      fs.String(prefix+"-user", "", desc+" user (default: POSTGRES_USER of the container)"),
+		password:  fs.String(prefix+"-password", "", desc+" password (default: $"+envName+" or POSTGRES_PASSWORD of the container)"),
+		docker:    fs.String(prefix+"-docker", "", desc+" Docker engine: context name or ssh:// / tcp:// host (default: local)"),
+	}
+}
+
+// resolve returns the container reference and credentials, filling empty
+// values from the container environment like the interactive prompts do.
+func (c connFlags) resolve(ctx context.Context) (container containerRef, user, pass string, err error) {
+	if *c.container == "" {
+		return container, "", "", fmt.Errorf("-%s is required", c.name)
+	}
+	engine, err := parseEngine(*c.docker)
+	if err != nil {
+		return container, "", "", fmt.Errorf("-%s-docker: %w", c.name, err)
+	}
+	container = onEngine(*c.container, engine)
+	user, pass = *c.user, *c.password
+	if pass == "" {
+		pass = os.Getenv("PGUPGRADE_" + strings.ToUpper(c.name) + "_PASSWORD")
+	}
+	if user == "" || pass == "" {
+		env := getContainerEnv(ctx, container)
+		if user == "" {
+			user = env["POSTGRES_USER"]
+		}
+		if pass == "" {
+			pass = env["POSTGRES_PASSWORD"]
+		}
+	}
+	if user == "" {
+		user = "postgres"
+	}
+	return container, user, pass, nil
+}
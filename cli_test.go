@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConnFlagsResolve(t *testing.T) {
+	dir := fakeDocker(t, `cat "$FAKE_DOCKER_DIR/env"`)
+	tests := []struct {
+		name      string
+		args      []string
+		envPass   string // $PGUPGRADE_SRC_PASSWORD
+		env       string // environment of the container
+		container string
+		engine    dockerEngine
+		user      string
+		pass      string
+		wantErr   string
+	}{
+		{
+			name: "flags win", args: []string{"-src", "pg", "-src-user", "app", "-src-password", "flag"},
+			envPass: "env", env: "POSTGRES_USER=other\nPOSTGRES_PASSWORD=container\n",
+			container: "pg", user: "app", pass: "flag",
+		},
+		{
+			name: "password from the environment", args: []string{"-src", "pg"},
+			envPass: "env", env: "POSTGRES_USER=app\nPOSTGRES_PASSWORD=container\n",
+			container: "pg", user: "app", pass: "env",
+		},
+		{
+			name: "container environment", args: []string{"-src", "pg"},
+			env:       "PATH=/usr/bin\nPOSTGRES_USER=app\nPOSTGRES_PASSWORD=a=b\n",
+			container: "pg", user: "app", pass: "a=b",
+		},
+		{
+			name: "default user", args: []string{"-src", "pg"},
+			env:       "POSTGRES_PASSWORD=container\n",
+			container: "pg", user: "postgres", pass: "container",
+		},
+		{
+			name: "remote engine", args: []string{"-src", "pg", "-src-docker", "prod"},
+			env:       "POSTGRES_USER=app\nPOSTGRES_PASSWORD=container\n",
+			container: "pg", engine: dockerEngine{Context: "prod"}, user: "app", pass: "container",
+		},
+		{name: "invalid engine", args: []string{"-src", "pg", "-src-docker", "ftp://host"}, wantErr: "-src-docker"},
+		{name: "container required", args: []string{"-src-user", "app"}, wantErr: "-src is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dir, "env"), []byte(tt.env), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PGUPGRADE_SRC_PASSWORD", tt.envPass)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			src := addConnFlags(fs, "src", "source")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			container, user, pass, err := src.resolve(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if container != onEngine(tt.container, tt.engine) || user != tt.user || pass != tt.pass {
+				t.Errorf("resolve = %+v, %q, %q, want %q on %v, %q, %q", container, user, pass, tt.container, tt.engine, tt.user, tt.pass)
+			}
+			if !tt.engine.isLocal() {
+				if args := fakeDockerArgs(t, dir); !slices.Equal(args[:2], tt.engine.globalArgs()) {
+					t.Errorf("container environment read with %q", args)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Docker Compose projects =====
+
+// Labels docker compose puts on the containers it creates.
+const (
+	composeConfigFilesLabel = "com.docker.compose.project.config_files"
+	composeWorkingDirLabel  = "com.docker.compose.project.working_dir"
+)
+
+// composeOverrideFile is written next to the compose files of an upgraded
+// project.
+const composeOverrideFile = "compose.pgupgrade.yml"
+
+// defaultDataDir is where images without a declared volume keep their data.
+const defaultDataDir = "/var/lib/postgresql/data"
+
+// bitnamiDataDir is the data directory of Bitnami images, inside their
+// volume /bitnami/postgresql; POSTGRESQL_DATA_DIR moves it.
+const bitnamiDataDir = "/bitnami/postgresql/data"
+
+// dataVolumeRoots are the trees PostgreSQL images keep their data volume in.
+var dataVolumeRoots = []string{"/var/lib/postgresql", "/bitnami/postgresql"}
+
+// composeService is the compose service a source container belongs to, and
+// the image and volume it is upgraded to.
+type composeService struct {
+	Project     string           `json:"project"`
+	Service     string           `json:"service"`
+	WorkingDir  string           `json:"working_dir,omitempty"`
+	ConfigFiles []string         `json:"config_files"`
+	Image       string           `json:"image"`
+	PGData      string           `json:"pgdata"`
+	Mounts      []containerMount `json:"mounts,omitempty"`
+
+	NewImage string `json:"new_image"`
+	Volume   string `json:"volume"`   // data volume of the upgraded service
+	DataDir  string `json:"data_dir"` // where NewImage keeps its data
+}
+
+// containerMount is one entry of .Mounts in "docker inspect".
+type containerMount struct {
+	Type        string `json:"Type"`
+	Name        string `json:"Name"`
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+	RW          bool   `json:"RW"`
+}
+
+var anonymousVolumePattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// composeServiceOf returns the compose service of container, or nil if it was
+// not started by compose or its compose files cannot be read here.
+func composeServiceOf(ctx context.Context, container containerRef) *composeService {
+	out, err := engineCommand(ctx, container.Engine, "inspect", "--format", "{{json .}}", container.Name).Output()
+	if err != nil {
+		return nil
+	}
+	var info struct {
+		Config struct {
+			Image  string            `json:"Image"`
+			Env    []string          `json:"Env"`
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+		Mounts []containerMount `json:"Mounts"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil
+	}
+	labels := info.Config.Labels
+	if labels[composeProjectLabel] == "" || labels[composeServiceLabel] == "" {
+		return nil
+	}
+	svc := &composeService{
+		Project:    labels[composeProjectLabel],
+		Service:    labels[composeServiceLabel],
+		WorkingDir: labels[composeWorkingDirLabel],
+		Image:      info.Config.Image,
+		PGData:     containerDataDir(info.Config.Image, info.Config.Env),
+		Mounts:     info.Mounts,
+	}
+	for _, f := range strings.Split(labels[composeConfigFilesLabel], ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			logf("'%s' belongs to compose project '%s', but its file '%s' is not readable here; in-place upgrade is not offered.\n",
+				container.Name, svc.Project, f)
+			return nil
+		}
+		svc.ConfigFiles = append(svc.ConfigFiles, f)
+	}
+	if len(svc.ConfigFiles) == 0 {
+		return nil
+	}
+	return svc
+}
+
+// tempContainerName names the container the data is migrated into before the
+// service takes it over.
+func (s *composeService) tempContainerName() string {
+	return s.Project + "-" + s.Service + "-pgupgrade"
+}
+
+// volumeName suggests a data volume name for the service running image.
+func (s *composeService) volumeName(image string) string {
+	tag := "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		tag = image[i+1:]
+	}
+	return unsafeFileChars.ReplaceAllString(s.Project+"_"+s.Service+"_pg"+tag, "_")
+}
+
+// containerDataDir returns the data directory of a container from image with
+// the environment env: POSTGRESQL_DATA_DIR (Bitnami) or PGDATA if set, else
+// the default of the image family.
+func containerDataDir(image string, env []string) string {
+	var pgdata, bitnamiDir string
+	bitnami := strings.Contains(image, "bitnami/")
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		switch name {
+		case "PGDATA":
+			pgdata = value
+		case "POSTGRESQL_DATA_DIR":
+			bitnamiDir = value
+		case "BITNAMI_APP_NAME":
+			bitnami = true
+		}
+	}
+	switch {
+	case bitnamiDir != "":
+		return bitnamiDir
+	case pgdata != "":
+		return pgdata
+	case bitnami:
+		return bitnamiDataDir
+	}
+	return defaultDataDir
+}
+
+// imageDataDir returns the volume path image declares for its data directory
+// (postgres:18 and later use /var/lib/postgresql instead of .../data, Bitnami
+// /bitnami/postgresql). The image is pulled if it is not present yet.
+func imageDataDir(ctx context.Context, e dockerEngine, image string) string {
+	inspect := func() ([]byte, error) {
+		return engineCommand(ctx, e, "image", "inspect", "--format", "{{json .Config.Volumes}}", image).Output()
+	}
+	out, err := inspect()
+	if err != nil {
+		logf("Pulling image '%s'...\n", image)
+		if pullOut, err := engineCommand(ctx, e, "pull", image).CombinedOutput(); err != nil {
+			logf("Pulling '%s' failed: %v - %s\n", image, err, pullOut)
+			return defaultDataDir
+		}
+		if out, err = inspect(); err != nil {
+			return defaultDataDir
+		}
+	}
+	var volumes map[string]any
+	if json.Unmarshal(out, &volumes) != nil {
+		return defaultDataDir
+	}
+	return dataVolume(volumes)
+}
+
+// dataVolume picks the data directory among the volumes an image declares.
+func dataVolume(volumes map[string]any) string {
+	for path := range volumes {
+		for _, root := range dataVolumeRoots {
+			if path == root || strings.HasPrefix(path, root+"/") {
+				return path
+			}
+		}
+	}
+	return defaultDataDir
+}
+
+// isDataMount reports whether m holds the PostgreSQL data of the service.
+func (s *composeService) isDataMount(m containerMount) bool {
+	dest := strings.TrimSuffix(m.Destination, "/")
+	if dest == s.PGData || strings.HasPrefix(s.PGData, dest+"/") || dest == defaultDataDir || dest == bitnamiDataDir {
+		return true
+	}
+	return slices.Contains(dataVolumeRoots, dest)
+}
+
+// writeOverride writes the compose override that runs the service from
+// NewImage with its data in Volume. The other mounts of the running container
+// are kept. An existing override of the same name is renamed to a backup
+// first. It returns the path of the override.
+func (s *composeService) writeOverride() (string, error) {
+	path := s.overridePath()
+	if _, err := os.Stat(path); err == nil {
+		backup := path + "." + time.Now().UTC().Format("20060102T150405Z") + ".bak"
+		if err := os.Rename(path, backup); err != nil {
+			return "", err
+		}
+		logf("Kept the previous '%s' as '%s'.\n", path, backup)
+	}
+
+	q := strconv.Quote
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Written by %s on %s.\n", appname, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "# Service %s: %s -> %s, data in volume %s.\n", q(s.Service), s.Image, s.NewImage, q(s.Volume))
+	fmt.Fprintf(&b, "# Leave this file out of the -f list to return to the original image and volume.\n")
+	fmt.Fprintf(&b, "services:\n  %s:\n    image: %s\n", q(s.Service), q(s.NewImage))
+	// !override (compose 2.24+) replaces the list; a plain list would be
+	// merged by target and keep the old data volume mounted
+	fmt.Fprintf(&b, "    volumes: !override\n")
+	fmt.Fprintf(&b, "      - type: volume\n        source: %s\n        target: %s\n", q(s.Volume), q(s.DataDir))
+	external := []string{s.Volume}
+	mounts := append([]containerMount{}, s.Mounts...)
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Destination < mounts[j].Destination })
+	for _, m := range mounts {
+		if s.isDataMount(m) {
+			continue
+		}
+		switch {
+		case m.Type == "volume" && !anonymousVolumePattern.MatchString(m.Name):
+			fmt.Fprintf(&b, "      - type: volume\n        source: %s\n        target: %s\n", q(m.Name), q(m.Destination))
+			external = append(external, m.Name)
+		case m.Type == "bind":
+			fmt.Fprintf(&b, "      - type: bind\n        source: %s\n        target: %s\n", q(m.Source), q(m.Destination))
+		default:
+			continue
+		}
+		if !m.RW {
+			fmt.Fprintf(&b, "        read_only: true\n")
+		}
+	}
+	fmt.Fprintf(&b, "volumes:\n")
+	for _, v := range external {
+		fmt.Fprintf(&b, "  %s:\n    external: true\n", q(v))
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// overridePath returns where the override of the project is written.
+func (s *composeService) overridePath() string {
+	dir := s.WorkingDir
+	if dir == "" {
+		dir = filepath.Dir(s.ConfigFiles[0])
+	}
+	return filepath.Join(dir, composeOverrideFile)
+}
+
+// composeArgs returns "compose -p <project> -f <file>..." for the project
+// with extra files added.
+func (s *composeService) composeArgs(extra ...string) []string {
+	args := []string{"compose", "-p", s.Project}
+	if s.WorkingDir != "" {
+		args = append(args, "--project-directory", s.WorkingDir)
+	}
+	for _, f := range append(append([]string{}, s.ConfigFiles...), extra...) {
+		args = append(args, "-f", f)
+	}
+	return args
+}
+
+// switchTo hands the migrated data over to the compose service, which runs on
+// the engine of tempContainer: the temporary container is removed, the
+// override is written and the service is recreated from it. It returns the
+// reference of the new service container once PostgreSQL accepts connections.
+func (s *composeService) switchTo(ctx context.Context, tempContainer containerRef, user, pass, db string) (containerRef, error) {
+	e := tempContainer.Engine
+	logf("Stopping temporary container '%s'...\n", tempContainer.Name)
+	if out, err := engineCommand(ctx, tempContainer.Engine, "stop", tempContainer.Name).CombinedOutput(); err != nil {
+		return containerRef{}, fmt.Errorf("stopping '%s' failed: %v - %s", tempContainer, err, out)
+	}
+	if out, err := engineCommand(ctx, tempContainer.Engine, "rm", tempContainer.Name).CombinedOutput(); err != nil {
+		return containerRef{}, fmt.Errorf("removing '%s' failed: %v - %s", tempContainer, err, out)
+	}
+	override, err := s.writeOverride()
+	if err != nil {
+		return containerRef{}, fmt.Errorf("writing the compose override failed: %w", err)
+	}
+	logf("Wrote '%s'.\n", override)
+
+	args := append(s.composeArgs(override), "up", "-d", "--no-deps", s.Service)
+	reportCommand(dockerCall{Engine: e, Args: args}.String())
+	cmd := engineCommand(ctx, e, args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = humanOut()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return containerRef{}, fmt.Errorf("docker compose up failed: %v - %s", err, stderr.String())
+	}
+	out, err := engineCommand(ctx, e, "ps", "--format", "{{.Names}}",
+		"--filter", "label="+composeProjectLabel+"="+s.Project,
+		"--filter", "label="+composeServiceLabel+"="+s.Service).Output()
+	names := strings.Fields(string(out))
+	if err != nil || len(names) == 0 {
+		return containerRef{}, fmt.Errorf("the recreated service '%s' is not running", s.Service)
+	}
+	container := onEngine(names[0], e)
+	if !waitForPgReady(ctx, container, user, pass, db, 60*time.Second) {
+		return containerRef{}, fmt.Errorf("PostgreSQL in '%s' did not become ready in time", names[0])
+	}
+	return container, nil
+}
+
+// composeUsage tells how to run the project with the override from now on.
+func (s *composeService) composeUsage() string {
+	files := append(append([]string{}, s.ConfigFiles...), s.overridePath())
+	return "COMPOSE_FILE=" + strings.Join(files, string(os.PathListSeparator)) + " docker compose -p " + s.Project + " up -d"
+}
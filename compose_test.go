@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteOverride(t *testing.T) {
+	dir := t.TempDir()
+	s := &composeService{
+		Project:     "shop",
+		Service:     "db",
+		WorkingDir:  dir,
+		ConfigFiles: []string{filepath.Join(dir, "compose.yml")},
+		Image:       "postgres:13",
+		PGData:      defaultDataDir,
+		Mounts: []containerMount{
+			{Type: "volume", Name: "shop_pgdata", Destination: defaultDataDir, RW: true},
+			{Type: "volume", Name: "shop_conf", Destination: "/etc/postgresql"},
+			{Type: "bind", Source: "/srv/shop/init", Destination: "/docker-entrypoint-initdb.d", RW: true},
+			{Type: "volume", Name: strings.Repeat("ab", 32), Destination: "/tmp/scratch", RW: true},
+			{Type: "tmpfs", Destination: "/run/postgresql", RW: true},
+		},
+		NewImage: "postgres:17",
+		Volume:   "shop_db_pg17",
+		DataDir:  defaultDataDir,
+	}
+	if err := os.WriteFile(s.overridePath(), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path, err := s.writeOverride()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, composeOverrideFile) {
+		t.Errorf("override written to %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the comment header carries the time of writing
+	var body []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			body = append(body, line)
+		}
+	}
+	want := `services:
+  "db":
+    image: "postgres:17"
+    volumes: !override
+      - type: volume
+        source: "shop_db_pg17"
+        target: "/var/lib/postgresql/data"
+      - type: bind
+        source: "/srv/shop/init"
+        target: "/docker-entrypoint-initdb.d"
+      - type: volume
+        source: "shop_conf"
+        target: "/etc/postgresql"
+        read_only: true
+volumes:
+  "shop_db_pg17":
+    external: true
+  "shop_conf":
+    external: true
+`
+	if got := strings.Join(body, "\n"); got != want {
+		t.Errorf("override =\n%s\nwant\n%s", got, want)
+	}
+	backups, _ := filepath.Glob(path + ".*.bak")
+	if len(backups) != 1 {
+		t.Errorf("previous override kept as %q, want one backup", backups)
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	s := &composeService{Project: "shop", Service: "db"}
+	tests := []struct {
+		image, want string
+	}{
+		{"postgres:17", "shop_db_pg17"},
+		{"postgres:17.2-alpine", "shop_db_pg17.2-alpine"},
+		{"postgres", "shop_db_pglatest"},
+		{"registry.local:5000/postgres", "shop_db_pglatest"},
+		{"registry.local:5000/postgres:16", "shop_db_pg16"},
+	}
+	for _, tt := range tests {
+		if got := s.volumeName(tt.image); got != tt.want {
+			t.Errorf("volumeName(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestComposeArgs(t *testing.T) {
+	s := &composeService{Project: "shop", WorkingDir: "/srv/shop", ConfigFiles: []string{"/srv/shop/compose.yml", "/srv/shop/compose.prod.yml"}}
+	got := s.composeArgs("/srv/shop/" + composeOverrideFile)
+	want := []string{"compose", "-p", "shop", "--project-directory", "/srv/shop",
+		"-f", "/srv/shop/compose.yml", "-f", "/srv/shop/compose.prod.yml", "-f", "/srv/shop/" + composeOverrideFile}
+	if !slices.Equal(got, want) {
+		t.Errorf("composeArgs = %q, want %q", got, want)
+	}
+	if !slices.Equal(s.ConfigFiles, []string{"/srv/shop/compose.yml", "/srv/shop/compose.prod.yml"}) {
+		t.Errorf("composeArgs changed the config files: %q", s.ConfigFiles)
+	}
+}
+
+func TestContainerDataDir(t *testing.T) {
+	tests := []struct {
+		name  string
+		image string
+		env   []string
+		want  string
+	}{
+		{"official", "postgres:16", []string{"PG_MAJOR=16"}, defaultDataDir},
+		{"official with PGDATA", "postgres:16", []string{"PGDATA=/var/lib/postgresql/data/pgdata"}, "/var/lib/postgresql/data/pgdata"},
+		{"bitnami by name", "bitnami/postgresql:16", nil, bitnamiDataDir},
+		{"bitnami by env", "registry.local/pg:16", []string{"BITNAMI_APP_NAME=postgresql"}, bitnamiDataDir},
+		{"bitnami data dir", "bitnami/postgresql:16", []string{"POSTGRESQL_DATA_DIR=/bitnami/postgresql/pgdata"}, "/bitnami/postgresql/pgdata"},
+		{"data dir before PGDATA", "bitnami/postgresql:16", []string{"PGDATA=/x", "POSTGRESQL_DATA_DIR=/y"}, "/y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerDataDir(tt.image, tt.env); got != tt.want {
+				t.Errorf("containerDataDir(%q, %q) = %q, want %q", tt.image, tt.env, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		volumes map[string]any
+		want    string
+	}{
+		{"postgres 17", map[string]any{"/var/lib/postgresql/data": struct{}{}}, "/var/lib/postgresql/data"},
+		{"postgres 18", map[string]any{"/var/lib/postgresql": struct{}{}}, "/var/lib/postgresql"},
+		{"bitnami", map[string]any{"/bitnami/postgresql": struct{}{}, "/docker-entrypoint-initdb.d": struct{}{}}, "/bitnami/postgresql"},
+		{"similar prefix", map[string]any{"/var/lib/postgresql-backup": struct{}{}}, defaultDataDir},
+		{"none", nil, defaultDataDir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dataVolume(tt.volumes); got != tt.want {
+				t.Errorf("dataVolume(%v) = %q, want %q", tt.volumes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDataMount(t *testing.T) {
+	tests := []struct {
+		name        string
+		pgdata      string
+		destination string
+		want        bool
+	}{
+		{"official data dir", defaultDataDir, "/var/lib/postgresql/data", true},
+		{"official parent", defaultDataDir, "/var/lib/postgresql", true},
+		{"custom PGDATA below mount", "/srv/pg/data", "/srv/pg", true},
+		{"bitnami volume", bitnamiDataDir, "/bitnami/postgresql", true},
+		{"bitnami custom data dir", "/bitnami/postgresql/pgdata", "/bitnami/postgresql/", true},
+		{"bitnami data dir mount", bitnamiDataDir, "/bitnami/postgresql/data", true},
+		{"init scripts", bitnamiDataDir, "/docker-entrypoint-initdb.d", false},
+		{"config bind", defaultDataDir, "/etc/postgresql", false},
+		{"sibling with same prefix", "/srv/pg/data", "/srv/p", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &composeService{PGData: tt.pgdata}
+			if got := s.isDataMount(containerMount{Destination: tt.destination}); got != tt.want {
+				t.Errorf("isDataMount(%q) with PGData %q = %v, want %v", tt.destination, tt.pgdata, got, tt.want)
+			}
+		})
+	}
+}
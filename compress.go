@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Compression =====
+
+// compression selects how dumps are compressed. "gzip" compresses dump files
+// in the Go process (stdlib), "pg_dump" passes -Z <level> to pg_dump. For the
+// container-to-container stream both use pg_dump's -Z in the source
+// container, the only place where compressing reduces the transferred bytes.
+type compression struct {
+	Method string `json:"method,omitempty"` // "", "gzip" or "pg_dump"
+	Level  int    `json:"level,omitempty"`
+}
+
+// defaultCompression is set by the global --compress flag.
+var defaultCompression compression
+
+const defaultCompressionLevel = 6
+
+// parseCompression parses "none", "gzip[:level]" or "pg_dump[:level]".
+func parseCompression(s string) (compression, error) {
+	method, levelStr, hasLevel := strings.Cut(strings.TrimSpace(strings.ToLower(s)), ":")
+	c := compression{Method: method, Level: defaultCompressionLevel}
+	switch method {
+	case "", "none":
+		if hasLevel {
+			return compression{}, fmt.Errorf("compression 'none' takes no level")
+		}
+		return compression{}, nil
+	case "gzip", "pg_dump":
+	default:
+		return compression{}, fmt.Errorf("unknown compression %q (none, gzip[:level], pg_dump[:level])", s)
+	}
+	if hasLevel {
+		level, err := strconv.Atoi(levelStr)
+		if err != nil || level < 1 || level > 9 {
+			return compression{}, fmt.Errorf("compression level must be 1-9, got %q", levelStr)
+		}
+		c.Level = level
+	}
+	return c, nil
+}
+
+func (c compression) String() string {
+	if c.Method == "" {
+		return "none"
+	}
+	return fmt.Sprintf("%s:%d", c.Method, c.Level)
+}
+
+// pgDumpArgs returns the pg_dump options for compressing a dump file.
+func (c compression) pgDumpArgs() []string {
+	if c.Method != "pg_dump" {
+		return nil
+	}
+	return []string{"-Z", strconv.Itoa(c.Level)}
+}
+
+// streamArgs returns the pg_dump options for compressing the stream between
+// the containers.
+func (c compression) streamArgs() []string {
+	if c.Method == "" {
+		return nil
+	}
+	return []string{"-Z", strconv.Itoa(c.Level)}
+}
+
+// gzipWriter wraps w with a gzip writer if the method is gzip. The returned
+// close function flushes the gzip trailer; it does not close w.
+func (c compression) gzipWriter(w io.Writer) (io.Writer, func() error, error) {
+	if c.Method != "gzip" {
+		return w, func() error { return nil }, nil
+	}
+	zw, err := gzip.NewWriterLevel(w, c.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	return zw, zw.Close, nil
+}
+
+// maybeGunzip decompresses r if it starts with the gzip magic bytes, so
+// compressed plain dumps (gzip or pg_dump -Z) restore transparently.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// reportCompression reports stored against raw bytes. raw is the size of the
+// uncompressed dump if known, otherwise the database size (approximate is
+// then true).
+func reportCompression(phase string, c compression, raw, stored int64, approximate bool, d time.Duration) {
+	if c.Method == "" || raw <= 0 {
+		return
+	}
+	ratio := float64(stored) / float64(raw)
+	ev := event{Type: "compression", Phase: phase, Compression: c.String(), Bytes: stored, RawBytes: raw, Ratio: ratio, DurationMs: d.Milliseconds()}
+	base := "uncompressed"
+	if approximate {
+		base = "database size"
+	}
+	emitOrLog(ev, fmt.Sprintf("Compression %s: %s of %s %s (%.1f%%) in %s.",
+		c, formatBytes(stored), base, formatBytes(raw), 100*ratio, d.Round(time.Millisecond)))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    compression
+		wantErr bool
+	}{
+		{"", compression{}, false},
+		{"none", compression{}, false},
+		{" NONE ", compression{}, false},
+		{"gzip", compression{Method: "gzip", Level: defaultCompressionLevel}, false},
+		{"gzip:1", compression{Method: "gzip", Level: 1}, false},
+		{"GZIP:9", compression{Method: "gzip", Level: 9}, false},
+		{"pg_dump", compression{Method: "pg_dump", Level: defaultCompressionLevel}, false},
+		{"pg_dump:3", compression{Method: "pg_dump", Level: 3}, false},
+		{"none:1", compression{}, true},
+		{"gzip:0", compression{}, true},
+		{"gzip:10", compression{}, true},
+		{"gzip:", compression{}, true},
+		{"gzip:fast", compression{}, true},
+		{"zstd", compression{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCompression(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCompression(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCompression(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionArgs(t *testing.T) {
+	tests := []struct {
+		c                 compression
+		str               string
+		dumpArgs, streamZ string
+	}{
+		{compression{}, "none", "", ""},
+		{compression{Method: "gzip", Level: 4}, "gzip:4", "", "4"},
+		{compression{Method: "pg_dump", Level: 7}, "pg_dump:7", "7", "7"},
+	}
+	zLevel := func(args []string) string {
+		if len(args) == 2 && args[0] == "-Z" {
+			return args[1]
+		}
+		if len(args) != 0 {
+			return "unexpected " + args[0]
+		}
+		return ""
+	}
+	for _, tt := range tests {
+		if got := tt.c.String(); got != tt.str {
+			t.Errorf("String() = %q, want %q", got, tt.str)
+		}
+		if got := zLevel(tt.c.pgDumpArgs()); got != tt.dumpArgs {
+			t.Errorf("%s: pgDumpArgs -Z %q, want %q", tt.str, got, tt.dumpArgs)
+		}
+		if got := zLevel(tt.c.streamArgs()); got != tt.streamZ {
+			t.Errorf("%s: streamArgs -Z %q, want %q", tt.str, got, tt.streamZ)
+		}
+	}
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	const dump = "--\n-- PostgreSQL database dump\n--\nCREATE TABLE t ();\n"
+	tests := []struct {
+		c          compression
+		compressed bool
+	}{
+		{compression{}, false},
+		{compression{Method: "pg_dump", Level: 6}, false},
+		{compression{Method: "gzip", Level: 1}, true},
+		{compression{Method: "gzip", Level: 9}, true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w, closeFn, err := tt.c.gzipWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, dump)
+		if err := closeFn(); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String() != dump; got != tt.compressed {
+			t.Errorf("%v: compressed = %v, want %v", tt.c, got, tt.compressed)
+		}
+		r, err := maybeGunzip(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != dump {
+			t.Errorf("%v: read back %q", tt.c, got)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ===== Credential conventions of PostgreSQL images =====
+
+// credentialConventions are the variables images use for the login, in order
+// of preference: a superuser comes first because globals and ownership need
+// one. defaultUser applies when only the password is set.
+var credentialConventions = []struct {
+	user, password, defaultUser string
+}{
+	{"POSTGRES_USER", "POSTGRES_PASSWORD", "postgres"},         // official image
+	{"", "POSTGRESQL_POSTGRES_PASSWORD", "postgres"},           // Bitnami, superuser next to a custom user
+	{"POSTGRESQL_USERNAME", "POSTGRESQL_PASSWORD", "postgres"}, // Bitnami
+	{"username", "password", ""},                               // CloudNativePG secret keys, e.g. from an env file
+}
+
+// databaseVars name the database created by the image, in order of preference.
+var databaseVars = []string{"POSTGRES_DB", "POSTGRESQL_DATABASE", "dbname"}
+
+// normalizeCredentials sets POSTGRES_USER, POSTGRES_PASSWORD and POSTGRES_DB
+// in env, the environment of container, from the first convention that is
+// configured. A variable may also be given as <name>_FILE (Docker secrets);
+// the file is then read inside the container.
+func normalizeCredentials(ctx context.Context, container containerRef, env map[string]string) {
+	lookup := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		if v := env[name]; v != "" {
+			return v
+		}
+		if path := env[name+"_FILE"]; path != "" {
+			v, err := readContainerFile(ctx, container, path)
+			if err != nil {
+				logf("Reading %s_FILE of '%s' failed: %v\n", name, container.Name, err)
+				return ""
+			}
+			return v
+		}
+		return ""
+	}
+	for _, c := range credentialConventions {
+		user, pass := lookup(c.user), lookup(c.password)
+		if user == "" && (pass == "" || c.defaultUser == "") {
+			continue
+		}
+		if user == "" {
+			user = c.defaultUser
+		}
+		env["POSTGRES_USER"], env["POSTGRES_PASSWORD"] = user, pass
+		break
+	}
+	for _, name := range databaseVars {
+		if db := lookup(name); db != "" {
+			env["POSTGRES_DB"] = db
+			break
+		}
+	}
+}
+
+// readContainerFile returns the content of a secret file in container
+// without the trailing newline.
+func readContainerFile(ctx context.Context, container containerRef, path string) (string, error) {
+	out, err := engineCommand(ctx, container.Engine, "exec", container.Name, "cat", path).Output()
+	if err != nil {
+		return "", fmt.Errorf("cat %s: %v", path, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// isBitnamiImage reports whether image follows the Bitnami conventions; it
+// has to be present on engine e already.
+func isBitnamiImage(ctx context.Context, e dockerEngine, image string) bool {
+	if strings.Contains(image, "bitnami/") {
+		return true
+	}
+	out, err := engineCommand(ctx, e, "image", "inspect", "--format", "{{range .Config.Env}}{{println .}}{{end}}", image).Output()
+	return err == nil && strings.Contains(string(out), "BITNAMI_APP_NAME=")
+}
+
+// containerEnvArgs returns the docker run arguments that set up the login
+// and database in a new container from image.
+func containerEnvArgs(ctx context.Context, e dockerEngine, image, user, pass, db string) []string {
+	vars := []string{"POSTGRES_USER=" + user, "POSTGRES_PASSWORD=" + pass, "POSTGRES_DB=" + db}
+	if isBitnamiImage(ctx, e, image) {
+		vars = []string{"POSTGRESQL_USERNAME=" + user, "POSTGRESQL_PASSWORD=" + pass, "POSTGRESQL_DATABASE=" + db}
+		if user != "postgres" {
+			// a custom Bitnami user is no superuser; enable postgres as well
+			vars = append(vars, "POSTGRESQL_POSTGRES_PASSWORD="+pass)
+		}
+	}
+	var args []string
+	for _, v := range vars {
+		args = append(args, "-e", v)
+	}
+	return args
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want map[string]string // POSTGRES_USER, POSTGRES_PASSWORD, POSTGRES_DB
+	}{
+		{
+			"official",
+			map[string]string{"POSTGRES_USER": "app", "POSTGRES_PASSWORD": "pw", "POSTGRES_DB": "shop"},
+			map[string]string{"POSTGRES_USER": "app", "POSTGRES_PASSWORD": "pw", "POSTGRES_DB": "shop"},
+		},
+		{
+			"official password only",
+			map[string]string{"POSTGRES_PASSWORD": "pw"},
+			map[string]string{"POSTGRES_USER": "postgres", "POSTGRES_PASSWORD": "pw"},
+		},
+		{
+			"bitnami superuser preferred",
+			map[string]string{"POSTGRESQL_USERNAME": "app", "POSTGRESQL_PASSWORD": "apppw", "POSTGRESQL_POSTGRES_PASSWORD": "su", "POSTGRESQL_DATABASE": "appdb"},
+			map[string]string{"POSTGRES_USER": "postgres", "POSTGRES_PASSWORD": "su", "POSTGRES_DB": "appdb"},
+		},
+		{
+			"bitnami custom user",
+			map[string]string{"POSTGRESQL_USERNAME": "app", "POSTGRESQL_PASSWORD": "apppw", "POSTGRESQL_DATABASE": "appdb"},
+			map[string]string{"POSTGRES_USER": "app", "POSTGRES_PASSWORD": "apppw", "POSTGRES_DB": "appdb"},
+		},
+		{
+			"cloudnativepg secret keys",
+			map[string]string{"username": "app", "password": "x", "dbname": "app"},
+			map[string]string{"POSTGRES_USER": "app", "POSTGRES_PASSWORD": "x", "POSTGRES_DB": "app"},
+		},
+		{
+			"secret keys need a user",
+			map[string]string{"password": "x"},
+			map[string]string{},
+		},
+		{
+			"nothing configured",
+			map[string]string{"PATH": "/usr/bin"},
+			map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := maps.Clone(tt.env)
+			normalizeCredentials(context.Background(), containerRef{Name: "pg"}, env)
+			for _, k := range []string{"POSTGRES_USER", "POSTGRES_PASSWORD", "POSTGRES_DB"} {
+				if env[k] != tt.want[k] {
+					t.Errorf("%s = %q, want %q", k, env[k], tt.want[k])
+				}
+			}
+		})
+	}
+}
+
+func TestContainerEnvArgs(t *testing.T) {
+	t.Setenv("PATH", t.TempDir()) // no docker: the image is judged by its name
+	tests := []struct {
+		name, image, user string
+		want              []string
+	}{
+		{
+			"official", "postgres:17", "app",
+			[]string{"-e", "POSTGRES_USER=app", "-e", "POSTGRES_PASSWORD=pw", "-e", "POSTGRES_DB=db"},
+		},
+		{
+			"bitnami postgres user", "bitnami/postgresql:17", "postgres",
+			[]string{"-e", "POSTGRESQL_USERNAME=postgres", "-e", "POSTGRESQL_PASSWORD=pw", "-e", "POSTGRESQL_DATABASE=db"},
+		},
+		{
+			"bitnami custom user", "docker.io/bitnami/postgresql:17", "app",
+			[]string{"-e", "POSTGRESQL_USERNAME=app", "-e", "POSTGRESQL_PASSWORD=pw", "-e", "POSTGRESQL_DATABASE=db", "-e", "POSTGRESQL_POSTGRES_PASSWORD=pw"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := containerEnvArgs(context.Background(), dockerEngine{}, tt.image, tt.user, "pw", "db")
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("containerEnvArgs(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
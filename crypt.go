@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ===== Encryption of dump artifacts =====
+
+// artifactKey is the AES-256 key for dump files written to the host (file
+// mode dumps, backups, exports). nil means artifacts are stored in clear text.
+// Encrypted files are recognised by their header and decrypted on the fly.
+var artifactKey []byte
+
+// encryptionKeyEnv holds the key itself (hex or base64), as an alternative to
+// --encryption-key-file.
+const encryptionKeyEnv = "PGUPGRADE_ENCRYPTION_KEY"
+
+// File layout: the magic, an 8 byte random nonce prefix, then records of at
+// most encChunkSize plaintext bytes sealed with AES-256-GCM. The nonce of a
+// record is the prefix followed by its 32 bit sequence number; the additional
+// data is the file header plus a flag marking the last record, so reordered,
+// dropped or truncated records fail authentication.
+const (
+	encMagic     = "PGUPENC1"
+	encChunkSize = 64 * 1024
+	encHeaderLen = len(encMagic) + 8
+)
+
+var errNoKey = errors.New("file is encrypted; provide the key with --encryption-key-file or $" + encryptionKeyEnv)
+
+// loadArtifactKey reads the key from keyFile or, if empty, from the
+// environment. The key is 32 bytes, hex or base64 encoded. A key file may
+// also hold the 32 raw bytes; they are taken as such only if they are not
+// valid hex or base64 text.
+func loadArtifactKey(keyFile string) ([]byte, error) {
+	var raw []byte
+	switch {
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		raw = data
+	case os.Getenv(encryptionKeyEnv) != "":
+		raw = []byte(os.Getenv(encryptionKeyEnv))
+	default:
+		return nil, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil && keyFile != "" {
+		key = raw
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes (raw, hex or base64)")
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	seq    uint32
+	buf    []byte
+}
+
+// newEncryptWriter encrypts everything written to it into w. Close must be
+// called to write the final record; it does not close w.
+func newEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderLen)
+	copy(header, encMagic)
+	if _, err := rand.Read(header[len(encMagic):]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// keep at least one byte back so the last record is written by Close
+	for len(e.buf) > encChunkSize {
+		if err := e.seal(e.buf[:encChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = append(e.buf[:0], e.buf[encChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	err := e.seal(e.buf, true)
+	e.buf = nil
+	return err
+}
+
+func (e *encryptWriter) seal(plain []byte, final bool) error {
+	out := e.aead.Seal(nil, recordNonce(e.header, e.seq), plain, recordAAD(e.header, final))
+	e.seq++
+	_, err := e.w.Write(out)
+	return err
+}
+
+func recordNonce(header []byte, seq uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[len(encMagic):])
+	binary.BigEndian.PutUint32(nonce[8:], seq)
+	return nonce
+}
+
+func recordAAD(header []byte, final bool) []byte {
+	aad := append([]byte{}, header...)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	seq    uint32
+	plain  []byte
+	done   bool
+}
+
+// newDecryptReader returns the plaintext of r, which must start with the
+// encryption header. Read fails if any record does not authenticate.
+func newDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return nil, fmt.Errorf("not an encrypted dump file")
+	}
+	return &decryptReader{r: bufio.NewReaderSize(r, encChunkSize+aead.Overhead()), aead: aead, header: header}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	record := make([]byte, encChunkSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, record)
+	if err == io.EOF {
+		return fmt.Errorf("encrypted dump file is truncated")
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// the record is the last one if nothing follows it
+	_, peekErr := d.r.Peek(1)
+	final := peekErr == io.EOF
+	plain, err := d.aead.Open(nil, recordNonce(d.header, d.seq), record[:n], recordAAD(d.header, final))
+	if err != nil {
+		return fmt.Errorf("decrypting dump file failed (wrong key or corrupted file)")
+	}
+	d.seq++
+	d.plain = plain
+	d.done = final
+	return nil
+}
+
+// isEncrypted reports whether the file at path starts with the encryption
+// header.
+func isEncrypted(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(encMagic))
+	n, _ := io.ReadFull(f, magic)
+	return n == len(magic) && string(magic) == encMagic, nil
+}
+
+// openArtifact opens a dump file for reading, decrypting it if needed.
+func openArtifact(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decryptIfNeeded(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{r, f}, nil
+}
+
+// decryptIfNeeded returns the plaintext of r if it starts with the
+// encryption header and r itself otherwise. name is used in error messages.
+func decryptIfNeeded(r io.Reader, name string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(encMagic)); string(magic) != encMagic {
+		return br, nil
+	}
+	if artifactKey == nil {
+		return nil, fmt.Errorf("%s: %w", name, errNoKey)
+	}
+	plain, err := newDecryptReader(br, artifactKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return plain, nil
+}
+
+// artifactSize returns the plaintext size of the dump file at path.
+func artifactSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	encrypted, err := isEncrypted(path)
+	if err != nil || !encrypted {
+		return fi.Size(), err
+	}
+	const overhead = 16 // GCM tag per record
+	body := fi.Size() - int64(encHeaderLen)
+	records := (body + encChunkSize + overhead - 1) / (encChunkSize + overhead)
+	return body - records*overhead, nil
+}
+
+// createArtifact wraps w so that it encrypts when a key is configured. The
+// returned close function finishes the encryption; it does not close w.
+func createArtifact(w io.Writer) (io.Writer, func() error, error) {
+	if artifactKey == nil {
+		return w, func() error { return nil }, nil
+	}
+	ew, err := newEncryptWriter(w, artifactKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ew, ew.Close, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, b byte) []byte {
+	t.Helper()
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func encryptForTest(t *testing.T, key, plain []byte, writeSize int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	ew, err := newEncryptWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := plain; len(rest) > 0; {
+		n := min(writeSize, len(rest))
+		if _, err := ew.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decryptForTest(key, data []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := testKey(t, 7)
+	tests := []struct {
+		name            string
+		size, writeSize int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"just below a record", encChunkSize - 1, 4096},
+		{"exactly one record", encChunkSize, encChunkSize},
+		{"one byte more", encChunkSize + 1, 1000},
+		{"several records, small writes", 3*encChunkSize + 5, 777},
+		{"several records, one write", 3 * encChunkSize, 3 * encChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := make([]byte, tt.size)
+			rand.Read(plain)
+			data := encryptForTest(t, key, plain, tt.writeSize)
+			if !bytes.HasPrefix(data, []byte(encMagic)) {
+				t.Fatalf("missing header")
+			}
+			got, err := decryptForTest(key, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("round trip of %d bytes returned %d different bytes", len(plain), len(got))
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsDamage(t *testing.T) {
+	key := testKey(t, 7)
+	plain := make([]byte, 3*encChunkSize+100)
+	rand.Read(plain)
+	data := encryptForTest(t, key, plain, encChunkSize)
+	record := encChunkSize + 16 // sealed record size (GCM tag)
+
+	tests := []struct {
+		name    string
+		damage  func([]byte) []byte
+		key     []byte
+		wantErr string
+	}{
+		{"wrong key", func(d []byte) []byte { return d }, testKey(t, 8), "wrong key or corrupted"},
+		{"flipped ciphertext byte", func(d []byte) []byte { d[encHeaderLen+10] ^= 1; return d }, key, "wrong key or corrupted"},
+		{"flipped nonce prefix", func(d []byte) []byte { d[len(encMagic)] ^= 1; return d }, key, "wrong key or corrupted"},
+		{"flipped tag of last record", func(d []byte) []byte { d[len(d)-1] ^= 1; return d }, key, "wrong key or corrupted"},
+		{"cut at a record boundary", func(d []byte) []byte { return d[:encHeaderLen+2*record] }, key, "wrong key or corrupted"},
+		{"cut inside a record", func(d []byte) []byte { return d[:encHeaderLen+record+100] }, key, "wrong key or corrupted"},
+		{"only the header", func(d []byte) []byte { return d[:encHeaderLen] }, key, "truncated"},
+		{"records swapped", func(d []byte) []byte {
+			first := append([]byte{}, d[encHeaderLen:encHeaderLen+record]...)
+			copy(d[encHeaderLen:], d[encHeaderLen+record:encHeaderLen+2*record])
+			copy(d[encHeaderLen+record:], first)
+			return d
+		}, key, "wrong key or corrupted"},
+		{"data appended", func(d []byte) []byte { return append(d, make([]byte, 40)...) }, key, "wrong key or corrupted"},
+		{"not encrypted", func([]byte) []byte { return []byte("-- PostgreSQL database dump\n") }, key, "not an encrypted dump file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := tt.damage(append([]byte{}, data...))
+			got, err := decryptForTest(tt.key, damaged)
+			if err == nil {
+				t.Fatalf("decrypted %d bytes without error", len(got))
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadArtifactKey(t *testing.T) {
+	key := testKey(t, 0xab)
+	tests := []struct {
+		name, env string
+		file      []byte
+		wantErr   bool
+	}{
+		{name: "hex", env: strings.Repeat("ab", 32)},
+		{name: "hex with newline", env: strings.Repeat("ab", 32) + "\n"},
+		{name: "base64", env: "q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s="},
+		{name: "too short", env: strings.Repeat("ab", 16), wantErr: true},
+		{name: "garbage", env: "not a key", wantErr: true},
+		{name: "raw bytes in env", env: string(key), wantErr: true},
+		{name: "file with hex", file: []byte(strings.Repeat("ab", 32) + "\n")},
+		{name: "file with raw bytes", file: key},
+		// 32 bytes of hex text are a 16-byte key, not a raw key
+		{name: "file with short hex", file: []byte(strings.Repeat("ab", 16)), wantErr: true},
+		{name: "file too short", file: key[:31], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(encryptionKeyEnv, tt.env)
+			var keyFile string
+			if tt.file != nil {
+				keyFile = filepath.Join(t.TempDir(), "key")
+				if err := os.WriteFile(keyFile, tt.file, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := loadArtifactKey(keyFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, key) {
+				t.Errorf("key = %x, want %x", got, key)
+			}
+		})
+	}
+}
+
+func TestArtifactSize(t *testing.T) {
+	key := testKey(t, 7)
+	for _, size := range []int{0, 1, encChunkSize, 2*encChunkSize + 3} {
+		path := filepath.Join(t.TempDir(), "app.dump")
+		if err := os.WriteFile(path, encryptForTest(t, key, make([]byte, size), 4096), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := artifactSize(path); err != nil || got != int64(size) {
+			t.Errorf("artifactSize of %d encrypted bytes = %d, %v", size, got, err)
+		}
+	}
+}
+
+func TestDetectFormatEncrypted(t *testing.T) {
+	key := testKey(t, 7)
+	path := filepath.Join(t.TempDir(), "app.dump.enc")
+	if err := os.WriteFile(path, encryptForTest(t, key, []byte("PGDMP\x01\x0e\x00"), 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { artifactKey = nil }()
+
+	artifactKey = key
+	if got, err := detectFormat(path); err != nil || got != formatCustom {
+		t.Errorf("detectFormat with key = %q, %v; want %q", got, err, formatCustom)
+	}
+	artifactKey = nil
+	if _, err := detectFormat(path); !errors.Is(err, errNoKey) {
+		t.Errorf("detectFormat without key: err = %v, want errNoKey", err)
+	}
+}
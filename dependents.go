@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== Dependent application containers =====
+
+// containerInfo is the part of "docker inspect" the tool looks at.
+type containerInfo struct {
+	Name   string `json:"Name"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Env    []string          `json:"Env"`
+		Labels map[string]string `json:"Labels"`
+		// ExposedPorts keys look like "5432/tcp"
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	} `json:"Config"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			Aliases []string `json:"Aliases"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+	State struct {
+		Status    string    `json:"Status"`
+		Running   bool      `json:"Running"`
+		StartedAt time.Time `json:"StartedAt"`
+	} `json:"State"`
+}
+
+// dependent is an application container found to use the source database.
+type dependent struct {
+	Name    string
+	Reasons []string
+}
+
+// Compose labels used to find services that depend on the database service.
+const (
+	composeProjectLabel   = "com.docker.compose.project"
+	composeServiceLabel   = "com.docker.compose.service"
+	composeDependsOnLabel = "com.docker.compose.depends_on"
+)
+
+// inspectRunning returns the running containers of engine e.
+func inspectRunning(ctx context.Context, e dockerEngine) ([]containerInfo, error) {
+	return inspectContainers(ctx, e, false)
+}
+
+// inspectContainers returns the containers of engine e, stopped ones too if
+// all is set.
+func inspectContainers(ctx context.Context, e dockerEngine, all bool) ([]containerInfo, error) {
+	psArgs := []string{"ps", "-q"}
+	if all {
+		psArgs = append(psArgs, "-a")
+	}
+	ids, err := engineCommand(ctx, e, psArgs...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing containers failed: %v", err)
+	}
+	if len(strings.Fields(string(ids))) == 0 {
+		return nil, nil
+	}
+	out, err := engineCommand(ctx, e, append([]string{"inspect"}, strings.Fields(string(ids))...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("inspecting containers failed: %v", err)
+	}
+	var infos []containerInfo
+	if err := json.Unmarshal(out, &infos); err != nil {
+		return nil, fmt.Errorf("decoding docker inspect failed: %w", err)
+	}
+	for i := range infos {
+		infos[i].Name = strings.TrimPrefix(infos[i].Name, "/")
+	}
+	return infos, nil
+}
+
+// findDependents lists the running containers that appear to use the source
+// container: they share a user-defined network with it, mention its name or
+// a network alias in their environment, or depend on its compose service.
+// The containers in exclude (source, destination) are skipped.
+func findDependents(ctx context.Context, source containerRef, exclude ...containerRef) ([]dependent, error) {
+	name := source.Name
+	infos, err := inspectRunning(ctx, source.Engine)
+	if err != nil {
+		return nil, err
+	}
+	var src *containerInfo
+	for i := range infos {
+		if infos[i].Name == name {
+			src = &infos[i]
+		}
+	}
+	if src == nil {
+		return nil, fmt.Errorf("container '%s' is not running", name)
+	}
+	skip := map[string]bool{name: true}
+	for _, x := range exclude {
+		skip[x.Name] = true
+	}
+
+	// names under which the source can be reached
+	hostnames := map[string]bool{name: true}
+	networks := map[string]bool{}
+	for net, settings := range src.NetworkSettings.Networks {
+		// every container is on the default networks, that says nothing
+		if net != "bridge" && net != "host" && net != "none" {
+			networks[net] = true
+		}
+		for _, alias := range settings.Aliases {
+			hostnames[alias] = true
+		}
+	}
+	var mentions []*regexp.Regexp
+	for h := range hostnames {
+		mentions = append(mentions, regexp.MustCompile(`(^|[^A-Za-z0-9_.-])`+regexp.QuoteMeta(h)+`([^A-Za-z0-9_.-]|$)`))
+	}
+	project, service := src.Config.Labels[composeProjectLabel], src.Config.Labels[composeServiceLabel]
+
+	var deps []dependent
+	for _, c := range infos {
+		if skip[c.Name] {
+			continue
+		}
+		var reasons []string
+		for net := range c.NetworkSettings.Networks {
+			if networks[net] {
+				reasons = append(reasons, "network "+net)
+			}
+		}
+		for _, kv := range c.Config.Env {
+			key, value, _ := strings.Cut(kv, "=")
+			for _, re := range mentions {
+				if re.MatchString(value) {
+					reasons = append(reasons, "env "+key)
+					break
+				}
+			}
+		}
+		if service != "" && c.Config.Labels[composeProjectLabel] == project {
+			for _, d := range strings.Split(c.Config.Labels[composeDependsOnLabel], ",") {
+				if svc, _, _ := strings.Cut(d, ":"); svc == service {
+					reasons = append(reasons, "compose depends_on "+service)
+				}
+			}
+		}
+		if len(reasons) > 0 {
+			sort.Strings(reasons)
+			deps = append(deps, dependent{Name: c.Name, Reasons: reasons})
+		}
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Name < deps[j].Name })
+	return deps, nil
+}
+
+// containersByLabel returns the running containers of engine e matching all
+// selectors ("key" or "key=value").
+func containersByLabel(ctx context.Context, e dockerEngine, selectors []string) ([]string, error) {
+	args := []string{"ps", "--format", "{{.Names}}"}
+	for _, s := range selectors {
+		args = append(args, "--filter", "label="+s)
+	}
+	out, err := engineCommand(ctx, e, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing containers failed: %v", err)
+	}
+	names := strings.Fields(string(out))
+	sort.Strings(names)
+	return names, nil
+}
+
+// stopApplications stops the given containers of engine e and returns a
+// function that starts them again. An interrupt starts them as well.
+func stopApplications(ctx context.Context, e dockerEngine, containers []string) (start func(ctx context.Context), err error) {
+	start = func(ctx context.Context) {
+		logf("Starting application containers: %s\n", strings.Join(containers, ", "))
+		args := append([]string{"start"}, containers...)
+		if out, err := engineCommand(ctx, e, args...).CombinedOutput(); err != nil {
+			logf("Starting application containers failed: %v - %s\n", err, out)
+		}
+	}
+	release := onInterrupt("start application containers again", start)
+	logf("Stopping application containers: %s\n", strings.Join(containers, ", "))
+	args := append([]string{"stop"}, containers...)
+	reportCommand(dockerCall{Engine: e, Args: args}.String())
+	if out, err := engineCommand(ctx, e, args...).CombinedOutput(); err != nil {
+		// some may have stopped; start them all again
+		release()
+		start(context.WithoutCancel(ctx))
+		return nil, fmt.Errorf("%v - %s", err, out)
+	}
+	return func(ctx context.Context) {
+		release()
+		start(ctx)
+	}, nil
+}
+
+// readApplicationContainers shows the containers that depend on source and
+// asks which ones to stop during the migration; label selectors replace the
+// detected list. It returns the names of the containers, which run on the
+// engine of source.
+func readApplicationContainers(ctx context.Context, reader *bufio.Reader, source, destination containerRef) []string {
+	e := source.Engine
+	deps, err := findDependents(ctx, source, destination)
+	if err != nil {
+		logf("Looking for application containers failed: %v\n", err)
+	}
+	var names []string
+	answer := "labels"
+	if len(deps) > 0 {
+		promptf("Containers that appear to use '%s':\n", source.Name)
+		for _, d := range deps {
+			promptf("  %s (%s)\n", d.Name, strings.Join(d.Reasons, ", "))
+			names = append(names, d.Name)
+		}
+		answer = strings.ToLower(readLineWithDefault(reader, "Stop them during the migration and start them again afterwards? (yes/no/labels)", "no"))
+	}
+	switch answer {
+	case "yes":
+	case "labels":
+		selectors := splitList(readLineWithDefault(reader, "Label selectors of application containers to stop (key or key=value, comma separated, empty = none)", ""))
+		if len(selectors) == 0 {
+			return nil
+		}
+		if names, err = containersByLabel(ctx, e, selectors); err != nil {
+			logf("%v; no containers will be stopped.\n", err)
+			return nil
+		}
+		names = slices.DeleteFunc(names, func(n string) bool {
+			return n == source.Name || n == destination.Name
+		})
+		if len(names) == 0 {
+			logf("No running containers match %s.\n", strings.Join(selectors, ", "))
+			return nil
+		}
+		promptf("Stop %s during the migration? (yes/no): ", strings.Join(names, ", "))
+		confirm, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(confirm)) != "yes" {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return names
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindDependents(t *testing.T) {
+	dir := fakeDocker(t, `case "$1" in
+ps) echo 1; echo 2; echo 3; echo 4; echo 5; echo 6 ;;
+inspect) cat "$FAKE_DOCKER_DIR/inspect" ;;
+esac`)
+	inspect := `[
+		{"Name": "/db", "Config": {"Image": "postgres:13", "Labels": {"com.docker.compose.project": "shop", "com.docker.compose.service": "postgres"}},
+		 "NetworkSettings": {"Networks": {"bridge": {}, "shop_default": {"Aliases": ["postgres", "db"]}}}},
+		{"Name": "/db-new", "Config": {"Image": "postgres:17"}, "NetworkSettings": {"Networks": {"shop_default": {}}}},
+		{"Name": "/web", "Config": {"Image": "shop:1", "Env": ["DATABASE_URL=postgres://app@postgres:5432/shop", "PORT=80"],
+		 "Labels": {"com.docker.compose.project": "shop", "com.docker.compose.depends_on": "postgres:service_healthy:false,redis:service_started:false"}},
+		 "NetworkSettings": {"Networks": {"shop_default": {}}}},
+		{"Name": "/worker", "Config": {"Image": "shop:1", "Env": ["PGHOST=db"]}, "NetworkSettings": {"Networks": {"bridge": {}}}},
+		{"Name": "/lookalike", "Config": {"Image": "x:1", "Env": ["HOST=postgres-replica", "NAME=mydb"]}, "NetworkSettings": {"Networks": {"bridge": {}}}},
+		{"Name": "/other", "Config": {"Image": "x:1", "Labels": {"com.docker.compose.project": "blog", "com.docker.compose.depends_on": "postgres:service_started:false"}},
+		 "NetworkSettings": {"Networks": {"bridge": {}}}}
+	]`
+	if err := os.WriteFile(filepath.Join(dir, "inspect"), []byte(inspect), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := dockerEngine{}
+	got, err := findDependents(context.Background(), onEngine("db", e), onEngine("db-new", e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dependent{
+		{Name: "web", Reasons: []string{"compose depends_on postgres", "env DATABASE_URL", "network shop_default"}},
+		{Name: "worker", Reasons: []string{"env PGHOST"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dependents = %+v, want %+v", got, want)
+	}
+
+	if _, err := findDependents(context.Background(), onEngine("gone", e)); err == nil {
+		t.Error("no error for a container that is not running")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Finding PostgreSQL containers =====
+
+// postgresLabels are image labels that name the software in an image.
+var postgresLabels = []string{
+	"org.opencontainers.image.title",
+	"org.opencontainers.image.description",
+	"org.opencontainers.image.ref.name",
+	"org.opencontainers.image.base.name",
+	"org.label-schema.name",
+	"org.label-schema.description",
+}
+
+// pgCtlProbe exits with 0 if pg_ctl exists in a container: on the PATH
+// (Alpine, Bitnami) or in the Debian and RPM package locations.
+const pgCtlProbe = `command -v pg_ctl >/dev/null 2>&1 && exit 0; for f in /usr/lib/postgresql/*/bin/pg_ctl /usr/pgsql-*/bin/pg_ctl; do [ -x "$f" ] && exit 0; done; exit 1`
+
+const probeTimeout = 10 * time.Second
+
+// isPostgresImage reports whether image looks like a PostgreSQL image.
+func isPostgresImage(image string) bool {
+	return strings.Contains(strings.ToLower(image), "postgres")
+}
+
+// postgresSignal returns what marks info as a PostgreSQL container, or "" if
+// its metadata gives no hint. Images built on the official one (postgis,
+// timescaledb) inherit PG_MAJOR and PG_VERSION and the exposed port.
+func postgresSignal(info containerInfo) string {
+	if isPostgresImage(info.Config.Image) {
+		return "image name"
+	}
+	for _, kv := range info.Config.Env {
+		if name, _, _ := strings.Cut(kv, "="); name == "PG_MAJOR" || name == "PG_VERSION" {
+			return "env " + name
+		}
+	}
+	for _, key := range postgresLabels {
+		if isPostgresImage(info.Config.Labels[key]) {
+			return "label " + key
+		}
+	}
+	if _, ok := info.Config.ExposedPorts["5432/tcp"]; ok {
+		return "port 5432"
+	}
+	return ""
+}
+
+// discoverPostgres returns the PostgreSQL containers of engine e, stopped ones
+// included if all is set. Running containers without a hint in their metadata
+// are probed for pg_ctl; stopped ones cannot be.
+func discoverPostgres(ctx context.Context, e dockerEngine, all bool) ([]containerInfo, error) {
+	infos, err := inspectContainers(ctx, e, all)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(infos))
+	sem := make(chan struct{}, 8)
+	var wg sync.WaitGroup
+	for i, info := range infos {
+		if postgresSignal(info) != "" {
+			found[i] = true
+			continue
+		}
+		if !info.State.Running {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			found[i] = hasPgCtl(ctx, e, info.Name)
+		}()
+	}
+	wg.Wait()
+	var containers []containerInfo
+	for i, info := range infos {
+		if found[i] {
+			containers = append(containers, info)
+		}
+	}
+	return containers, nil
+}
+
+// hasPgCtl runs pgCtlProbe in a running container. Images without a shell
+// count as not PostgreSQL.
+func hasPgCtl(ctx context.Context, e dockerEngine, name string) bool {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return engineCommand(ctx, e, "exec", name, "sh", "-c", pgCtlProbe).Run() == nil
+}
+
+// startTemporarily starts a stopped container and waits for PostgreSQL. The
+// returned function stops the container again; an interrupt stops it too.
+func startTemporarily(ctx context.Context, container containerRef) (func(), error) {
+	logf("Starting container '%s'...\n", container)
+	cmd := engineCommand(ctx, container.Engine, "start", container.Name)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("starting container '%s' failed: %v - %s", container, err, strings.TrimSpace(stderr.String()))
+	}
+	stop := func(ctx context.Context) {
+		logf("Stopping container '%s' again...\n", container)
+		engineCommand(ctx, container.Engine, "stop", container.Name).Run()
+	}
+	release := onInterrupt(fmt.Sprintf("stop container '%s'", container), stop)
+	stopAgain := func() {
+		release()
+		stop(context.WithoutCancel(ctx))
+	}
+	// pg_isready does not authenticate, so any user will do
+	if !waitForPgReady(ctx, container, "postgres", "", "postgres", 60*time.Second) {
+		stopAgain()
+		return nil, fmt.Errorf("PostgreSQL in container '%s' did not become ready in time", container)
+	}
+	return stopAgain, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func inspectInfo(t *testing.T, doc string) containerInfo {
+	t.Helper()
+	var info containerInfo
+	if err := json.Unmarshal([]byte(doc), &info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestPostgresSignal(t *testing.T) {
+	tests := []struct {
+		name, doc, want string
+	}{
+		{"official image", `{"Config": {"Image": "postgres:16"}}`, "image name"},
+		{"registry path", `{"Config": {"Image": "registry.local/team/PostgreSQL-custom:1"}}`, "image name"},
+		{"postgis", `{"Config": {"Image": "ghcr.io/acme/geo:2", "Env": ["PATH=/usr/bin", "PG_MAJOR=16"]}}`, "env PG_MAJOR"},
+		{"version env", `{"Config": {"Image": "acme/db:1", "Env": ["PG_VERSION=15.4"]}}`, "env PG_VERSION"},
+		{"oci title", `{"Config": {"Image": "acme/db:1", "Labels": {"org.opencontainers.image.title": "PostgreSQL 16"}}}`, "label org.opencontainers.image.title"},
+		{"label schema", `{"Config": {"Image": "acme/db:1", "Labels": {"org.label-schema.name": "bitnami/postgresql"}}}`, "label org.label-schema.name"},
+		{"exposed port", `{"Config": {"Image": "acme/db:1", "ExposedPorts": {"5432/tcp": {}}}}`, "port 5432"},
+		{"other label", `{"Config": {"Image": "redis:7", "Labels": {"maintainer": "postgres fans"}}}`, ""},
+		{"other port", `{"Config": {"Image": "mysql:8", "ExposedPorts": {"3306/tcp": {}}}}`, ""},
+		{"env value only", `{"Config": {"Image": "app:1", "Env": ["DB=PG_MAJOR"]}}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postgresSignal(inspectInfo(t, tt.doc)); got != tt.want {
+				t.Errorf("postgresSignal = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverPostgres(t *testing.T) {
+	dir := fakeDocker(t, `case "$1" in
+ps) echo 1; echo 2 ;;
+inspect) cat "$FAKE_DOCKER_DIR/inspect.json" ;;
+exec) [ "$2" = custom-pg ] ;;
+*) exit 1 ;;
+esac`)
+	inspect := `[
+		{"Name": "/db", "Config": {"Image": "postgres:16"}, "State": {"Status": "running", "Running": true}},
+		{"Name": "/old", "Config": {"Image": "acme/pg:9", "Env": ["PG_MAJOR=9.6"]}, "State": {"Status": "exited"}},
+		{"Name": "/custom-pg", "Config": {"Image": "acme/db:1"}, "State": {"Status": "running", "Running": true}},
+		{"Name": "/cache", "Config": {"Image": "redis:7"}, "State": {"Status": "running", "Running": true}},
+		{"Name": "/stopped-custom", "Config": {"Image": "acme/db:1"}, "State": {"Status": "exited"}}
+	]`
+	if err := os.WriteFile(filepath.Join(dir, "inspect.json"), []byte(inspect), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := discoverPostgres(context.Background(), dockerEngine{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	// stopped containers without a hint cannot be probed
+	if want := []string{"db", "old", "custom-pg"}; !slices.Equal(names, want) {
+		t.Errorf("found %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Docker engines =====
+
+// dockerEngine selects the Docker engine a container runs on: a context from
+// "docker context ls" or a host URL as in $DOCKER_HOST. The zero value is the
+// engine the docker CLI uses by default.
+type dockerEngine struct {
+	Context string `json:"context,omitempty"`
+	Host    string `json:"host,omitempty"` // ssh://user@host or tcp://host:2376
+}
+
+var contextNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.+-]*$`)
+
+// parseEngine parses a context name or an ssh://, tcp:// or unix:// host.
+// "" and "local" select the default engine.
+func parseEngine(s string) (dockerEngine, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || s == "local":
+		return dockerEngine{}, nil
+	case strings.Contains(s, "://"):
+		scheme, _, _ := strings.Cut(s, "://")
+		switch scheme {
+		case "ssh", "tcp", "unix":
+			return dockerEngine{Host: s}, nil
+		}
+		return dockerEngine{}, fmt.Errorf("unsupported Docker host %q (ssh://, tcp:// or unix://)", s)
+	case contextNamePattern.MatchString(s):
+		return dockerEngine{Context: s}, nil
+	}
+	return dockerEngine{}, fmt.Errorf("invalid Docker context name %q", s)
+}
+
+func (e dockerEngine) isLocal() bool {
+	return e.Context == "" && e.Host == ""
+}
+
+func (e dockerEngine) String() string {
+	switch {
+	case e.Context != "":
+		return "context " + e.Context
+	case e.Host != "":
+		return e.Host
+	}
+	return "local"
+}
+
+// globalArgs returns the docker CLI options selecting the engine.
+func (e dockerEngine) globalArgs() []string {
+	switch {
+	case e.Context != "":
+		return []string{"--context", e.Context}
+	case e.Host != "":
+		return []string{"--host", e.Host}
+	}
+	return nil
+}
+
+// containerRef identifies a container on a Docker engine. The engine travels
+// with the name, so no argument is ever parsed for it.
+type containerRef struct {
+	Name   string       `json:"name"`
+	Engine dockerEngine `json:"engine"`
+}
+
+// onEngine returns the reference for name on engine e.
+func onEngine(name string, e dockerEngine) containerRef {
+	return containerRef{Name: name, Engine: e}
+}
+
+func (c containerRef) String() string {
+	return c.Name
+}
+
+// engineCommand prepares "docker args..." against engine e.
+func engineCommand(ctx context.Context, e dockerEngine, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "docker", append(e.globalArgs(), args...)...)
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// dockerCall is a docker command line and the engine it runs against.
+type dockerCall struct {
+	Engine dockerEngine
+	Args   []string
+}
+
+func (d dockerCall) String() string {
+	return "docker " + formatArgs(d.Args)
+}
+
+func (d dockerCall) command(ctx context.Context) *exec.Cmd {
+	return engineCommand(ctx, d.Engine, d.Args...)
+}
+
+// ===== Byte-count check for streams between engines =====
+
+// A stream between engines passes through two docker clients and usually an
+// SSH or TLS connection. Both ends count the bytes inside the container with
+// dd, which reports "<n> bytes ..." on stderr; the counts are compared with
+// what the tool received and sent, so a silently truncated stream is detected.
+
+// countingSourceScript runs "$@" and copies its stdout through dd while
+// keeping the exit status of the command (POSIX sh has no pipefail).
+const countingSourceScript = `exec 4>&1; rc=$({ { "$@"; echo $? >&5; } | dd bs=65536 >&4; } 5>&1); exit ${rc:-1}`
+
+// countingSinkScript feeds stdin through dd into "$@".
+const countingSinkScript = `dd bs=65536 | "$@"`
+
+var (
+	ddBytesPattern  = regexp.MustCompile(`(?m)^(\d+) bytes`)
+	ddStatusPattern = regexp.MustCompile(`(?m)^(\d+\+\d+ records (in|out)|\d+ bytes .*copied.*)\n?`)
+)
+
+// wrapCounting rewrites "exec [options] <container> tool..." as built by
+// pgExec so that the tool runs under script in the container.
+func wrapCounting(args []string, script string) ([]string, bool) {
+	if len(args) == 0 || args[0] != "exec" {
+		return args, false
+	}
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "-e":
+			i++ // skip the value
+		case strings.HasPrefix(args[i], "-"):
+		default:
+			wrapped := append(append([]string{}, args[:i+1]...), "sh", "-c", script, "sh")
+			return append(wrapped, args[i+1:]...), true
+		}
+	}
+	return args, false
+}
+
+// ddCount extracts the byte count dd reported in stderr.
+func ddCount(stderr string) (int64, bool) {
+	m := ddBytesPattern.FindAllStringSubmatch(stderr, -1)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(m[len(m)-1][1], 10, 64)
+	return n, err == nil
+}
+
+// withoutDDStatus removes dd's statistics from stderr for error messages.
+func withoutDDStatus(stderr string) string {
+	return ddStatusPattern.ReplaceAllString(stderr, "")
+}
+
+// checkByteCounts compares the counts reported by dd on both ends with the
+// bytes the tool received from the source and sent to the destination.
+func checkByteCounts(srcStderr, dstStderr string, received, sent int64) error {
+	dumped, ok := ddCount(srcStderr)
+	if !ok {
+		return fmt.Errorf("integrity check: source did not report a byte count")
+	}
+	restored, ok := ddCount(dstStderr)
+	if !ok {
+		return fmt.Errorf("integrity check: destination did not report a byte count")
+	}
+	if dumped != received {
+		return fmt.Errorf("integrity check: source wrote %d bytes, received %d", dumped, received)
+	}
+	if restored != sent {
+		return fmt.Errorf("integrity check: sent %d bytes, destination read %d", sent, restored)
+	}
+	logf("Integrity check passed: %s dumped, %s received by the destination.\n", formatBytes(dumped), formatBytes(restored))
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseEngine(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    dockerEngine
+		wantErr bool
+	}{
+		{"", dockerEngine{}, false},
+		{"local", dockerEngine{}, false},
+		{"  local ", dockerEngine{}, false},
+		{"prod", dockerEngine{Context: "prod"}, false},
+		{"prod-eu.1", dockerEngine{Context: "prod-eu.1"}, false},
+		{"ssh://ops@db1", dockerEngine{Host: "ssh://ops@db1"}, false},
+		{"tcp://10.0.0.5:2376", dockerEngine{Host: "tcp://10.0.0.5:2376"}, false},
+		{"unix:///run/user/1000/docker.sock", dockerEngine{Host: "unix:///run/user/1000/docker.sock"}, false},
+		{"http://db1:2375", dockerEngine{}, true},
+		{"-prod", dockerEngine{}, true},
+		{"prod env", dockerEngine{}, true},
+		{"app@prod", dockerEngine{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseEngine(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEngine(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseEngine(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEngineArgs(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		engine dockerEngine
+		prefix []string
+	}{
+		{"local", dockerEngine{}, nil},
+		{"context", dockerEngine{Context: "prod"}, []string{"--context", "prod"}},
+		{"host", dockerEngine{Host: "ssh://ops@db1"}, []string{"--host", "ssh://ops@db1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// names and databases with '@' are passed on untouched
+			container := onEngine("app@prod", tt.engine)
+			cmd := pgExecEnv(container, "pw", []string{"PGOPTIONS=-c x=1"}, true, "psql", "-d", "app@prod").command(ctx)
+			want := append([]string{"docker"}, tt.prefix...)
+			want = append(want, "exec", "-e", "PGPASSWORD=pw", "-e", "PGAPPNAME="+sessionAppName,
+				"-e", "PGOPTIONS=-c x=1", "-i", "app@prod", "psql", "-d", "app@prod")
+			if !slices.Equal(cmd.Args, want) {
+				t.Errorf("args = %q\nwant   %q", cmd.Args, want)
+			}
+
+			cmd = engineCommand(ctx, tt.engine, "inspect", "app@prod")
+			want = append(append([]string{"docker"}, tt.prefix...), "inspect", "app@prod")
+			if !slices.Equal(cmd.Args, want) {
+				t.Errorf("engineCommand args = %q, want %q", cmd.Args, want)
+			}
+		})
+	}
+}
+
+func TestPgExecStdin(t *testing.T) {
+	for _, stdin := range []bool{false, true} {
+		args := pgExec(onEngine("pg", dockerEngine{}), "pw", stdin, "pg_restore").Args
+		if got := slices.Contains(args, "-i"); got != stdin {
+			t.Errorf("pgExec(stdin=%v) args %q", stdin, args)
+		}
+	}
+}
+
+func TestContainerRefJSON(t *testing.T) {
+	ref := onEngine("shop-db", dockerEngine{Host: "ssh://ops@db1"})
+	data, err := json.Marshal(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"shop-db","engine":{"host":"ssh://ops@db1"}}`; string(data) != want {
+		t.Errorf("json = %s, want %s", data, want)
+	}
+	var back containerRef
+	if err := json.Unmarshal(data, &back); err != nil || back != ref {
+		t.Errorf("round trip = %+v, %v", back, err)
+	}
+	if !(containerRef{Name: "x"}).Engine.isLocal() {
+		t.Error("zero engine is not local")
+	}
+}
+
+func TestWrapCounting(t *testing.T) {
+	call := pgExec(onEngine("pg", dockerEngine{}), "pw", false, "pg_dump", "-d", "app")
+	wrapped, ok := wrapCounting(call.Args, countingSourceScript)
+	if !ok {
+		t.Fatalf("wrapCounting(%q) did not find the container", call.Args)
+	}
+	want := []string{"exec", "-e", "PGPASSWORD=pw", "-e", "PGAPPNAME=" + sessionAppName, "pg",
+		"sh", "-c", countingSourceScript, "sh", "pg_dump", "-d", "app"}
+	if !slices.Equal(wrapped, want) {
+		t.Errorf("wrapped = %q\nwant      %q", wrapped, want)
+	}
+	if _, ok := wrapCounting([]string{"run", "postgres"}, countingSinkScript); ok {
+		t.Error("wrapped a non-exec command")
+	}
+}
+
+func TestCheckByteCounts(t *testing.T) {
+	src := "12+1 records in\n12+1 records out\n790528 bytes (791 kB, 772 KiB) copied, 0.01 s, 79 MB/s\n"
+	dst := "pg_restore: warning: x\n790528 bytes copied\n"
+	tests := []struct {
+		name           string
+		src, dst       string
+		received, sent int64
+		wantErr        string
+	}{
+		{"match", src, dst, 790528, 790528, ""},
+		{"short read", src, dst, 790000, 790528, "source wrote 790528 bytes, received 790000"},
+		{"short write", src, dst, 790528, 790528 + 1, "destination read 790528"},
+		{"no source count", "pg_dump: error\n", dst, 0, 0, "source did not report"},
+		{"no destination count", src, "", 790528, 790528, "destination did not report"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkByteCounts(tt.src, tt.dst, tt.received, tt.sent)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if got := withoutDDStatus(src + "pg_dump: error: boom\n"); got != "pg_dump: error: boom\n" {
+		t.Errorf("withoutDDStatus left %q", got)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Output: human text or newline-delimited JSON events =====
+
+// outputJSON is set by --output json. Stdout then carries one JSON event per
+// line; prompts and the output of child processes go to stderr instead.
+var outputJSON bool
+
+// Error codes attached to "error" events.
+const (
+	errDocker          = "docker_unavailable"
+	errNoContainers    = "no_containers"
+	errInvalidInput    = "invalid_input"
+	errConnection      = "connection_failed"
+	errContainerCreate = "container_create_failed"
+	errGlobals         = "globals_failed"
+	errRoleCheck       = "role_check_failed"
+	errMigration       = "migration_failed"
+	errDump            = "dump_failed"
+	errBackup          = "backup_failed"
+	errCopy            = "copy_failed"
+	errRestore         = "restore_failed"
+	errVerification    = "verification_failed"
+	errReplication     = "replication_failed"
+	errMaintenance     = "maintenance_failed"
+	errStopApps        = "stop_apps_failed"
+	errCompose         = "compose_failed"
+	errHook            = "hook_failed"
+)
+
+// event is one line of the JSON output. Only the fields relevant to the
+// event type are set.
+type event struct {
+	Time        string   `json:"time"`
+	Type        string   `json:"type"`
+	Container   string   `json:"container,omitempty"` // fleet member the event is about
+	Phase       string   `json:"phase,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	Message     string   `json:"message,omitempty"`
+	Command     string   `json:"command,omitempty"`
+	Bytes       int64    `json:"bytes,omitempty"`
+	RawBytes    int64    `json:"raw_bytes,omitempty"`
+	Ratio       float64  `json:"ratio,omitempty"`
+	Compression string   `json:"compression,omitempty"`
+	DurationMs  int64    `json:"duration_ms,omitempty"`
+	BytesPerSec int64    `json:"bytes_per_sec,omitempty"`
+	EtaMs       int64    `json:"eta_ms,omitempty"`
+	LagBytes    *int64   `json:"lag_bytes,omitempty"`
+	Details     []string `json:"details,omitempty"`
+	Check       string   `json:"check,omitempty"`
+	Passed      *bool    `json:"passed,omitempty"`
+	Code        string   `json:"code,omitempty"`
+	Error       string   `json:"error,omitempty"`
+
+	Inventory *inventoryEntry `json:"inventory,omitempty"` // one container, for "inventory"
+}
+
+var eventMu sync.Mutex
+
+func emit(ev event) {
+	if !outputJSON {
+		return
+	}
+	ev.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	json.NewEncoder(os.Stdout).Encode(ev)
+}
+
+// humanOut is where text meant for a person goes (stdout unless JSON mode).
+func humanOut() io.Writer {
+	if outputJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// logf reports progress: plain text, or a "log" event in JSON mode.
+func logf(format string, args ...any) {
+	if outputJSON {
+		emit(event{Type: "log", Message: strings.TrimSpace(fmt.Sprintf(format, args...))})
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// promptf prints an interactive question; in JSON mode it goes to stderr so
+// stdout stays machine readable.
+func promptf(format string, args ...any) {
+	fmt.Fprintf(humanOut(), format, args...)
+}
+
+// failf reports an error with a stable code.
+func failf(code string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if outputJSON {
+		emit(event{Type: "error", Code: code, Message: strings.TrimSpace(msg)})
+		return
+	}
+	fmt.Print(msg)
+}
+
+// Observers are told about every finished phase and restore warning; rehearse
+// collects them for its report.
+var (
+	phaseObserver   func(name string, d time.Duration, err error)
+	warningObserver func(message string)
+)
+
+// startPhase emits a phase_start event and returns a function that emits the
+// matching phase_end with duration and status.
+func startPhase(name string) func(err error) {
+	start := time.Now()
+	emit(event{Type: "phase_start", Phase: name})
+	return func(err error) {
+		d := time.Since(start)
+		ev := event{Type: "phase_end", Phase: name, Status: "ok", DurationMs: d.Milliseconds()}
+		if err != nil {
+			ev.Status = "failed"
+			ev.Error = err.Error()
+		}
+		emit(ev)
+		if phaseObserver != nil {
+			phaseObserver(name, d, err)
+		}
+	}
+}
+
+// reportWarnings passes on what a restore tool wrote to stderr although it
+// succeeded: pg_restore warnings, psql notices, and the errors of the globals
+// restore, the only psql restore that runs without ON_ERROR_STOP. shown tells
+// whether the text already went to the terminal.
+func reportWarnings(stderr string, shown bool) {
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if warningObserver != nil {
+			warningObserver(line)
+		}
+		switch {
+		case outputJSON:
+			emit(event{Type: "warning", Message: line})
+		case !shown:
+			fmt.Println(line)
+		}
+	}
+}
+
+// passwordVars are the environment variables whose values are never shown.
+const passwordVars = `(?:PGPASSWORD|POSTGRES_PASSWORD|POSTGRESQL_(?:POSTGRES_)?PASSWORD)=`
+
+var (
+	passwordPattern    = regexp.MustCompile(`(` + passwordVars + `)('(?:[^']|'\\'')*'|"(?:[^"\\]|\\.)*"|\S+)`)
+	passwordArgPattern = regexp.MustCompile(`(?s)^(` + passwordVars + `).*`)
+)
+
+// redactCommand hides passwords passed via environment assignments in a shell
+// command line.
+func redactCommand(command string) string {
+	return passwordPattern.ReplaceAllString(command, "${1}***")
+}
+
+// formatArgs joins an argument list for display. Password assignments are
+// redacted per argument, before joining, so a password containing spaces is
+// hidden completely.
+func formatArgs(args []string) string {
+	shown := make([]string, len(args))
+	for i, arg := range args {
+		shown[i] = passwordArgPattern.ReplaceAllString(arg, "${1}***")
+	}
+	return strings.Join(shown, " ")
+}
+
+// reportCommand announces a command line that is about to run.
+func reportCommand(command string) {
+	command = redactCommand(command)
+	if outputJSON {
+		emit(event{Type: "command", Command: command})
+		return
+	}
+	fmt.Printf("Running: %s\n", command)
+}
+
+// reportBytes records the amount of data transferred in a phase.
+func reportBytes(phase string, n int64) {
+	if outputJSON {
+		emit(event{Type: "bytes", Phase: phase, Bytes: n})
+		return
+	}
+	fmt.Printf("Transferred %s.\n", formatBytes(n))
+}
+
+// reportVerification reports the result of one verification step.
+func reportVerification(r verifyResult) {
+	passed := r.Err == nil
+	if !outputJSON {
+		status := "PASS"
+		if !passed {
+			status = "FAIL"
+		}
+		fmt.Printf("  [%s] %s\n", status, r.Name)
+		return
+	}
+	ev := event{Type: "verification", Check: r.Name, Passed: &passed}
+	if r.Err != nil {
+		ev.Code = errVerification
+		ev.Error = r.Err.Error()
+	}
+	emit(ev)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
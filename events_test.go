@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn writes to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestRedactCommand(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "PGPASSWORD=secret psql -U app", "PGPASSWORD=*** psql -U app"},
+		{"single quoted with space", "PGPASSWORD='se cret' psql", "PGPASSWORD=*** psql"},
+		{"single quoted escape", `PGPASSWORD='it'\''s' psql`, "PGPASSWORD=*** psql"},
+		{"container variable", "docker run -e POSTGRES_PASSWORD=x postgres", "docker run -e POSTGRES_PASSWORD=*** postgres"},
+		{"double quoted with space", `POSTGRES_PASSWORD="se \"cr\" et" ./notify`, "POSTGRES_PASSWORD=*** ./notify"},
+		{"bitnami", "POSTGRESQL_PASSWORD=a POSTGRESQL_POSTGRES_PASSWORD=b", "POSTGRESQL_PASSWORD=*** POSTGRESQL_POSTGRES_PASSWORD=***"},
+		{"other variables", "PGUSER=app PGPASSFILE=/x", "PGUSER=app PGPASSFILE=/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactCommand(tt.in); got != tt.want {
+				t.Errorf("redactCommand(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 40, "3.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestJSONEvents(t *testing.T) {
+	outputJSON = true
+	defer func() { outputJSON = false }()
+	out := captureStdout(t, func() {
+		logf("Copying '%s'...\n", "app")
+		reportCommand("docker exec -e PGPASSWORD=secret pg psql")
+		done := startPhase("restore")
+		done(errors.New("psql failed"))
+		failf(errRestore, "Error restoring: %v\n", "psql failed")
+	})
+	want := []event{
+		{Type: "log", Message: "Copying 'app'..."},
+		{Type: "command", Command: "docker exec -e PGPASSWORD=*** pg psql"},
+		{Type: "phase_start", Phase: "restore"},
+		{Type: "phase_end", Phase: "restore", Status: "failed", Error: "psql failed"},
+		{Type: "error", Code: errRestore, Message: "Error restoring: psql failed"},
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	var i int
+	for ; scanner.Scan(); i++ {
+		var ev event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("line %d is no event: %q", i+1, scanner.Text())
+		}
+		if ev.Time == "" {
+			t.Errorf("line %d has no time", i+1)
+		}
+		ev.Time, ev.DurationMs = "", 0
+		if i < len(want) && !reflect.DeepEqual(ev, want[i]) {
+			t.Errorf("event %d = %+v, want %+v", i+1, ev, want[i])
+		}
+	}
+	if i != len(want) {
+		t.Errorf("got %d events, want %d:\n%s", i, len(want), out)
+	}
+}
+
+func TestDockerCallStringRedactsPerArgument(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			"password with spaces",
+			[]string{"exec", "-e", "PGPASSWORD=correct horse battery", "-e", "PGAPPNAME=x", "pg", "psql"},
+			"docker exec -e PGPASSWORD=*** -e PGAPPNAME=x pg psql",
+		},
+		{
+			"password with newline",
+			[]string{"run", "-e", "POSTGRES_PASSWORD=a\nb", "postgres:17"},
+			"docker run -e POSTGRES_PASSWORD=*** postgres:17",
+		},
+		{
+			"assignment not at argument start",
+			[]string{"exec", "pg", "psql", "-c", "SELECT 'PGPASSWORD=x'"},
+			"docker exec pg psql -c SELECT 'PGPASSWORD=x'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (dockerCall{Args: tt.args}).String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"os"
+)
+
+// runExportCommand implements "export": dump one database of a container to
+// a file or directory on the host. Exit code 0 means success, 1 a failed
+// dump and 2 a usage or connection error.
+func runExportCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	src := addConnFlags(fs, "src", "source")
+	db := fs.String("db", "", "database name (default: POSTGRES_DB of the container or postgres)")
+	format := fs.String("format", formatCustom, "archive format: custom, directory or plain")
+	out := fs.String("o", "", "output file, directory or s3://bucket/key (default: <db>.dump, <db>.dir or <db>.sql, plus .gz and .enc when compressed or encrypted)")
+	jobs := fs.Int("jobs", 4, "parallel pg_dump workers (directory format)")
+	fs.Parse(args)
+
+	container, user, pass, err := src.resolve(ctx)
+	if err != nil {
+		failf(errInvalidInput, "export: %v\n", err)
+		return 2
+	}
+	extensions := map[string]string{formatCustom: ".dump", formatDirectory: ".dir", formatPlain: ".sql"}
+	if extensions[*format] == "" {
+		failf(errInvalidInput, "export: unknown format %q\n", *format)
+		return 2
+	}
+	dbName := defaultDatabase(ctx, container, *db)
+	path := *out
+	if path == "" {
+		path = unsafeFileChars.ReplaceAllString(dbName, "_") + extensions[*format]
+		if *format != formatDirectory {
+			path += dumpFileSuffix(*format, defaultCompression)
+		}
+	}
+	toObject := isObjectURL(path)
+	if toObject {
+		if _, _, err := parseS3URL(path); err != nil {
+			failf(errInvalidInput, "export: %v\n", err)
+			return 2
+		}
+		if *format == formatDirectory {
+			failf(errInvalidInput, "export: the directory format cannot be uploaded; use custom or plain\n")
+			return 2
+		}
+	} else if *format == formatDirectory {
+		if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+			failf(errInvalidInput, "export: directory '%s' is not empty\n", path)
+			return 2
+		}
+	}
+	if !checkPgConnection(ctx, container, user, pass, dbName) {
+		failf(errConnection, "export: cannot connect to '%s'\n", container)
+		return 2
+	}
+	watchSessions(container, user, pass)
+
+	logf("Exporting database '%s' from '%s' to '%s' (%s format)...\n", dbName, container, path, *format)
+	done := startPhase("export")
+	var size int64
+	switch {
+	case toObject:
+		size, _, err = dumpToObject(ctx, container, user, pass, dbName, path, defaultCompression, "-F"+(*format)[:1])
+	case *format == formatCustom:
+		size, _, err = dumpToFile(ctx, container, user, pass, dbName, path, defaultCompression, "-Fc")
+	case *format == formatPlain:
+		size, _, err = dumpToFile(ctx, container, user, pass, dbName, path, defaultCompression, "-Fp")
+	case *format == formatDirectory:
+		size, err = dumpToDirectory(ctx, container, user, pass, dbName, path, *jobs, defaultCompression)
+	}
+	done(err)
+	if err != nil {
+		failf(errDump, "export: %v\n", err)
+		return 1
+	}
+	reportBytes("export", size)
+	return 0
+}
+
+// runImportCommand implements "import": load a custom-format archive, a
+// directory-format archive or a plain SQL file from the host into a
+// container. The format is detected from the file unless -format is given.
+func runImportCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dst := addConnFlags(fs, "dst", "destination")
+	db := fs.String("db", "", "database name (default: POSTGRES_DB of the container or postgres)")
+	in := fs.String("i", "", "archive file, archive directory, SQL file or object URL (s3://, https://) to import")
+	format := fs.String("format", "auto", "archive format: auto, custom, directory or plain")
+	jobs := fs.Int("jobs", 4, "parallel pg_restore workers (directory format)")
+	clean := fs.Bool("clean", false, "drop existing objects before restoring them (custom and directory format)")
+	noOwner := fs.Bool("no-owner", false, "skip ownership and privileges (custom and directory format)")
+	fs.Parse(args)
+
+	if *in == "" {
+		failf(errInvalidInput, "import: -i is required\n")
+		return 2
+	}
+	container, user, pass, err := dst.resolve(ctx)
+	if err != nil {
+		failf(errInvalidInput, "import: %v\n", err)
+		return 2
+	}
+	f := *format
+	switch {
+	case isObjectURL(*in):
+		if f == formatDirectory {
+			failf(errInvalidInput, "import: the directory format cannot be read from a URL\n")
+			return 2
+		}
+	case f == "auto":
+		if f, err = detectFormat(*in); err != nil {
+			failf(errInvalidInput, "import: %v\n", err)
+			return 2
+		}
+	}
+	switch f {
+	case "auto", formatCustom, formatDirectory, formatPlain:
+	default:
+		failf(errInvalidInput, "import: unknown format %q\n", f)
+		return 2
+	}
+	dbName := defaultDatabase(ctx, container, *db)
+	if !checkPgConnection(ctx, container, user, pass, "postgres") {
+		failf(errConnection, "import: cannot connect to '%s'\n", container)
+		return 2
+	}
+	watchSessions(container, user, pass)
+	if err := ensureDatabase(ctx, container, user, pass, dbName); err != nil {
+		failf(errRestore, "import: creating database '%s' failed: %v\n", dbName, err)
+		return 1
+	}
+
+	var restoreArgs []string
+	if *clean {
+		restoreArgs = append(restoreArgs, "--clean", "--if-exists")
+	}
+	if *noOwner {
+		restoreArgs = append(restoreArgs, "--no-owner", "--no-privileges")
+	}
+	logf("Importing '%s' (format %s) into database '%s' on '%s'...\n", *in, f, dbName, container)
+	releasePartial := warnPartialRestore(container, dbName)
+	done := startPhase("import")
+	var size int64
+	switch {
+	case isObjectURL(*in):
+		size, err = restoreFromObject(ctx, container, user, pass, dbName, *in, f, restoreArgs...)
+	case f == formatCustom || f == formatPlain:
+		size, err = restoreFromFile(ctx, container, user, pass, dbName, *in, f, restoreArgs...)
+	case f == formatDirectory:
+		size, err = restoreFromDirectory(ctx, container, user, pass, dbName, *in, *jobs, restoreArgs...)
+	}
+	done(err)
+	if err != nil {
+		failf(errRestore, "import: %v\n", err)
+		return 1
+	}
+	releasePartial()
+	reportBytes("import", size)
+	return 0
+}
+
+// defaultDatabase returns db, or the POSTGRES_DB of container, or postgres.
+func defaultDatabase(ctx context.Context, container containerRef, db string) string {
+	if db != "" {
+		return db
+	}
+	if db = getContainerEnv(ctx, container)["POSTGRES_DB"]; db != "" {
+		return db
+	}
+	return "postgres"
+}
+
+// restoreFromObject streams an object into container, decrypting and
+// decompressing it on the fly. format "auto" is decided from the stream.
+func restoreFromObject(ctx context.Context, container containerRef, user, pass, db, src, format string, restoreArgs ...string) (int64, error) {
+	body, err := openObject(ctx, src)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	decoded, err := decodeDump(body, src)
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(decoded)
+	if format == "auto" {
+		format = streamFormat(br)
+	}
+	return restoreFromReader(ctx, container, user, pass, db, br, src, format, restoreArgs...)
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ===== Batch upgrade of many containers =====
+
+// fleetResult is the outcome of upgrading one container.
+type fleetResult struct {
+	Container   string `json:"container"`
+	From        string `json:"from_version,omitempty"`
+	Status      string `json:"status"` // ok, failed or skipped
+	Destination string `json:"destination,omitempty"`
+	StateFile   string `json:"state_file,omitempty"` // kept for "resume" after a failure
+	DurationMs  int64  `json:"duration_ms"`
+	Error       string `json:"error,omitempty"`
+	// SourceRunning is set when the upgrade is a copy: the original container
+	// keeps running next to it and the applications still use the original
+	SourceRunning bool `json:"source_running,omitempty"`
+}
+
+// fleetTarget is a selected source container.
+type fleetTarget struct {
+	container containerRef
+	entry     *inventoryEntry
+}
+
+// fleetOptions are the settings shared by all upgrades of a batch.
+type fleetOptions struct {
+	Engine     dockerEngine `json:"engine"`
+	Image      string       `json:"image"`
+	DataDir    string       `json:"data_dir"`
+	Major      string       `json:"major,omitempty"` // of Image, "" if unknown
+	InPlace    bool         `json:"in_place,omitempty"`
+	Globals    bool         `json:"globals,omitempty"`
+	Preserve   bool         `json:"preserve,omitempty"`
+	VerifyMode string       `json:"verify_mode"`
+}
+
+// fleetMemberSpec is what a "fleet-member" process upgrades.
+type fleetMemberSpec struct {
+	Container containerRef `json:"container"`
+	Version   string       `json:"version,omitempty"`
+	Major     string       `json:"major,omitempty"`
+	Options   fleetOptions `json:"options"`
+}
+
+// runFleetCommand implements "fleet": upgrade every running PostgreSQL
+// container matching the selection to a target image, several at a time.
+// Each container is migrated into a new container next to it (or its compose
+// service is upgraded in place); a failure does not stop the others.
+func runFleetCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("fleet", flag.ExitOnError)
+	docker := fs.String("docker", "", "Docker engine: context name or ssh:// / tcp:// host (default: local)")
+	names := fs.String("name", "", "container name globs, comma separated (e.g. 'shop-*,billing')")
+	labels := fs.String("label", "", "label selectors, comma separated (key or key=value, all must match)")
+	majors := fs.String("major", "", "current major versions, comma separated (e.g. 12,13)")
+	image := fs.String("image", "", "target image (required)")
+	concurrency := fs.Int("concurrency", 2, "migrations running at the same time")
+	inPlace := fs.Bool("in-place", false, "upgrade Docker Compose services in place instead of creating containers next to them")
+	globals := fs.Bool("globals", true, "migrate global objects (roles)")
+	preserve := fs.Bool("preserve-ownership", false, "keep owners and GRANTs")
+	mode := fs.String("verify", "quick", "verification mode: quick, estimate, full or none")
+	dryRun := fs.Bool("dry-run", false, "only list the selected containers")
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	reportPath := fs.String("report", "", "also write the results as JSON to this file")
+	fs.Parse(args)
+
+	if *image == "" {
+		failf(errInvalidInput, "fleet: -image is required\n")
+		return 2
+	}
+	if *names == "" && *labels == "" && *majors == "" {
+		failf(errInvalidInput, "fleet: select containers with -name, -label or -major\n")
+		return 2
+	}
+	switch *mode {
+	case "quick", "estimate", "full", "none":
+	default:
+		failf(errInvalidInput, "fleet: unknown verification mode %q\n", *mode)
+		return 2
+	}
+	for _, g := range splitList(*names) {
+		if _, err := path.Match(g, ""); err != nil {
+			failf(errInvalidInput, "fleet: invalid glob %q: %v\n", g, err)
+			return 2
+		}
+	}
+	e, err := parseEngine(*docker)
+	if err != nil {
+		failf(errInvalidInput, "fleet: -docker: %v\n", err)
+		return 2
+	}
+	opts := fleetOptions{Engine: e, Image: *image, InPlace: *inPlace, Globals: *globals || *preserve, Preserve: *preserve, VerifyMode: *mode}
+	opts.DataDir = imageDataDir(ctx, e, *image)
+	opts.Major = imageMajor(ctx, e, *image)
+
+	targets, err := selectFleet(ctx, e, splitList(*names), splitList(*labels), splitList(*majors))
+	if err != nil {
+		failf(errDocker, "fleet: %v\n", err)
+		return 2
+	}
+	if len(targets) == 0 {
+		failf(errNoContainers, "fleet: no running PostgreSQL containers match the selection\n")
+		return 1
+	}
+	promptf("Selected containers (target %s, PostgreSQL %s):\n", *image, orUnknown(opts.Major))
+	for _, t := range targets {
+		promptf("  %s (%s, PostgreSQL %s)\n", t.container.Name, t.entry.Image, orUnknown(t.entry.Version))
+	}
+	if *dryRun {
+		return 0
+	}
+	if !opts.InPlace {
+		promptf("Each container is copied into a new, upgraded container. The old containers keep running and the applications are not switched over.\n")
+	}
+	if !*yes {
+		promptf("Upgrade %d container(s), %d at a time? (yes/no): ", len(targets), max(*concurrency, 1))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(answer)) != "yes" {
+			logf("Aborted.\n")
+			return 1
+		}
+	}
+
+	results := make([]fleetResult, len(targets))
+	sem := make(chan struct{}, max(*concurrency, 1))
+	var wg sync.WaitGroup
+	// on Ctrl-C the members clean up themselves; wait for them
+	stop := make(chan struct{})
+	release := onInterrupt("stop the running upgrades", func(ctx context.Context) {
+		close(stop)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(interruptCleanupTimeout + 5*time.Second):
+		}
+	})
+	defer release()
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				results[i] = fleetResult{Container: t.container.Name, Status: "skipped", Error: "interrupted"}
+				return
+			}
+			results[i] = runFleetMember(t, opts, stop)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return 1
+	}
+
+	printFleetReport(results)
+	if *reportPath != "" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		if err := os.WriteFile(*reportPath, append(data, '\n'), 0o644); err != nil {
+			logf("Writing the report to '%s' failed: %v\n", *reportPath, err)
+		}
+	}
+	for _, r := range results {
+		if r.Status == "failed" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// selectFleet returns the running PostgreSQL containers of engine e matching
+// all given criteria; an empty criterion matches everything.
+func selectFleet(ctx context.Context, e dockerEngine, globs, selectors, majors []string) ([]fleetTarget, error) {
+	infos, err := discoverPostgres(ctx, e, false)
+	if err != nil {
+		return nil, err
+	}
+	var targets []fleetTarget
+	for _, info := range infos {
+		if !matchesGlobs(info.Name, globs) || !matchesLabels(info.Config.Labels, selectors) {
+			continue
+		}
+		t := fleetTarget{container: onEngine(info.Name, e), entry: &inventoryEntry{}}
+		t.entry.fill(info)
+		if len(majors) > 0 {
+			if t.entry.Major == "" {
+				// custom image without PG_VERSION: ask the server
+				env := getContainerEnv(ctx, t.container)
+				if v, err := serverVersion(ctx, t.container, orDefault(env["POSTGRES_USER"], "postgres"), env["POSTGRES_PASSWORD"]); err == nil {
+					t.entry.setVersion(v)
+				}
+			}
+			if !slices.Contains(majors, t.entry.Major) {
+				continue
+			}
+		}
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].container.Name < targets[j].container.Name })
+	return targets, nil
+}
+
+func matchesGlobs(name string, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesLabels(labels map[string]string, selectors []string) bool {
+	for _, s := range selectors {
+		key, value, hasValue := strings.Cut(s, "=")
+		v, ok := labels[key]
+		if !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// imageMajor returns PG_MAJOR of image, or "" if the image does not set it.
+func imageMajor(ctx context.Context, e dockerEngine, image string) string {
+	out, err := engineCommand(ctx, e, "image", "inspect", "--format", "{{json .Config.Env}}", image).Output()
+	if err != nil {
+		return ""
+	}
+	var env []string
+	if json.Unmarshal(out, &env) != nil {
+		return ""
+	}
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "PG_MAJOR="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// runFleetMember upgrades one container in a "fleet-member" child process,
+// so concurrent upgrades do not share any state and their output can be told
+// apart: each line is prefixed with the container name, each event carries
+// it. Closing stop interrupts the child like Ctrl-C.
+func runFleetMember(t fleetTarget, opts fleetOptions, stop <-chan struct{}) fleetResult {
+	name := t.container.Name
+	fail := func(err error) fleetResult {
+		logf("[%s] Upgrade failed: %v\n", name, err)
+		return fleetResult{Container: name, From: t.entry.Version, Status: "failed", Error: err.Error()}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fail(err)
+	}
+	resultFile, err := os.CreateTemp("", "pgupgrade-fleet-*.json")
+	if err != nil {
+		return fail(err)
+	}
+	resultFile.Close()
+	defer os.Remove(resultFile.Name())
+	spec, _ := json.Marshal(fleetMemberSpec{Container: t.container, Version: t.entry.Version, Major: t.entry.Major, Options: opts})
+
+	args := append(slices.Clone(globalFlagArgs), "fleet-member", "-spec", string(spec), "-result", resultFile.Name())
+	cmd := exec.Command(exe, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fail(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fail(err)
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-stop:
+			stdin.Close()
+		case <-exited:
+		}
+	}()
+	var relays sync.WaitGroup
+	relays.Add(2)
+	go func() {
+		defer relays.Done()
+		relayMemberOutput(stdout, name, outputJSON, os.Stdout)
+	}()
+	go func() {
+		defer relays.Done()
+		relayMemberOutput(stderr, name, false, os.Stderr)
+	}()
+	relays.Wait()
+	waitErr := cmd.Wait()
+
+	var res fleetResult
+	data, err := os.ReadFile(resultFile.Name())
+	if err != nil || json.Unmarshal(data, &res) != nil || res.Status == "" {
+		if waitErr == nil {
+			waitErr = errors.New("no result reported")
+		}
+		return fail(fmt.Errorf("upgrade process: %v", waitErr))
+	}
+	return res
+}
+
+// relayMemberOutput copies the output of a fleet member to w, each line
+// prefixed with the container name. With events set the lines are JSON
+// events, which are emitted again with the container filled in.
+func relayMemberOutput(r io.Reader, name string, events bool, w io.Writer) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			var ev event
+			if events && json.Unmarshal([]byte(line), &ev) == nil && ev.Type != "" {
+				ev.Container = name
+				emit(ev)
+			} else {
+				if events {
+					w = os.Stderr // keep stdout valid JSON
+				}
+				if line = strings.TrimSuffix(line, "\n"); line != "" {
+					line = "[" + name + "] " + line
+				}
+				fmt.Fprintln(w, line)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// runFleetMemberCommand implements "fleet-member", started by runFleetMember
+// for each container: it upgrades the container given by -spec and writes the
+// fleetResult to the -result file.
+func runFleetMemberCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("fleet-member", flag.ExitOnError)
+	specJSON := fs.String("spec", "", "fleetMemberSpec as JSON")
+	resultPath := fs.String("result", "", "file receiving the fleetResult as JSON")
+	fs.Parse(args)
+	var spec fleetMemberSpec
+	if err := json.Unmarshal([]byte(*specJSON), &spec); err != nil || *resultPath == "" {
+		failf(errInvalidInput, "fleet-member: -spec and -result are required\n")
+		return 2
+	}
+	// the fleet closes stdin to interrupt the upgrade
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		interruptSelf()
+	}()
+
+	t := fleetTarget{container: spec.Container, entry: &inventoryEntry{Version: spec.Version, Major: spec.Major}}
+	res := upgradeFleetMember(ctx, t, spec.Options)
+	data, _ := json.Marshal(res)
+	if err := os.WriteFile(*resultPath, data, 0o600); err != nil {
+		failf(errInvalidInput, "fleet-member: writing the result failed: %v\n", err)
+		return 1
+	}
+	if res.Status == "failed" {
+		return 1
+	}
+	return 0
+}
+
+// upgradeFleetMember migrates all databases of one container into a new
+// container from the target image, or upgrades its compose service in place.
+// The state file of a failed run is kept for "resume".
+func upgradeFleetMember(ctx context.Context, t fleetTarget, opts fleetOptions) fleetResult {
+	start := time.Now()
+	name := t.container.Name
+	res := fleetResult{Container: name, From: t.entry.Version, Status: "failed"}
+	fail := func(err error) fleetResult {
+		res.Error = strings.Join(strings.Fields(err.Error()), " ")
+		res.DurationMs = time.Since(start).Milliseconds()
+		logf("Upgrade failed: %v\n", err)
+		return res
+	}
+	if opts.Major != "" && t.entry.Major != "" {
+		if from, err1 := strconv.ParseFloat(t.entry.Major, 64); err1 == nil {
+			if to, err2 := strconv.ParseFloat(opts.Major, 64); err2 == nil && from >= to {
+				res.Status, res.Error = "skipped", "already on PostgreSQL "+t.entry.Major
+				return res
+			}
+		}
+	}
+
+	env := getContainerEnv(ctx, t.container)
+	user, pass := orDefault(env["POSTGRES_USER"], "postgres"), env["POSTGRES_PASSWORD"]
+	if !checkPgConnection(ctx, t.container, user, pass, "postgres") {
+		return fail(fmt.Errorf("cannot connect to '%s'", name))
+	}
+	databases, err := userDatabases(ctx, t.container, user, pass)
+	if err != nil {
+		return fail(err)
+	}
+	release := watchSessions(t.container, user, pass)
+	defer release()
+
+	suffix := "pg" + orDefault(opts.Major, "new")
+	contName, volume := name+"-"+suffix, unsafeFileChars.ReplaceAllString(name+"_"+suffix, "_")
+	var upgrade *composeService
+	if opts.InPlace {
+		if upgrade = composeServiceOf(ctx, t.container); upgrade != nil {
+			contName, volume = upgrade.tempContainerName(), upgrade.volumeName(opts.Image)
+			upgrade.NewImage, upgrade.Volume, upgrade.DataDir = opts.Image, volume, opts.DataDir
+		}
+	}
+	logf("Creating '%s' from '%s'...\n", contName, opts.Image)
+	dst, releases, err := createPostgresContainer(ctx, opts.Engine, opts.Image, contName, "", volume, opts.DataDir, user, pass, databases[0])
+	// the created container is kept on failure so the run can be resumed
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	if err != nil {
+		return fail(err)
+	}
+	if upgrade != nil {
+		// Ctrl-C keeps the volume: the service may already run on it
+		releases[0]()
+	} else {
+		// reachable from the applications under its own name
+		if nets, err := containerNetworks(ctx, t.container); err == nil {
+			for net := range nets {
+				if net != "bridge" && net != "host" && net != "none" {
+					engineCommand(ctx, dst.Engine, "network", "connect", net, dst.Name).Run()
+				}
+			}
+		}
+	}
+	releaseDst := watchSessions(dst, user, pass)
+	defer releaseDst()
+
+	plan := &migrationPlan{
+		SrcContainer: t.container, SrcUser: user, SrcPassword: pass,
+		DstContainer: dst, DstUser: user, DstPassword: pass,
+		Databases: databases, Stream: true,
+		MigrateGlobals: opts.Globals, PreserveOwnership: opts.Preserve,
+		VerifyMode: opts.VerifyMode, CountOptions: defaultCountOptions(),
+		Compression: defaultCompression, Compose: upgrade, Hooks: globalHooks,
+	}
+	res.StateFile = "pgupgrade-state-" + unsafeFileChars.ReplaceAllString(name, "_") + ".json"
+	state := newRunState(res.StateFile, plan)
+	if err := state.save(); err != nil {
+		logf("Saving run state to '%s' failed: %v\n", res.StateFile, err)
+	}
+	if err := runMigration(ctx, plan, state); err != nil {
+		return fail(err)
+	}
+	os.Remove(res.StateFile)
+	res.StateFile = ""
+	res.Status = "ok"
+	res.Destination = dst.Name
+	res.SourceRunning = upgrade == nil
+	if upgrade != nil {
+		res.Destination = "compose service " + upgrade.Service
+	}
+	res.DurationMs = time.Since(start).Milliseconds()
+	logf("Upgraded in %s.\n", time.Since(start).Round(time.Second))
+	return res
+}
+
+// userDatabases lists the databases worth migrating: all that accept
+// connections except the templates and, unless it is the only one, postgres.
+func userDatabases(ctx context.Context, container containerRef, user, pass string) ([]string, error) {
+	var rows []struct {
+		Name string `json:"name"`
+	}
+	sql := "SELECT datname AS name FROM pg_database WHERE datallowconn AND NOT datistemplate AND datname <> 'postgres' ORDER BY datname"
+	if err := queryJSON(ctx, container, user, pass, "postgres", sql, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []string{"postgres"}, nil
+	}
+	dbs := make([]string, len(rows))
+	for i, r := range rows {
+		dbs[i] = r.Name
+	}
+	return dbs, nil
+}
+
+func printFleetReport(results []fleetResult) {
+	w := tabwriter.NewWriter(humanOut(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nCONTAINER\tFROM\tSTATUS\tDURATION\tDESTINATION\tDETAILS")
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+		details := r.Error
+		if r.StateFile != "" {
+			details += " (resume -state " + r.StateFile + ")"
+		}
+		if r.SourceRunning {
+			counts["copies"]++
+			details = "copy; '" + r.Container + "' keeps running"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Container, orDash(r.From), r.Status,
+			(time.Duration(r.DurationMs) * time.Millisecond).Round(time.Second), orDash(r.Destination), orDash(details))
+	}
+	w.Flush()
+	fmt.Fprintf(humanOut(), "\n%d upgraded, %d failed, %d skipped.\n", counts["ok"], counts["failed"], counts["skipped"])
+	if counts["copies"] > 0 {
+		fmt.Fprintf(humanOut(), "%d upgraded container(s) run next to their originals, which were not stopped. Point the applications at the new containers, then remove the old ones.\n", counts["copies"])
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMatchesGlobs(t *testing.T) {
+	tests := []struct {
+		name  string
+		globs []string
+		want  bool
+	}{
+		{"db-shop", nil, true},
+		{"db-shop", []string{"db-*"}, true},
+		{"db-shop", []string{"web-*", "*-shop"}, true},
+		{"db-shop", []string{"db-?"}, false},
+		{"db-shop", []string{"[a-c]*"}, false},
+		{"db-shop", []string{"[bad"}, false},
+	}
+	for _, tt := range tests {
+		if got := matchesGlobs(tt.name, tt.globs); got != tt.want {
+			t.Errorf("matchesGlobs(%q, %q) = %v, want %v", tt.name, tt.globs, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesLabels(t *testing.T) {
+	labels := map[string]string{"tier": "prod", "team": "shop", "backup": ""}
+	tests := []struct {
+		selectors []string
+		want      bool
+	}{
+		{nil, true},
+		{[]string{"tier"}, true},
+		{[]string{"tier=prod", "team=shop"}, true},
+		{[]string{"backup"}, true},
+		{[]string{"backup="}, true},
+		{[]string{"tier=prod", "team=blog"}, false},
+		{[]string{"tier=production"}, false},
+		{[]string{"owner"}, false},
+	}
+	for _, tt := range tests {
+		if got := matchesLabels(labels, tt.selectors); got != tt.want {
+			t.Errorf("matchesLabels(%q) = %v, want %v", tt.selectors, got, tt.want)
+		}
+	}
+}
+
+func TestSelectFleet(t *testing.T) {
+	dir := fakeDocker(t, `case "$1" in
+ps) echo 1; echo 2; echo 3; echo 4 ;;
+inspect) cat "$FAKE_DOCKER_DIR/inspect" ;;
+*) exit 1 ;;
+esac`)
+	inspect := `[
+		{"Name": "/shop-db", "Config": {"Image": "postgres:13", "Env": ["PG_VERSION=13.16-1.pgdg120+1"], "Labels": {"tier": "prod"}}, "State": {"Status": "running", "Running": true}},
+		{"Name": "/blog-db", "Config": {"Image": "postgres:16", "Env": ["PG_MAJOR=16"], "Labels": {"tier": "dev"}}, "State": {"Status": "running", "Running": true}},
+		{"Name": "/analytics-db", "Config": {"Image": "postgres:13.4"}, "State": {"Status": "running", "Running": true}},
+		{"Name": "/cache", "Config": {"Image": "redis:7", "Labels": {"tier": "prod"}}, "State": {"Status": "running", "Running": true}}
+	]`
+	if err := os.WriteFile(filepath.Join(dir, "inspect"), []byte(inspect), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name                     string
+		globs, selectors, majors []string
+		want                     []string
+	}{
+		{name: "all", want: []string{"analytics-db", "blog-db", "shop-db"}},
+		{name: "glob", globs: []string{"s*"}, want: []string{"shop-db"}},
+		{name: "label", selectors: []string{"tier=prod"}, want: []string{"shop-db"}},
+		{name: "major", majors: []string{"13"}, want: []string{"analytics-db", "shop-db"}},
+		{name: "no match", globs: []string{"*-db"}, majors: []string{"12"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, err := selectFleet(context.Background(), dockerEngine{}, tt.globs, tt.selectors, tt.majors)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, target := range targets {
+				got = append(got, target.container.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selected %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayMemberOutput(t *testing.T) {
+	const output = "Copying 'app'...\n\n" + `{"time":"t","type":"phase_start","phase":"restore"}` + "\nno newline at the end"
+
+	var buf bytes.Buffer
+	relayMemberOutput(strings.NewReader(output), "shop-db", false, &buf)
+	want := "[shop-db] Copying 'app'...\n\n[shop-db] " + `{"time":"t","type":"phase_start","phase":"restore"}` + "\n[shop-db] no newline at the end\n"
+	if buf.String() != want {
+		t.Errorf("text relay =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	outputJSON = true
+	defer func() { outputJSON = false }()
+	buf.Reset()
+	stdout := captureStdout(t, func() {
+		relayMemberOutput(strings.NewReader(output), "shop-db", true, &buf)
+	})
+	var ev event
+	if err := json.Unmarshal([]byte(stdout), &ev); err != nil {
+		t.Fatalf("stdout is not one event: %q", stdout)
+	}
+	if ev.Type != "phase_start" || ev.Phase != "restore" || ev.Container != "shop-db" {
+		t.Errorf("relayed event = %+v", ev)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("non-event lines went to w: %q", buf.String())
+	}
+}
+
+func TestPrintFleetReport(t *testing.T) {
+	out := captureStdout(t, func() {
+		printFleetReport([]fleetResult{
+			{Container: "shop-db", From: "13.4", Status: "ok", Destination: "shop-db-pg17", SourceRunning: true},
+			{Container: "billing", From: "12.9", Status: "ok", Destination: "compose service db"},
+			{Container: "crm", From: "13.1", Status: "failed", Error: "restore failed", StateFile: "pgupgrade-state-crm.json"},
+		})
+	})
+	for _, want := range []string{
+		"copy; 'shop-db' keeps running",
+		"restore failed (resume -state pgupgrade-state-crm.json)",
+		"2 upgraded, 1 failed, 0 skipped.",
+		"1 upgraded container(s) run next to their originals",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "'billing' keeps running") {
+		t.Errorf("in-place upgrade reported as a copy:\n%s", out)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ===== Hooks =====
+
+// Hook events. Pre-hooks (pre-check, pre-dump) abort the run when they fail;
+// the failure of any other hook is only reported.
+const (
+	hookPreCheck    = "pre-check"    // before the run changes anything
+	hookPreDump     = "pre-dump"     // before each database is backed up and dumped
+	hookPostRestore = "post-restore" // after each database is restored
+	hookPostVerify  = "post-verify"  // after each database is verified, with the outcome
+	hookOnFailure   = "on-failure"   // once when the run fails
+	hookPostCutover = "post-cutover" // once the destination has taken over
+)
+
+var hookEvents = []string{hookPreCheck, hookPreDump, hookPostRestore, hookPostVerify, hookOnFailure, hookPostCutover}
+
+// hookSet maps an event to the commands run for it, in order. It implements
+// flag.Value for the repeatable --hook event=command flag.
+type hookSet map[string][]string
+
+// globalHooks is set by the global --hook flags.
+var globalHooks = hookSet{}
+
+func (h hookSet) String() string {
+	var parts []string
+	for _, event := range hookEvents {
+		for _, cmd := range h[event] {
+			parts = append(parts, event+"="+cmd)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h hookSet) Set(s string) error {
+	event, cmd, ok := strings.Cut(s, "=")
+	event = strings.TrimSpace(event)
+	if !ok || strings.TrimSpace(cmd) == "" {
+		return fmt.Errorf("expected event=command, got %q", s)
+	}
+	if !slices.Contains(hookEvents, event) {
+		return fmt.Errorf("unknown hook event %q (%s)", event, strings.Join(hookEvents, ", "))
+	}
+	h[event] = append(h[event], cmd)
+	return nil
+}
+
+// isPreHook reports whether a failing hook for event aborts the run.
+func isPreHook(event string) bool {
+	return event == hookPreCheck || event == hookPreDump
+}
+
+// hookEnv describes the run to a hook. Passwords are not passed on.
+type hookEnv struct {
+	SrcContainer, DstContainer containerRef
+	Databases                  []string
+	Database                   string // the database of per-database hooks
+	Outcome                    string // success, failure or verification_failed
+	Error                      string
+	StateFile                  string
+}
+
+// planHookEnv returns the hook environment of a migration plan.
+func planHookEnv(plan *migrationPlan, state *runState) hookEnv {
+	env := hookEnv{
+		SrcContainer: plan.SrcContainer, DstContainer: plan.DstContainer,
+		Databases: plan.Databases,
+	}
+	if state != nil {
+		env.StateFile = state.path
+	}
+	return env
+}
+
+func (e hookEnv) environ(event string) []string {
+	vars := map[string]string{
+		"PGUPGRADE_HOOK":          event,
+		"PGUPGRADE_SRC_CONTAINER": e.SrcContainer.Name,
+		"PGUPGRADE_DST_CONTAINER": e.DstContainer.Name,
+		"PGUPGRADE_SRC_ENGINE":    e.SrcContainer.Engine.String(),
+		"PGUPGRADE_DST_ENGINE":    e.DstContainer.Engine.String(),
+		"PGUPGRADE_DATABASES":     strings.Join(e.Databases, ","),
+		"PGUPGRADE_DATABASE":      e.Database,
+		"PGUPGRADE_OUTCOME":       e.Outcome,
+		"PGUPGRADE_ERROR":         e.Error,
+		"PGUPGRADE_STATE_FILE":    e.StateFile,
+	}
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	environ := os.Environ()
+	for _, k := range keys {
+		environ = append(environ, k+"="+vars[k])
+	}
+	return environ
+}
+
+// runHooks runs the commands configured for event through "sh -c" on the
+// host, one after the other. For pre-hooks the first failure stops and is
+// returned; failures of other hooks are logged and nil is returned.
+func runHooks(ctx context.Context, hooks hookSet, event string, env hookEnv) error {
+	for _, command := range hooks[event] {
+		done := startPhase("hook_" + event)
+		reportCommand(command)
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = env.environ(event)
+		var stderr bytes.Buffer
+		cmd.Stdout = humanOut()
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			err = fmt.Errorf("%s hook '%s' failed: %v - %s", event, command, err, strings.TrimSpace(stderr.String()))
+		} else if stderr.Len() > 0 {
+			logf("%s", stderr.String())
+		}
+		done(err)
+		if err == nil {
+			continue
+		}
+		if isPreHook(event) {
+			return err
+		}
+		logf("%v\n", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHookSetSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    hookSet
+		wantErr string
+	}{
+		{
+			name:   "repeated event keeps order",
+			values: []string{"pre-dump=./stop-cron.sh", "post-cutover=curl -d ok https://hooks.local/x?a=b", "pre-dump=./flush.sh"},
+			want: hookSet{
+				hookPreDump:     {"./stop-cron.sh", "./flush.sh"},
+				hookPostCutover: {"curl -d ok https://hooks.local/x?a=b"},
+			},
+		},
+		{name: "spaces around the event", values: []string{" on-failure =notify"}, want: hookSet{hookOnFailure: {"notify"}}},
+		{name: "no command", values: []string{"pre-check="}, wantErr: "expected event=command"},
+		{name: "blank command", values: []string{"pre-check=  "}, wantErr: "expected event=command"},
+		{name: "no separator", values: []string{"pre-check"}, wantErr: "expected event=command"},
+		{name: "unknown event", values: []string{"post-dump=x"}, wantErr: `unknown hook event "post-dump"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := hookSet{}
+			var err error
+			for _, v := range tt.values {
+				if err = h.Set(v); err != nil {
+					break
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Errorf("hooks = %v, want %v", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestHookSetString(t *testing.T) {
+	h := hookSet{hookPostCutover: {"c"}, hookPreCheck: {"a", "b"}}
+	if got, want := h.String(), "pre-check=a, pre-check=b, post-cutover=c"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run through sh")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	record := `echo "$PGUPGRADE_HOOK $PGUPGRADE_DATABASE $PGUPGRADE_SRC_CONTAINER@$PGUPGRADE_SRC_ENGINE $PGUPGRADE_OUTCOME" >> ` + out
+	env := hookEnv{
+		SrcContainer: onEngine("old", dockerEngine{Context: "prod"}),
+		DstContainer: onEngine("new", dockerEngine{}),
+		Databases:    []string{"app", "shop"},
+		Database:     "app",
+		Outcome:      "success",
+	}
+	hooks := hookSet{
+		hookPreDump:     {record, "exit 3", record},
+		hookPostRestore: {"echo broken >&2; exit 1", record},
+	}
+	ctx := context.Background()
+
+	err := runHooks(ctx, hooks, hookPreDump, env)
+	if err == nil || !strings.Contains(err.Error(), "pre-dump hook 'exit 3' failed") {
+		t.Errorf("pre-dump: err = %v, want the failure of the second hook", err)
+	}
+	if err := runHooks(ctx, hooks, hookPostRestore, env); err != nil {
+		t.Errorf("post-restore: err = %v, want failures only logged", err)
+	}
+	if err := runHooks(ctx, hooks, hookPostVerify, env); err != nil {
+		t.Errorf("post-verify without hooks: err = %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pre-dump app old@context prod success\npost-restore app old@context prod success\n"
+	if string(data) != want {
+		t.Errorf("hooks ran\n%s\nwant\n%s", data, want)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ===== Inventory of PostgreSQL containers =====
+
+// postgresEOL is the end of community support of each major version, see
+// https://www.postgresql.org/support/versioning/.
+var postgresEOL = map[string]string{
+	"9.3": "2018-11-08",
+	"9.4": "2020-02-13",
+	"9.5": "2021-02-11",
+	"9.6": "2021-11-11",
+	"10":  "2022-11-10",
+	"11":  "2023-11-09",
+	"12":  "2024-11-21",
+	"13":  "2025-11-13",
+	"14":  "2026-11-12",
+	"15":  "2027-11-11",
+	"16":  "2028-11-09",
+	"17":  "2029-11-08",
+	"18":  "2030-11-14",
+}
+
+// eolWarning is how long before its end of support a version is reported as
+// "eol_soon".
+const eolWarning = 180 * 24 * time.Hour
+
+// EOL states of an inventory entry.
+const (
+	eolSupported = "supported"
+	eolSoon      = "eol_soon"
+	eolPast      = "eol"
+	eolUnknown   = "unknown"
+)
+
+var versionPattern = regexp.MustCompile(`^\d+(\.\d+)*`)
+
+type inventoryEntry struct {
+	Engine        string              `json:"engine"`
+	Container     string              `json:"container"`
+	Image         string              `json:"image"`
+	State         string              `json:"state"`
+	Version       string              `json:"version,omitempty"`
+	Major         string              `json:"major,omitempty"`
+	Minor         string              `json:"minor,omitempty"`
+	EOL           string              `json:"eol,omitempty"`
+	EOLStatus     string              `json:"eol_status"`
+	UptimeSeconds int64               `json:"uptime_seconds,omitempty"`
+	Databases     []inventoryDatabase `json:"databases,omitempty"`
+	Error         string              `json:"error,omitempty"` // why databases could not be read
+
+	ref containerRef
+}
+
+type inventoryDatabase struct {
+	Name       string   `json:"name"`
+	SizeBytes  int64    `json:"size_bytes"`
+	Extensions []string `json:"extensions,omitempty"` // "name version", plpgsql left out
+}
+
+// runInventoryCommand implements "inventory": list the PostgreSQL containers
+// of one or more engines, running or stopped, with version, databases,
+// extensions and uptime, and flag versions past their end of support.
+func runInventoryCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("inventory", flag.ExitOnError)
+	dockers := fs.String("docker", "local", "Docker engines, comma separated: context names or ssh:// / tcp:// hosts")
+	runningOnly := fs.Bool("running", false, "leave out stopped containers")
+	format := fs.String("format", "table", "output format: table, json or csv")
+	user := fs.String("user", "", "user for all containers (default: POSTGRES_USER of each container or postgres)")
+	password := fs.String("password", "", "password for all containers (default: $PGUPGRADE_PASSWORD or POSTGRES_PASSWORD of each container)")
+	workers := fs.Int("workers", 4, "containers queried in parallel")
+	fs.Parse(args)
+
+	switch *format {
+	case "table", "json", "csv":
+	default:
+		failf(errInvalidInput, "inventory: unknown format %q\n", *format)
+		return 2
+	}
+	pass := *password
+	if pass == "" {
+		pass = os.Getenv("PGUPGRADE_PASSWORD")
+	}
+	var entries []*inventoryEntry
+	for _, d := range splitList(*dockers) {
+		e, err := parseEngine(d)
+		if err != nil {
+			failf(errInvalidInput, "inventory: -docker: %v\n", err)
+			return 2
+		}
+		infos, err := discoverPostgres(ctx, e, !*runningOnly)
+		if err != nil {
+			failf(errDocker, "inventory: %s: %v\n", e, err)
+			return 2
+		}
+		for _, info := range infos {
+			entry := &inventoryEntry{Engine: e.String(), Container: info.Name, ref: onEngine(info.Name, e)}
+			entry.fill(info)
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Engine != entries[j].Engine {
+			return entries[i].Engine < entries[j].Engine
+		}
+		return entries[i].Container < entries[j].Container
+	})
+
+	sem := make(chan struct{}, max(*workers, 1))
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		if entry.State != "running" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			entry.query(ctx, *user, pass)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return 1
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		entry.EOLStatus, entry.EOL = eolStatus(entry.Major, now)
+	}
+
+	if outputJSON {
+		// stdout carries events; -format applies to plain output only
+		for _, entry := range entries {
+			emit(event{Type: "inventory", Inventory: entry})
+		}
+		return 0
+	}
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+	case "csv":
+		writeInventoryCSV(entries)
+	default:
+		writeInventoryTable(entries)
+	}
+	return 0
+}
+
+// fill takes state, uptime and, until the server is asked, the version from
+// docker inspect.
+func (entry *inventoryEntry) fill(info containerInfo) {
+	entry.Image = info.Config.Image
+	entry.State = info.State.Status
+	if info.State.Running && !info.State.StartedAt.IsZero() {
+		entry.UptimeSeconds = int64(time.Since(info.State.StartedAt).Seconds())
+	}
+	// official images set PG_VERSION (e.g. "16.4-1.pgdg120+1") and PG_MAJOR
+	env := map[string]string{}
+	for _, kv := range info.Config.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	version := env["PG_VERSION"]
+	if version == "" {
+		version = env["PG_MAJOR"]
+	}
+	if version == "" {
+		if i := strings.LastIndex(entry.Image, ":"); i > strings.LastIndex(entry.Image, "/") {
+			version = entry.Image[i+1:]
+		}
+	}
+	entry.setVersion(version)
+}
+
+// setVersion parses "16.4", "9.6.24" or "16.4 (Debian 16.4-1.pgdg120+1)".
+func (entry *inventoryEntry) setVersion(v string) {
+	v = versionPattern.FindString(strings.TrimSpace(v))
+	if v == "" {
+		return
+	}
+	entry.Version, entry.Minor = v, ""
+	parts := strings.Split(v, ".")
+	if parts[0] == "9" && len(parts) > 1 {
+		// before 10 the major version had two parts
+		entry.Major = parts[0] + "." + parts[1]
+		parts = parts[1:]
+	} else {
+		entry.Major = parts[0]
+	}
+	if len(parts) > 1 {
+		entry.Minor = parts[1]
+	}
+}
+
+// query asks a running server for its exact version, databases and
+// extensions. Failures are recorded in the entry.
+func (entry *inventoryEntry) query(ctx context.Context, user, pass string) {
+	if user == "" || pass == "" {
+		env := getContainerEnv(ctx, entry.ref)
+		if user == "" {
+			user = env["POSTGRES_USER"]
+		}
+		if pass == "" {
+			pass = env["POSTGRES_PASSWORD"]
+		}
+	}
+	if user == "" {
+		user = "postgres"
+	}
+	if v, err := serverVersion(ctx, entry.ref, user, pass); err == nil {
+		entry.setVersion(v)
+	} else {
+		entry.Error = strings.TrimSpace(err.Error())
+		return
+	}
+	var dbs []struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}
+	sql := "SELECT datname AS name, pg_database_size(datname) AS size FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname"
+	if err := queryJSON(ctx, entry.ref, user, pass, "postgres", sql, &dbs); err != nil {
+		entry.Error = strings.TrimSpace(err.Error())
+		return
+	}
+	for _, db := range dbs {
+		d := inventoryDatabase{Name: db.Name, SizeBytes: db.Size}
+		var exts []struct {
+			Ext string `json:"ext"`
+		}
+		sql := "SELECT extname || ' ' || extversion AS ext FROM pg_extension WHERE extname <> 'plpgsql' ORDER BY extname"
+		if err := queryJSON(ctx, entry.ref, user, pass, db.Name, sql, &exts); err != nil {
+			entry.Error = fmt.Sprintf("extensions of '%s': %s", db.Name, strings.TrimSpace(err.Error()))
+		}
+		for _, e := range exts {
+			d.Extensions = append(d.Extensions, e.Ext)
+		}
+		entry.Databases = append(entry.Databases, d)
+	}
+}
+
+// eolStatus returns the support state of major at now and its EOL date.
+func eolStatus(major string, now time.Time) (string, string) {
+	date, ok := postgresEOL[major]
+	if !ok {
+		return eolUnknown, ""
+	}
+	eol, _ := time.Parse("2006-01-02", date)
+	switch {
+	case !now.Before(eol):
+		return eolPast, date
+	case eol.Sub(now) < eolWarning:
+		return eolSoon, date
+	}
+	return eolSupported, date
+}
+
+func formatUptime(seconds int64) string {
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case seconds == 0:
+		return "-"
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
+
+func writeInventoryTable(entries []*inventoryEntry) {
+	engines := map[string]bool{}
+	for _, e := range entries {
+		engines[e.Engine] = true
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "CONTAINER\tIMAGE\tSTATE\tVERSION\tEOL\tUPTIME\tDATABASES\tEXTENSIONS"
+	if len(engines) > 1 {
+		header = "ENGINE\t" + header
+	}
+	fmt.Fprintln(w, header)
+	past, soon := 0, 0
+	for _, e := range entries {
+		eol := e.EOL
+		switch e.EOLStatus {
+		case eolPast:
+			eol += " EOL!"
+			past++
+		case eolSoon:
+			eol += " soon"
+			soon++
+		case eolUnknown:
+			eol = "?"
+		}
+		var dbs []string
+		extSet := map[string]bool{}
+		for _, d := range e.Databases {
+			dbs = append(dbs, fmt.Sprintf("%s (%s)", d.Name, formatBytes(d.SizeBytes)))
+			for _, x := range d.Extensions {
+				extSet[x] = true
+			}
+		}
+		exts := make([]string, 0, len(extSet))
+		for x := range extSet {
+			exts = append(exts, x)
+		}
+		sort.Strings(exts)
+		databases := strings.Join(dbs, ", ")
+		if e.Error != "" && len(dbs) == 0 {
+			databases = "(not readable: " + strings.Join(strings.Fields(e.Error), " ") + ")"
+		}
+		row := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", e.Container, e.Image, e.State, orDash(e.Version), eol,
+			formatUptime(e.UptimeSeconds), orDash(databases), orDash(strings.Join(exts, ", ")))
+		if len(engines) > 1 {
+			row = e.Engine + "\t" + row
+		}
+		fmt.Fprintln(w, row)
+	}
+	w.Flush()
+	fmt.Printf("\n%d container(s), %d past end of life, %d reaching it within %d days.\n", len(entries), past, soon, int(eolWarning.Hours()/24))
+}
+
+func writeInventoryCSV(entries []*inventoryEntry) {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"engine", "container", "image", "state", "version", "major", "minor", "eol", "eol_status", "uptime_seconds", "databases", "extensions", "error"})
+	for _, e := range entries {
+		var dbs, exts []string
+		for _, d := range e.Databases {
+			dbs = append(dbs, fmt.Sprintf("%s=%d", d.Name, d.SizeBytes))
+			for _, x := range d.Extensions {
+				exts = append(exts, d.Name+":"+x)
+			}
+		}
+		w.Write([]string{e.Engine, e.Container, e.Image, e.State, e.Version, e.Major, e.Minor, e.EOL, e.EOLStatus,
+			strconv.FormatInt(e.UptimeSeconds, 10), strings.Join(dbs, ";"), strings.Join(exts, ";"), e.Error})
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
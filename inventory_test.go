@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEOLStatus(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		name, major string
+		now         time.Time
+		wantStatus  string
+		wantDate    string
+	}{
+		{"long before", "16", day("2026-01-01"), eolSupported, "2028-11-09"},
+		{"just outside warning", "16", day("2028-11-09").Add(-eolWarning - time.Hour), eolSupported, "2028-11-09"},
+		{"inside warning", "16", day("2028-11-09").Add(-eolWarning + time.Hour), eolSoon, "2028-11-09"},
+		{"day before", "16", day("2028-11-08"), eolSoon, "2028-11-09"},
+		{"on the day", "12", day("2024-11-21"), eolPast, "2024-11-21"},
+		{"after", "9.6", day("2026-10-19"), eolPast, "2021-11-11"},
+		{"unknown major", "99", day("2026-10-19"), eolUnknown, ""},
+		{"no version", "", day("2026-10-19"), eolUnknown, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, date := eolStatus(tt.major, tt.now)
+			if status != tt.wantStatus || date != tt.wantDate {
+				t.Errorf("eolStatus(%q, %s) = %q, %q; want %q, %q", tt.major, tt.now.Format(time.RFC3339), status, date, tt.wantStatus, tt.wantDate)
+			}
+		})
+	}
+}
+
+func TestSetVersion(t *testing.T) {
+	tests := []struct {
+		in                    string
+		version, major, minor string
+	}{
+		{"16.4", "16.4", "16", "4"},
+		{"17.0 (Debian 17.0-1.pgdg120+1)", "17.0", "17", "0"},
+		{"18beta1", "18", "18", ""},
+		{"9.6.24", "9.6.24", "9.6", "24"},
+		{"9.6", "9.6", "9.6", ""},
+		{" 13.16\n", "13.16", "13", "16"},
+		{"latest", "", "", ""},
+	}
+	for _, tt := range tests {
+		var e inventoryEntry
+		e.setVersion(tt.in)
+		if e.Version != tt.version || e.Major != tt.major || e.Minor != tt.minor {
+			t.Errorf("setVersion(%q) = %q, %q, %q; want %q, %q, %q", tt.in, e.Version, e.Major, e.Minor, tt.version, tt.major, tt.minor)
+		}
+	}
+}
+
+func TestFormatUptime(t *testing.T) {
+	tests := []struct {
+		seconds int64
+		want    string
+	}{
+		{0, "-"},
+		{59, "0m"},
+		{45 * 60, "45m"},
+		{3*3600 + 5*60, "3h5m"},
+		{50 * 3600, "2d2h"},
+	}
+	for _, tt := range tests {
+		if got := formatUptime(tt.seconds); got != tt.want {
+			t.Errorf("formatUptime(%d) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
@@ -1,607 +1,997 @@
 package main
 
 import (
-    "bufio"
-    "bytes"
-    "fmt"
-    "os"
-    "os/exec"
-    "strconv"
-    "strings"
-    "time"
-
-    "golang.org/x/term"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
 )
 
 var (
 	appname = "docker-pgupgrade-go"
 	version = "0.1"
-	author = "Traktuner"
-    // Set via -ldflags in build.sh / CI
-    Tag       = ""
-    Commit    = ""
-    BuildTime = ""
+	author  = "Traktuner"
+	// Set via -ldflags in build.sh / CI
+	Tag       = ""
+	Commit    = ""
+	BuildTime = ""
 )
 
 func main() {
+	args := parseGlobalFlags(os.Args[1:])
+	ctx := handleInterrupts()
+	if len(args) > 0 {
+		cmd, ok := subcommands[args[0]]
+		if !ok {
+			if args[0] != "help" {
+				fmt.Fprintf(os.Stderr, "Unknown command '%s'.\n", args[0])
+			}
+			printUsage()
+			os.Exit(2)
+		}
+		code := cmd(ctx, args[1:])
+		exitIfInterrupted(ctx)
+		os.Exit(code)
+	}
+	// On Ctrl-C the flow below returns early; the interrupt cleanup exits the process
+	defer exitIfInterrupted(ctx)
+
 	reader := bufio.NewReader(os.Stdin)
 
 	//Output version tag
-    fmt.Println("====================================")
-    fmt.Printf(" %s\n", appname)
-    fmt.Printf(" Version: %s\n", version)
-    if Tag != "" {
-        fmt.Printf(" Tag: %s\n", Tag)
-    }
-    if Commit != "" {
-        fmt.Printf(" Commit: %s\n", Commit)
-    }
-    if BuildTime != "" {
-        fmt.Printf(" BuildTime: %s\n", BuildTime)
-    }
-    fmt.Printf(" Developed by: %s\n", author)
-    fmt.Println("====================================")
-
-    // Query Postgres Docker containers (filter by image name containing 'postgres')
-    fmt.Println("Querying all running Docker containers...")
-    containers, err := exec.Command("docker", "ps", "--format", "{{.Names}}::{{.Image}}").Output()
+	printBanner()
+
+	// The containers may run on another host (Docker context or DOCKER_HOST)
+	srcEngineStr := readLineWithDefault(reader, "Docker engine of the original container (context name, ssh:// or tcp:// host)", "local")
+	srcEngine, err := parseEngine(srcEngineStr)
 	if err != nil {
-		fmt.Printf("Error querying Docker containers: %v\n", err)
+		failf(errInvalidInput, "Invalid Docker engine: %v\n", err)
 		return
 	}
 
-    rawLines := strings.Split(strings.TrimSpace(string(containers)), "\n")
-    var containerNames []string
-    for _, line := range rawLines {
-        if strings.TrimSpace(line) == "" {
-            continue
-        }
-        parts := strings.SplitN(line, "::", 2)
-        name := parts[0]
-        image := ""
-        if len(parts) == 2 {
-            image = parts[1]
-        }
-        if strings.Contains(strings.ToLower(image), "postgres") {
-            containerNames = append(containerNames, name)
-        }
-    }
-    if len(containerNames) == 0 {
-		fmt.Println("No running Docker containers found.")
+	// Find PostgreSQL containers by image, env, labels, port or a pg_ctl probe; stopped ones included
+	logf("Looking for PostgreSQL containers...\n")
+	containers, err := discoverPostgres(ctx, srcEngine, true)
+	if err != nil {
+		failf(errDocker, "Error querying Docker containers: %v\n", err)
+		return
+	}
+	if len(containers) == 0 {
+		failf(errNoContainers, "No PostgreSQL containers found.\n")
 		return
 	}
 
 	// Choose the original PostgreSQL container
-	fmt.Println("Please choose the original PostgreSQL container:")
-	for i, name := range containerNames {
-		fmt.Printf("[%d] %s\n", i, name)
+	promptf("Please choose the original PostgreSQL container:\n")
+	for i, info := range containers {
+		if info.State.Running {
+			promptf("[%d] %s\n", i, info.Name)
+		} else {
+			promptf("[%d] %s (%s)\n", i, info.Name, info.State.Status)
+		}
 	}
-	fmt.Print("Enter the number of the original container: ")
-	originalIndexStr, _ := reader.ReadString('\n')
-	originalIndex, err := strconv.Atoi(strings.TrimSpace(originalIndexStr))
+	originalIndex, err := readIndex(reader, "Enter the number of the original container", len(containers))
 	if err != nil {
-		fmt.Printf("Invalid input: %v\n", err)
+		failf(errInvalidInput, "Invalid input: %v\n", err)
 		return
 	}
-	originalContainer := containerNames[originalIndex]
-
-    // Prefill credentials from container env if possible
-    srcEnv := getContainerEnv(originalContainer)
-    defaultSrcUser := srcEnv["POSTGRES_USER"]
-    defaultSrcPass := srcEnv["POSTGRES_PASSWORD"]
-    defaultSrcDB := srcEnv["POSTGRES_DB"]
-    if defaultSrcDB == "" {
-        defaultSrcDB = "postgres"
-    }
-
-    // Get original DB credentials and the database name for the dump
-    fmt.Printf("Enter the username for the original DB [%s]: ", defaultSrcUser)
-    originalUsername, _ := reader.ReadString('\n')
-    originalUsername = strings.TrimSpace(originalUsername)
-    if originalUsername == "" {
-        originalUsername = defaultSrcUser
-    }
-    originalPassword := readPasswordWithDefault("Enter the password for the original DB", defaultSrcPass)
-    fmt.Printf("Enter the database name for the dump [%s]: ", defaultSrcDB)
-    databaseName, _ := reader.ReadString('\n')
-    databaseName = strings.TrimSpace(databaseName)
-    if databaseName == "" {
-        databaseName = defaultSrcDB
-    }
+	originalContainer := onEngine(containers[originalIndex].Name, srcEngine)
+
+	// A stopped source is only started for the duration of the run
+	stopSource := func() {}
+	defer func() { stopSource() }()
+	if !containers[originalIndex].State.Running {
+		promptf("Container '%s' is not running. Start it temporarily for the migration? (yes/no): ", originalContainer.Name)
+		startStr, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(startStr)) != "yes" {
+			failf(errInvalidInput, "The original container must be running.\n")
+			return
+		}
+		if stopSource, err = startTemporarily(ctx, originalContainer); err != nil {
+			failf(errDocker, "%v\n", err)
+			return
+		}
+	}
+
+	// Prefill credentials from container env if possible
+	srcEnv := getContainerEnv(ctx, originalContainer)
+	defaultSrcUser := srcEnv["POSTGRES_USER"]
+	defaultSrcPass := srcEnv["POSTGRES_PASSWORD"]
+	defaultSrcDB := srcEnv["POSTGRES_DB"]
+	if defaultSrcDB == "" {
+		defaultSrcDB = "postgres"
+	}
+
+	// Get original DB credentials and the database name for the dump
+	promptf("Enter the username for the original DB [%s]: ", defaultSrcUser)
+	originalUsername, _ := reader.ReadString('\n')
+	originalUsername = strings.TrimSpace(originalUsername)
+	if originalUsername == "" {
+		originalUsername = defaultSrcUser
+	}
+	originalPassword := readPasswordWithDefault("Enter the password for the original DB", defaultSrcPass)
+	promptf("Enter the database name(s) to migrate, comma separated [%s]: ", defaultSrcDB)
+	databasesStr, _ := reader.ReadString('\n')
+	databases := splitList(databasesStr)
+	if len(databases) == 0 {
+		databases = []string{defaultSrcDB}
+	}
+	// The first database is used for the connection checks
+	databaseName := databases[0]
 
 	// Check connection to the original DB
-	if !checkPgConnection(originalContainer, originalUsername, originalPassword, databaseName) {
-		fmt.Println("The credentials for the original database are either wrong or there is some other problem with the database.")
+	if !checkPgConnection(ctx, originalContainer, originalUsername, originalPassword, databaseName) {
+		failf(errConnection, "The credentials for the original database are either wrong or there is some other problem with the database.\n")
+		return
+	}
+	// On Ctrl-C, stop pg_dump & co. inside the container too
+	watchSessions(originalContainer, originalUsername, originalPassword)
+
+	dstEngineStr := readLineWithDefault(reader, "Docker engine of the new container", srcEngineStr)
+	dstEngine, err := parseEngine(dstEngineStr)
+	if err != nil {
+		failf(errInvalidInput, "Invalid Docker engine: %v\n", err)
 		return
 	}
+	if dstEngine != srcEngine {
+		logf("Source and destination run on different engines; the dump is streamed through this host (%s -> %s).\n", srcEngine, dstEngine)
+	}
 
-    // Optionally create a new destination container automatically
-    fmt.Print("Do you want to automatically create the destination container? (yes/no): ")
-    autoCreateStr, _ := reader.ReadString('\n')
-    autoCreate := strings.TrimSpace(strings.ToLower(autoCreateStr)) == "yes"
-    var newContainer string
-    var newUsername, newPassword string
-    if autoCreate {
-        fmt.Print("Enter the image for the new container [postgres:latest]: ")
-        imageStr, _ := reader.ReadString('\n')
-        image := strings.TrimSpace(imageStr)
-        if image == "" {
-            image = "postgres:latest"
-        }
-        fmt.Print("Enter a name for the new container [pg-new]: ")
-        nameStr, _ := reader.ReadString('\n')
-        contName := strings.TrimSpace(nameStr)
-        if contName == "" {
-            contName = "pg-new"
-        }
-        fmt.Print("Enter a host port to expose [5433]: ")
-        portStr, _ := reader.ReadString('\n')
-        hostPort := strings.TrimSpace(portStr)
-        if hostPort == "" {
-            hostPort = "5433"
-        }
-        fmt.Print("Enter a volume name for data [pgdata_new]: ")
-        volStr, _ := reader.ReadString('\n')
-        volume := strings.TrimSpace(volStr)
-        if volume == "" {
-            volume = "pgdata_new"
-        }
-        // Ask for credentials for the new DB (prefill from src)
-        fmt.Printf("Enter the username for the new DB [%s]: ", originalUsername)
-        usrStr, _ := reader.ReadString('\n')
-        newUsername = strings.TrimSpace(usrStr)
-        if newUsername == "" {
-            newUsername = originalUsername
-        }
-        newPassword = readPasswordWithDefault("Enter the password for the new DB", originalPassword)
-
-        fmt.Printf("Creating volume '%s'...\n", volume)
-        if err := exec.Command("docker", "volume", "create", volume).Run(); err != nil {
-            fmt.Printf("Failed to create volume: %v\n", err)
-            return
-        }
-        fmt.Printf("Starting new container '%s' from image '%s'...\n", contName, image)
-        runArgs := []string{
-            "run", "-d",
-            "--name", contName,
-            "-e", fmt.Sprintf("POSTGRES_USER=%s", newUsername),
-            "-e", fmt.Sprintf("POSTGRES_PASSWORD=%s", newPassword),
-            "-e", fmt.Sprintf("POSTGRES_DB=%s", databaseName),
-            "-p", hostPort + ":5432",
-            "-v", volume + ":/var/lib/postgresql/data",
-            image,
-        }
-        cmdRun := exec.Command("docker", runArgs...)
-        var runStderr bytes.Buffer
-        cmdRun.Stderr = &runStderr
-        if err := cmdRun.Run(); err != nil {
-            fmt.Printf("Failed to start new container: %v - %s\n", err, runStderr.String())
-            return
-        }
-        newContainer = contName
-        // Wait until ready
-        fmt.Println("Waiting for the new PostgreSQL to be ready...")
-        if !waitForPgReady(newContainer, newUsername, newPassword, databaseName, 60*time.Second) {
-            fmt.Println("New PostgreSQL container did not become ready in time.")
-            return
-        }
-    } else {
-        // Choose the new PostgreSQL container
-        fmt.Println("Please choose the new PostgreSQL container:")
-        for i, name := range containerNames {
-            fmt.Printf("[%d] %s\n", i, name)
-        }
-        fmt.Print("Enter the number of the new container: ")
-        newIndexStr, _ := reader.ReadString('\n')
-        newIndex, err := strconv.Atoi(strings.TrimSpace(newIndexStr))
-        if err != nil {
-            fmt.Printf("Invalid input: %v\n", err)
-            return
-        }
-        newContainer = containerNames[newIndex]
-
-        // Check if we should use the same credentials for the new DB
-        fmt.Print("Do you want to use the credentials from the original database for the new container? (yes/no): ")
-        useSameCredentialsStr, _ := reader.ReadString('\n')
-        useSameCredentials := strings.TrimSpace(strings.ToLower(useSameCredentialsStr)) == "yes"
-
-        if useSameCredentials {
-            newUsername = originalUsername
-            newPassword = originalPassword
-        } else {
-            // Prefill from destination env
-            dstEnv := getContainerEnv(newContainer)
-            defUser := dstEnv["POSTGRES_USER"]
-            defPass := dstEnv["POSTGRES_PASSWORD"]
-            fmt.Printf("Enter the username for the new DB [%s]: ", defUser)
-            usr, _ := reader.ReadString('\n')
-            newUsername = strings.TrimSpace(usr)
-            if newUsername == "" {
-                newUsername = defUser
-            }
-            newPassword = readPasswordWithDefault("Enter the password for the new DB", defPass)
-        }
-    }
+	// A compose service can be upgraded in place: the data is migrated into a
+	// new volume, then the service is recreated from the new image on it
+	var upgrade *composeService
+	if svc := composeServiceOf(ctx, originalContainer); svc != nil && dstEngine == srcEngine {
+		promptf("'%s' is service '%s' of compose project '%s'. Upgrade the service in place? (yes/no): ",
+			originalContainer.Name, svc.Service, svc.Project)
+		inPlaceStr, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(inPlaceStr)) == "yes" {
+			upgrade = svc
+		}
+	}
+
+	// Optionally create a new destination container automatically
+	autoCreate := upgrade != nil
+	if !autoCreate {
+		promptf("Do you want to automatically create the destination container? (yes/no): ")
+		autoCreateStr, _ := reader.ReadString('\n')
+		autoCreate = strings.TrimSpace(strings.ToLower(autoCreateStr)) == "yes"
+	}
+	var newContainer containerRef
+	var newUsername, newPassword string
+	// Undo actions for the auto-created container; released once the migration succeeded
+	var releaseCreated []func()
+	if autoCreate && upgrade != nil {
+		image := readLineWithDefault(reader, "Enter the image for the upgraded service", "postgres:latest")
+		volume := readLineWithDefault(reader, "Enter a volume name for the new data", upgrade.volumeName(image))
+		// The data is migrated into a temporary container without a port
+		// and the same credentials; the service takes over its volume later
+		newUsername, newPassword = originalUsername, originalPassword
+		upgrade.NewImage, upgrade.Volume = image, volume
+		upgrade.DataDir = imageDataDir(ctx, dstEngine, image)
+		newContainer, releaseCreated, err = createPostgresContainer(ctx, dstEngine, image, upgrade.tempContainerName(), "", volume, upgrade.DataDir,
+			newUsername, newPassword, databaseName)
+		if err != nil {
+			failf(errContainerCreate, "%v\n", err)
+			return
+		}
+		// Ctrl-C keeps the volume: the service may already run on it
+		releaseCreated[0]()
+	} else if autoCreate {
+		promptf("Enter the image for the new container [postgres:latest]: ")
+		imageStr, _ := reader.ReadString('\n')
+		image := strings.TrimSpace(imageStr)
+		if image == "" {
+			image = "postgres:latest"
+		}
+		promptf("Enter a name for the new container [pg-new]: ")
+		nameStr, _ := reader.ReadString('\n')
+		contName := strings.TrimSpace(nameStr)
+		if contName == "" {
+			contName = "pg-new"
+		}
+		promptf("Enter a host port to expose [5433]: ")
+		portStr, _ := reader.ReadString('\n')
+		hostPort := strings.TrimSpace(portStr)
+		if hostPort == "" {
+			hostPort = "5433"
+		}
+		promptf("Enter a volume name for data [pgdata_new]: ")
+		volStr, _ := reader.ReadString('\n')
+		volume := strings.TrimSpace(volStr)
+		if volume == "" {
+			volume = "pgdata_new"
+		}
+		// Ask for credentials for the new DB (prefill from src)
+		promptf("Enter the username for the new DB [%s]: ", originalUsername)
+		usrStr, _ := reader.ReadString('\n')
+		newUsername = strings.TrimSpace(usrStr)
+		if newUsername == "" {
+			newUsername = originalUsername
+		}
+		newPassword = readPasswordWithDefault("Enter the password for the new DB", originalPassword)
+
+		dataDir := imageDataDir(ctx, dstEngine, image)
+		newContainer, releaseCreated, err = createPostgresContainer(ctx, dstEngine, image, contName, hostPort, volume, dataDir,
+			newUsername, newPassword, databaseName)
+		if err != nil {
+			failf(errContainerCreate, "%v\n", err)
+			return
+		}
+	} else {
+		dstContainers := containers
+		if dstEngine != srcEngine {
+			if dstContainers, err = discoverPostgres(ctx, dstEngine, false); err != nil {
+				failf(errDocker, "Error querying Docker containers on %s: %v\n", dstEngine, err)
+				return
+			}
+		}
+		// The destination must already run
+		var dstNames []string
+		for _, info := range dstContainers {
+			if info.State.Running {
+				dstNames = append(dstNames, info.Name)
+			}
+		}
+		if len(dstNames) == 0 {
+			failf(errNoContainers, "No running PostgreSQL containers found on %s.\n", dstEngine)
+			return
+		}
+		// Choose the new PostgreSQL container
+		promptf("Please choose the new PostgreSQL container:\n")
+		for i, name := range dstNames {
+			promptf("[%d] %s\n", i, name)
+		}
+		newIndex, err := readIndex(reader, "Enter the number of the new container", len(dstNames))
+		if err != nil {
+			failf(errInvalidInput, "Invalid input: %v\n", err)
+			return
+		}
+		newContainer = onEngine(dstNames[newIndex], dstEngine)
+
+		// Check if we should use the same credentials for the new DB
+		promptf("Do you want to use the credentials from the original database for the new container? (yes/no): ")
+		useSameCredentialsStr, _ := reader.ReadString('\n')
+		useSameCredentials := strings.TrimSpace(strings.ToLower(useSameCredentialsStr)) == "yes"
+
+		if useSameCredentials {
+			newUsername = originalUsername
+			newPassword = originalPassword
+		} else {
+			// Prefill from destination env
+			dstEnv := getContainerEnv(ctx, newContainer)
+			defUser := dstEnv["POSTGRES_USER"]
+			defPass := dstEnv["POSTGRES_PASSWORD"]
+			promptf("Enter the username for the new DB [%s]: ", defUser)
+			usr, _ := reader.ReadString('\n')
+			newUsername = strings.TrimSpace(usr)
+			if newUsername == "" {
+				newUsername = defUser
+			}
+			newPassword = readPasswordWithDefault("Enter the password for the new DB", defPass)
+		}
+	}
 
 	// Check connection to the new DB
-	if !checkPgConnection(newContainer, newUsername, newPassword, databaseName) {
-		fmt.Println("The credentials for the new database are either wrong or there is some other problem with the database.")
+	if !checkPgConnection(ctx, newContainer, newUsername, newPassword, databaseName) {
+		failf(errConnection, "The credentials for the new database are either wrong or there is some other problem with the database.\n")
+		return
+	}
+	watchSessions(newContainer, newUsername, newPassword)
+
+	// Migration method: stream (recommended) or file-based
+	plan := &migrationPlan{
+		SrcContainer: originalContainer, SrcUser: originalUsername, SrcPassword: originalPassword,
+		DstContainer: newContainer, DstUser: newUsername, DstPassword: newPassword,
+		Databases: databases, Compose: upgrade,
+		Hooks: globalHooks,
+	}
+	promptf("Use streaming migration (no temporary file)? (yes/no): ")
+	streamStr, _ := reader.ReadString('\n')
+	plan.Stream = strings.TrimSpace(strings.ToLower(streamStr)) == "yes"
+
+	if plan.Stream {
+		// Optionally keep object ownership and GRANTs (requires the roles on the destination)
+		promptf("Preserve ownership and privileges (requires the same roles on the destination)? (yes/no): ")
+		preserveStr, _ := reader.ReadString('\n')
+		plan.PreserveOwnership = strings.TrimSpace(strings.ToLower(preserveStr)) == "yes"
+		plan.MigrateGlobals = plan.PreserveOwnership
+		if plan.PreserveOwnership {
+			logf("Global objects (roles) will be migrated first so ownership can be restored.\n")
+			roleMapStr := readLineWithDefault(reader, "Role rename mapping (old=new, comma separated)", "")
+			plan.RoleMap, err = parseRoleMap(roleMapStr)
+			if err != nil {
+				failf(errInvalidInput, "Invalid role mapping: %v\n", err)
+				return
+			}
+		} else {
+			// Optionally migrate global objects (roles, db-level settings)
+			promptf("Also migrate global objects (roles)? (yes/no): ")
+			globalsStr, _ := reader.ReadString('\n')
+			plan.MigrateGlobals = strings.TrimSpace(strings.ToLower(globalsStr)) == "yes"
+		}
+	}
+
+	compStr := readLineWithDefault(reader, "Compression for dump files and the stream (none, gzip[:level], pg_dump[:level])", defaultCompression.String())
+	plan.Compression, err = parseCompression(compStr)
+	if err != nil {
+		failf(errInvalidInput, "Invalid compression: %v\n", err)
+		return
+	}
+
+	// Optionally keep applications from writing to the source while it is dumped
+	maintStr := readLineWithDefault(reader, "Maintenance mode for the source during the migration (none/read_only/block)", "none")
+	plan.Maintenance, err = parseMaintenanceMode(strings.ToLower(maintStr))
+	if err != nil {
+		failf(errInvalidInput, "Invalid maintenance mode: %v\n", err)
+		return
+	}
+	if plan.Maintenance != "" {
+		graceStr := readLineWithDefault(reader, "Grace period before other sessions are terminated", defaultDrainGrace.String())
+		if plan.DrainGrace, err = time.ParseDuration(graceStr); err != nil || plan.DrainGrace < 0 {
+			logf("Invalid grace period '%s'; using %s.\n", graceStr, defaultDrainGrace)
+			plan.DrainGrace = defaultDrainGrace
+		}
+	}
+
+	// Applications using the source are stopped so they do not write during the run
+	plan.StopContainers = readApplicationContainers(ctx, reader, originalContainer, newContainer)
+
+	// Verification runs after each database, so ask before starting
+	plan.VerifyMode, plan.CountOptions, plan.SmokeFile = readVerificationSettings(reader)
+
+	// Optionally keep a custom-format archive of every database as rollback point
+	plan.BackupDir = readLineWithDefault(reader, "Directory to keep a backup archive of each database (empty = no backup)", "")
+	if plan.BackupDir != "" {
+		keepStr := readLineWithDefault(reader, "Number of backups to keep per database (0 = unlimited)", "5")
+		if n, err := strconv.Atoi(keepStr); err == nil && n >= 0 {
+			plan.Retention.Keep = n
+		} else {
+			logf("Invalid number '%s'; keeping all backups.\n", keepStr)
+		}
+		ageStr := readLineWithDefault(reader, "Remove backups older than (e.g. 30d, 0 = never)", "0")
+		if d, err := parseAge(ageStr); err == nil {
+			plan.Retention.MaxAge = d
+		} else {
+			logf("%v; backups are not removed by age.\n", err)
+		}
+		plan.BackupUpload = readLineWithDefault(reader, "Also upload backups to (s3://bucket/prefix, empty = no)", "")
+		if plan.BackupUpload != "" && !strings.HasPrefix(plan.BackupUpload, "s3://") {
+			failf(errInvalidInput, "Invalid upload target '%s'; expected s3://bucket/prefix.\n", plan.BackupUpload)
+			return
+		}
+	}
+
+	// Progress is recorded so an interrupted run can be continued with "resume"
+	if _, err := os.Stat(defaultStateFile); err == nil {
+		promptf("A state file '%s' from an earlier run exists. Start over and replace it? (yes/no): ", defaultStateFile)
+		replaceStr, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(replaceStr)) != "yes" {
+			logf("Aborted. Run '%s resume' to continue the earlier run.\n", appname)
+			return
+		}
+	}
+	state := newRunState(defaultStateFile, plan)
+	if err := state.save(); err != nil {
+		logf("Saving run state to '%s' failed: %v\n", defaultStateFile, err)
+	}
+	releaseState := onInterrupt("keep run state", func(ctx context.Context) {
+		logf("Progress was saved to '%s'; run '%s resume' to continue.\n", defaultStateFile, appname)
+	})
+
+	err = runMigration(ctx, plan, state)
+	if ctx.Err() != nil {
 		return
 	}
+	releaseState()
+	if err != nil {
+		logf("Progress was saved to '%s'; run '%s resume' to continue.\n", defaultStateFile, appname)
+		return
+	}
+	for _, release := range releaseCreated {
+		release()
+	}
+	if plan.Compose != nil {
+		// The service was recreated on the new volume; it has to keep running
+		stopSource = func() {}
+	}
+	// Nothing left to resume
+	os.Remove(defaultStateFile)
+}
+
+// createPostgresContainer creates volume and starts a container from image on
+// engine e with its data there, publishing hostPort unless it is empty. It
+// returns the container reference once PostgreSQL is ready, and the undo
+// actions registered for an interrupt.
+func createPostgresContainer(ctx context.Context, e dockerEngine, image, contName, hostPort, volume, dataDir, user, pass, db string) (containerRef, []func(), error) {
+	var releases []func()
+	contRef := onEngine(contName, e)
+
+	createDone := startPhase("create_container")
+	logf("Creating volume '%s'...\n", volume)
+	if err := engineCommand(ctx, e, "volume", "create", volume).Run(); err != nil {
+		createDone(err)
+		return containerRef{}, releases, fmt.Errorf("Failed to create volume: %v", err)
+	}
+	releases = append(releases, onInterrupt(fmt.Sprintf("remove volume '%s'", volume), func(ctx context.Context) {
+		engineCommand(ctx, e, "volume", "rm", volume).Run()
+	}))
+	logf("Starting new container '%s' from image '%s'...\n", contName, image)
+	runArgs := []string{
+		"run", "-d",
+		"--name", contName,
+	}
+	// Official or Bitnami variables, depending on the image
+	runArgs = append(runArgs, containerEnvArgs(ctx, e, image, user, pass, db)...)
+	if hostPort != "" {
+		runArgs = append(runArgs, "-p", hostPort+":5432")
+	}
+	runArgs = append(runArgs, "-v", volume+":"+dataDir, image)
+	run := dockerCall{Engine: e, Args: runArgs}
+	cmdRun := run.command(ctx)
+	var runStderr bytes.Buffer
+	cmdRun.Stderr = &runStderr
+	reportCommand(run.String())
+	if err := cmdRun.Run(); err != nil {
+		createDone(err)
+		return containerRef{}, releases, fmt.Errorf("Failed to start new container: %v - %s", err, runStderr.String())
+	}
+	releases = append(releases, onInterrupt(fmt.Sprintf("remove container '%s'", contName), func(ctx context.Context) {
+		engineCommand(ctx, e, "rm", "-f", contName).Run()
+	}))
+	// Wait until ready
+	logf("Waiting for the new PostgreSQL to be ready...\n")
+	if !waitForPgReady(ctx, contRef, user, pass, db, 60*time.Second) {
+		createDone(fmt.Errorf("not ready in time"))
+		return containerRef{}, releases, fmt.Errorf("New PostgreSQL container did not become ready in time")
+	}
+	createDone(nil)
+	return contRef, releases, nil
+}
 
-    // Migration method: stream (recommended) or file-based
-    fmt.Print("Use streaming migration (no temporary file)? (yes/no): ")
-    streamStr, _ := reader.ReadString('\n')
-    useStream := strings.TrimSpace(strings.ToLower(streamStr)) == "yes"
-
-    if useStream {
-        // Optionally migrate global objects (roles, db-level settings)
-        fmt.Print("Also migrate global objects (roles)? (yes/no): ")
-        globalsStr, _ := reader.ReadString('\n')
-        migrateGlobals := strings.TrimSpace(strings.ToLower(globalsStr)) == "yes"
-        if migrateGlobals {
-            if err := streamGlobals(originalContainer, originalUsername, originalPassword, newContainer, newUsername, newPassword); err != nil {
-                fmt.Printf("Error migrating global objects: %v\n", err)
-                return
-            }
-        }
-
-        if err := streamDumpRestore(originalContainer, originalUsername, originalPassword, newContainer, newUsername, newPassword, databaseName); err != nil {
-            fmt.Printf("Error migrating database: %v\n", err)
-            return
-        }
-        fmt.Println("Database migration completed successfully.")
-        // Optional verification
-        runPostMigrationVerification(reader, originalContainer, originalUsername, originalPassword, newContainer, newUsername, newPassword, databaseName)
-        return
-    }
-
-    // Fallback: file-based dump/restore (plain SQL)
-    dumpFileName := databaseName + "_dump.sql"
-    fmt.Printf("Running pg_dump on the original container '%s'...\n", originalContainer)
-    cmd := exec.Command("docker", "exec", "-e", "PGPASSWORD="+originalPassword, originalContainer, "pg_dump", "-U", originalUsername, "-d", databaseName, "-f", "/"+dumpFileName)
-    var stderr bytes.Buffer
-    cmd.Stderr = &stderr
-    if err := cmd.Run(); err != nil {
-        fmt.Printf("Failed to dump the database: %v - %s\n", err, stderr.String())
-        return
-    }
-
-    // Copy the dump file from the original container to the local filesystem
-    fmt.Printf("Copying the dump file from the original container '%s' to the local filesystem...\n", originalContainer)
-    localDumpPath := "./" + dumpFileName
-    err = exec.Command("docker", "cp", fmt.Sprintf("%s:/%s", originalContainer, dumpFileName), localDumpPath).Run()
-    if err != nil {
-        fmt.Printf("Error copying the dump file from the original container: %v\n", err)
-        return
-    }
-
-    // Copy the dump file from the local filesystem to the new container
-    fmt.Printf("Copying the dump file to the new container '%s'...\n", newContainer)
-    err = exec.Command("docker", "cp", localDumpPath, fmt.Sprintf("%s:/%s", newContainer, dumpFileName)).Run()
-    if err != nil {
-        fmt.Printf("Error copying the dump file to the new container: %v\n", err)
-        return
-    }
-
-    // Restore the dump into the new database
-    fmt.Printf("Restoring the dump file into the new database on container '%s'...\n", newContainer)
-    cmd = exec.Command("docker", "exec", "-e", "PGPASSWORD="+newPassword, newContainer, "psql", "-U", newUsername, "-d", databaseName, "-f", "/"+dumpFileName)
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
-    if err := cmd.Run(); err != nil {
-        fmt.Printf("Error restoring the database: %v\n", err)
-        return
-    }
-
-    // Cleanup: delete the dump file from the container and the script directory
-    fmt.Println("Cleaning up...")
-    exec.Command("docker", "exec", originalContainer, "rm", "/"+dumpFileName).Run()
-    exec.Command("docker", "exec", newContainer, "rm", "/"+dumpFileName).Run()
-    exec.Command("rm", localDumpPath).Run()
-
-    fmt.Println("Database migration completed successfully.")
-    // Optional verification
-    runPostMigrationVerification(reader, originalContainer, originalUsername, originalPassword, newContainer, newUsername, newPassword, databaseName)
-}
-
-func checkPgConnection(containerName, username, password, database string) bool {
-	fmt.Printf("Checking PostgreSQL connection for container '%s'...\n", containerName)
-    cmd := exec.Command("docker", "exec", "-e", "PGPASSWORD="+password, containerName, "pg_isready", "-U", username, "-d", database)
+func checkPgConnection(ctx context.Context, container containerRef, username, password, database string) bool {
+	logf("Checking PostgreSQL connection for container '%s'...\n", container)
+	cmd := pgExec(container, password, false, "pg_isready", "-U", username, "-d", database).command(ctx)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		fmt.Printf("Failed to connect to PostgreSQL on container '%s': %v - %s\n", containerName, err, stderr.String())
+		logf("Failed to connect to PostgreSQL on container '%s': %v - %s\n", container, err, stderr.String())
 		return false
 	}
-	fmt.Printf("PostgreSQL on container '%s' is ready.\n", containerName)
+	logf("PostgreSQL on container '%s' is ready.\n", container)
 	return true
 }
 
-func waitForPgReady(containerName, username, password, database string, timeout time.Duration) bool {
-    deadline := time.Now().Add(timeout)
-    for {
-        if checkPgConnection(containerName, username, password, database) {
-            return true
-        }
-        if time.Now().After(deadline) {
-            return false
-        }
-        time.Sleep(2 * time.Second)
-    }
-}
-
-func getContainerEnv(containerName string) map[string]string {
-    out, err := exec.Command("docker", "inspect", "--format", "{{range .Config.Env}}{{println .}}{{end}}", containerName).Output()
-    if err != nil {
-        return map[string]string{}
-    }
-    env := map[string]string{}
-    scanner := bufio.NewScanner(bytes.NewReader(out))
-    for scanner.Scan() {
-        line := scanner.Text()
-        if strings.TrimSpace(line) == "" {
-            continue
-        }
-        kv := strings.SplitN(line, "=", 2)
-        if len(kv) == 2 {
-            env[kv[0]] = kv[1]
-        }
-    }
-    return env
+func waitForPgReady(ctx context.Context, container containerRef, username, password, database string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if checkPgConnection(ctx, container, username, password, database) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// getContainerEnv returns the environment of a container. POSTGRES_USER,
+// POSTGRES_PASSWORD and POSTGRES_DB are filled in from the conventions of
+// other images and from secret files, see normalizeCredentials.
+func getContainerEnv(ctx context.Context, container containerRef) map[string]string {
+	out, err := engineCommand(ctx, container.Engine, "inspect", "--format", "{{range .Config.Env}}{{println .}}{{end}}", container.Name).Output()
+	if err != nil {
+		return map[string]string{}
+	}
+	env := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	normalizeCredentials(ctx, container, env)
+	return env
 }
 
 func readPasswordWithDefault(prompt string, def string) string {
-    if def != "" {
-        fmt.Printf("%s [hidden, press Enter to keep existing]: ", prompt)
-    } else {
-        fmt.Printf("%s: ", prompt)
-    }
-    // Disable input echo for password
-    pwdBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
-    fmt.Println("")
-    if err != nil {
-        // Fallback to visible input
-        reader := bufio.NewReader(os.Stdin)
-        val, _ := reader.ReadString('\n')
-        val = strings.TrimSpace(val)
-        if val == "" {
-            return def
-        }
-        return val
-    }
-    val := strings.TrimSpace(string(pwdBytes))
-    if val == "" {
-        return def
-    }
-    return val
-}
-
-// shellQuote returns a safely single-quoted string for embedding into shell commands
-func shellQuote(s string) string {
-    // Replace ' with '\'' pattern
-    return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
-}
-
-func streamGlobals(srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass string) error {
-    fmt.Println("Migrating global objects (roles)...")
-    cmdStr := fmt.Sprintf(
-        "docker exec -e PGPASSWORD=%s %s pg_dumpall -U %s --globals-only | docker exec -e PGPASSWORD=%s -i %s psql -U %s -d postgres",
-        shellQuote(srcPass), srcContainer, shellQuote(srcUser), shellQuote(dstPass), dstContainer, shellQuote(dstUser),
-    )
-    return runShellPipeline(cmdStr)
-}
-
-func streamDumpRestore(srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName string) error {
-    fmt.Printf("Streaming dump from '%s' to '%s' for database '%s'...\n", srcContainer, dstContainer, dbName)
-    // Use custom format for potential parallelism; pg_restore reads from stdin
-    // Note: -j parallelism cannot be used when reading from stdin; keep single-threaded for reliability
-    cmdStr := fmt.Sprintf(
-        "docker exec -e PGPASSWORD=%s %s pg_dump -U %s -d %s -Fc --no-owner --no-privileges | docker exec -e PGPASSWORD=%s -i %s pg_restore -U %s -d %s --clean --if-exists",
-        shellQuote(srcPass), srcContainer, shellQuote(srcUser), shellQuote(dbName), shellQuote(dstPass), dstContainer, shellQuote(dstUser), shellQuote(dbName),
-    )
-    return runShellPipeline(cmdStr)
-}
-
-func runShellPipeline(command string) error {
-    fmt.Printf("Running: %s\n", command)
-    // Use /bin/sh -c to execute the full pipeline
-    cmd := exec.Command("/bin/sh", "-c", command)
-    cmd.Stdout = os.Stdout
-    var stderr bytes.Buffer
-    cmd.Stderr = &stderr
-    if err := cmd.Run(); err != nil {
-        return fmt.Errorf("pipeline failed: %v - %s", err, stderr.String())
-    }
-    return nil
+	if def != "" {
+		promptf("%s [hidden, press Enter to keep existing]: ", prompt)
+	} else {
+		promptf("%s: ", prompt)
+	}
+	// Disable input echo for password
+	pwdBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
+	promptf("\n")
+	if err != nil {
+		// Fallback to visible input
+		reader := bufio.NewReader(os.Stdin)
+		val, _ := reader.ReadString('\n')
+		val = strings.TrimSpace(val)
+		if val == "" {
+			return def
+		}
+		return val
+	}
+	val := strings.TrimSpace(string(pwdBytes))
+	if val == "" {
+		return def
+	}
+	return val
+}
+
+// readIndex asks for a list index until one in [0, n) is entered. It fails
+// only when the input ends.
+func readIndex(reader *bufio.Reader, prompt string, n int) (int, error) {
+	for {
+		promptf("%s: ", prompt)
+		line, err := reader.ReadString('\n')
+		if i, convErr := strconv.Atoi(strings.TrimSpace(line)); convErr == nil && i >= 0 && i < n {
+			return i, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("no container chosen: %w", err)
+		}
+		logf("Please enter a number from 0 to %d.\n", n-1)
+	}
+}
+
+func readLineWithDefault(reader *bufio.Reader, prompt string, def string) string {
+	promptf("%s [%s]: ", prompt, def)
+	val, _ := reader.ReadString('\n')
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return def
+	}
+	return val
+}
+
+func streamGlobals(ctx context.Context, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass string, roleMap map[string]string) error {
+	logf("Migrating global objects (roles)...\n")
+	srcCall := pgExec(srcContainer, srcPass, false, "pg_dumpall", "-U", srcUser, "--globals-only")
+	// Best effort: a role attribute or setting the destination rejects is
+	// reported as a warning instead of stopping the migration
+	dstCall := pgExec(dstContainer, dstPass, true, "psql", "-X", "-U", dstUser, "-d", "postgres")
+	_, err := streamWithRoleRewrite(ctx, srcCall, dstCall, &roleRewriter{roleMap: roleMap, globals: true, keepRole: dstUser}, nil)
+	return err
+}
+
+// streamDumpRestore pipes pg_dump into the destination and returns the sha256
+// and size of the streamed dump, which the run state records. comp makes
+// pg_dump compress inside the source container.
+func streamDumpRestore(ctx context.Context, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, dbName string, preserveOwnership bool, roleMap map[string]string, comp compression) (string, int64, error) {
+	logf("Streaming dump from '%s' to '%s' for database '%s'...\n", srcContainer, dstContainer, dbName)
+	progress := newStreamProgress(ctx, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName)
+	progress.begin()
+	defer progress.finish()
+	hash := sha256.New()
+	tee := io.MultiWriter(progress, hash)
+	var err error
+	if preserveOwnership && len(roleMap) > 0 {
+		// Roles are renamed in the SQL text, so stream plain format
+		srcTool := append([]string{"pg_dump", "-U", srcUser, "-d", dbName, "-Fp", "--clean", "--if-exists"}, comp.streamArgs()...)
+		var received int64
+		received, err = streamWithRoleRewrite(ctx,
+			pgExec(srcContainer, srcPass, false, srcTool...),
+			pgExec(dstContainer, dstPass, true, "psql", "-X", "-v", "ON_ERROR_STOP=1", "-U", dstUser, "-d", dbName),
+			&roleRewriter{roleMap: roleMap}, tee,
+		)
+		if err == nil {
+			reportCompression("dump_restore", comp, progress.bytes.Load(), received, false, time.Since(progress.start))
+		}
+	} else {
+		// Use custom format for potential parallelism; pg_restore reads from stdin
+		// Note: -j parallelism cannot be used when reading from stdin; keep single-threaded for reliability
+		srcTool := append([]string{"pg_dump", "-U", srcUser, "-d", dbName, "-Fc"}, comp.streamArgs()...)
+		if !preserveOwnership {
+			srcTool = append(srcTool, "--no-owner", "--no-privileges")
+		}
+		dstCall := pgExec(dstContainer, dstPass, true, "pg_restore", "-U", dstUser, "-d", dbName, "--clean", "--if-exists")
+		_, err = pipeDocker(ctx, pgExec(srcContainer, srcPass, false, srcTool...), dstCall, plainCopy(tee))
+		if err == nil {
+			// pg_restore decompresses internally; compare with the database size
+			reportCompression("dump_restore", comp, progress.srcSize, progress.bytes.Load(), true, time.Since(progress.start))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), progress.bytes.Load(), err
 }
 
 // ===== Verification helpers =====
 
-func runPostMigrationVerification(reader *bufio.Reader, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName string) {
-    fmt.Print("Run post-migration verification? (none/quick/full) [none]: ")
-    modeStr, _ := reader.ReadString('\n')
-    mode := strings.TrimSpace(strings.ToLower(modeStr))
-    if mode == "" {
-        mode = "none"
-    }
-    switch mode {
-    case "none":
-        return
-    case "quick":
-        if err := verifySchemaEqual(srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName); err != nil {
-            fmt.Printf("Verification (schema) failed: %v\n", err)
-        } else {
-            fmt.Println("Schema verification passed.")
-        }
-    case "full":
-        if err := verifySchemaEqual(srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName); err != nil {
-            fmt.Printf("Verification (schema) failed: %v\n", err)
-            // continue to counts to provide more info
-        } else {
-            fmt.Println("Schema verification passed.")
-        }
-        if err := verifyRowCountsEqual(srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName); err != nil {
-            fmt.Printf("Verification (row counts) failed: %v\n", err)
-        } else {
-            fmt.Println("Row counts verification passed.")
-        }
-    default:
-        fmt.Println("Unknown verification mode; skipping.")
-    }
-}
-
-func verifySchemaEqual(srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName string) error {
-    srcSchema, err := dumpSchema(srcContainer, srcUser, srcPass, dbName)
-    if err != nil {
-        return fmt.Errorf("src schema dump failed: %w", err)
-    }
-    dstSchema, err := dumpSchema(dstContainer, dstUser, dstPass, dbName)
-    if err != nil {
-        return fmt.Errorf("dst schema dump failed: %w", err)
-    }
-    normSrc := normalizeSchema(srcSchema)
-    normDst := normalizeSchema(dstSchema)
-    if normSrc != normDst {
-        return fmt.Errorf("schema differs between source and destination")
-    }
-    return nil
-}
-
-func dumpSchema(container, user, pass, db string) (string, error) {
-    args := []string{"exec", "-e", "PGPASSWORD=" + pass, container, "pg_dump", "-U", user, "-d", db, "-s", "--no-owner", "--no-privileges"}
-    cmd := exec.Command("docker", args...)
-    var out bytes.Buffer
-    var errBuf bytes.Buffer
-    cmd.Stdout = &out
-    cmd.Stderr = &errBuf
-    if err := cmd.Run(); err != nil {
-        return "", fmt.Errorf("%v - %s", err, errBuf.String())
-    }
-    return out.String(), nil
+// readVerificationSettings asks which verification to run after each
+// database has been migrated.
+func readVerificationSettings(reader *bufio.Reader) (mode string, opts countOptions, smokeFile string) {
+	promptf("Run post-migration verification? (none/quick/estimate/full) [none]: ")
+	modeStr, _ := reader.ReadString('\n')
+	mode = strings.TrimSpace(strings.ToLower(modeStr))
+	if mode == "" {
+		mode = "none"
+	}
+	opts = defaultCountOptions()
+	if mode == "full" {
+		opts = readCountOptions(reader, opts)
+	}
+	smokeFile = readLineWithDefault(reader, "Smoke-test query file (JSON, empty to skip)", "")
+	return mode, opts, smokeFile
+}
+
+// verifyResult is the outcome of a single verification step.
+type verifyResult struct {
+	Name string
+	Err  error
+}
+
+// runVerification runs the schema/row count checks selected by mode followed
+// by the smoke-test queries from smokeFile (if any).
+func runVerification(ctx context.Context, mode string, opts countOptions, smokeFile string, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, dbName string) []verifyResult {
+	var results []verifyResult
+	switch mode {
+	case "none":
+	case "quick":
+		err := verifySchemaEqual(ctx, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName)
+		if err != nil {
+			logf("Verification (schema) failed: %v\n", err)
+		} else {
+			logf("Schema verification passed.\n")
+		}
+		results = append(results, verifyResult{Name: "schema", Err: err})
+	case "estimate", "full":
+		opts.Estimate = mode == "estimate"
+		err := verifySchemaEqual(ctx, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName)
+		if err != nil {
+			logf("Verification (schema) failed: %v\n", err)
+			// continue to counts to provide more info
+		} else {
+			logf("Schema verification passed.\n")
+		}
+		results = append(results, verifyResult{Name: "schema", Err: err})
+		err = verifyRowCountsEqual(ctx, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName, opts)
+		if err != nil {
+			logf("Verification (row counts) failed: %v\n", err)
+		} else {
+			logf("Row counts verification passed.\n")
+		}
+		results = append(results, verifyResult{Name: "row counts", Err: err})
+	default:
+		logf("Unknown verification mode; skipping.\n")
+	}
+	if smokeFile != "" {
+		checks, err := loadSmokeChecks(smokeFile)
+		if err != nil {
+			logf("Loading smoke tests failed: %v\n", err)
+			results = append(results, verifyResult{Name: "smoke tests", Err: err})
+		} else {
+			results = append(results, runSmokeChecks(ctx, checks, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName)...)
+		}
+	}
+	return results
+}
+
+// printVerificationSummary prints the pass/fail summary and reports whether
+// every step passed.
+func printVerificationSummary(results []verifyResult) bool {
+	if len(results) == 0 {
+		return true
+	}
+	failed := 0
+	logf("Verification summary:\n")
+	for _, r := range results {
+		reportVerification(r)
+		if r.Err != nil {
+			failed++
+		}
+	}
+	logf("%d passed, %d failed.\n", len(results)-failed, failed)
+	return failed == 0
+}
+
+// countOptions controls how row counts are gathered for verification.
+type countOptions struct {
+	Estimate     bool          // compare pg_class.reltuples after ANALYZE instead of COUNT(*)
+	Workers      int           // parallel COUNT(*) queries per container
+	TableTimeout time.Duration // statement_timeout for each COUNT(*) query (0 = none)
+}
+
+// estimateTolerance is the relative difference allowed between row estimates.
+const estimateTolerance = 0.1
+
+func defaultCountOptions() countOptions {
+	return countOptions{Workers: 4, TableTimeout: 30 * time.Minute}
+}
+
+func readCountOptions(reader *bufio.Reader, opts countOptions) countOptions {
+	workersStr := readLineWithDefault(reader, "Parallel COUNT(*) queries per container", strconv.Itoa(opts.Workers))
+	if n, err := strconv.Atoi(workersStr); err == nil && n > 0 {
+		opts.Workers = n
+	} else {
+		logf("Invalid worker count '%s'; using %d.\n", workersStr, opts.Workers)
+	}
+	timeoutStr := readLineWithDefault(reader, "Timeout per table count (e.g. 10m, 0 = none)", opts.TableTimeout.String())
+	if d, err := time.ParseDuration(timeoutStr); err == nil && d >= 0 {
+		opts.TableTimeout = d
+	} else {
+		logf("Invalid timeout '%s'; using %s.\n", timeoutStr, opts.TableTimeout)
+	}
+	return opts
+}
+
+func verifySchemaEqual(ctx context.Context, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, dbName string) error {
+	srcSchema, err := dumpSchema(ctx, srcContainer, srcUser, srcPass, dbName)
+	if err != nil {
+		return fmt.Errorf("src schema dump failed: %w", err)
+	}
+	dstSchema, err := dumpSchema(ctx, dstContainer, dstUser, dstPass, dbName)
+	if err != nil {
+		return fmt.Errorf("dst schema dump failed: %w", err)
+	}
+	normSrc := normalizeSchema(srcSchema)
+	normDst := normalizeSchema(dstSchema)
+	if normSrc != normDst {
+		return fmt.Errorf("schema differs between source and destination")
+	}
+	return nil
+}
+
+func dumpSchema(ctx context.Context, container containerRef, user, pass, db string) (string, error) {
+	call := pgExec(container, pass, false, "pg_dump", "-U", user, "-d", db, "-s", "--no-owner", "--no-privileges")
+	cmd := call.command(ctx)
+	var out bytes.Buffer
+	var errBuf bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v - %s", err, errBuf.String())
+	}
+	return out.String(), nil
 }
 
 func normalizeSchema(s string) string {
-    lines := strings.Split(s, "\n")
-    var kept []string
-    for _, l := range lines {
-        // drop comments and blank lines
-        if strings.HasPrefix(strings.TrimSpace(l), "--") || strings.TrimSpace(l) == "" {
-            continue
-        }
-        // normalize OWNER TO differences
-        if strings.Contains(l, " OWNER TO ") {
-            continue
-        }
-        kept = append(kept, l)
-    }
-    return strings.Join(kept, "\n")
-}
-
-func verifyRowCountsEqual(srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, db string) error {
-    tables, err := listUserTables(srcContainer, srcUser, srcPass, db)
-    if err != nil {
-        return fmt.Errorf("listing tables failed: %w", err)
-    }
-    if len(tables) == 0 {
-        return nil
-    }
-    srcCounts, err := fetchRowCounts(srcContainer, srcUser, srcPass, db, tables)
-    if err != nil {
-        return fmt.Errorf("source counts failed: %w", err)
-    }
-    dstCounts, err := fetchRowCounts(dstContainer, dstUser, dstPass, db, tables)
-    if err != nil {
-        return fmt.Errorf("destination counts failed: %w", err)
-    }
-    var diffs []string
-    for _, t := range tables {
-        key := t[0] + "." + t[1]
-        if srcCounts[key] != dstCounts[key] {
-            diffs = append(diffs, fmt.Sprintf("%s: src=%d dst=%d", key, srcCounts[key], dstCounts[key]))
-        }
-    }
-    if len(diffs) > 0 {
-        return fmt.Errorf("row count differences detected:\n%s", strings.Join(diffs, "\n"))
-    }
-    return nil
-}
-
-func listUserTables(container, user, pass, db string) ([][2]string, error) {
-    sql := `SELECT table_schema, table_name
-FROM information_schema.tables
-WHERE table_type='BASE TABLE'
-  AND table_schema NOT IN ('pg_catalog','information_schema')
-ORDER BY table_schema, table_name;`
-    out, err := runPsql(container, user, pass, db, sql)
-    if err != nil {
-        return nil, err
-    }
-    var tables [][2]string
-    scanner := bufio.NewScanner(strings.NewReader(out))
-    for scanner.Scan() {
-        line := scanner.Text()
-        if strings.TrimSpace(line) == "" {
-            continue
-        }
-        parts := strings.Split(line, ",")
-        if len(parts) != 2 {
-            continue
-        }
-        schema := parts[0]
-        name := parts[1]
-        tables = append(tables, [2]string{schema, name})
-    }
-    return tables, nil
-}
-
-func fetchRowCounts(container, user, pass, db string, tables [][2]string) (map[string]int64, error) {
-    // Build a single UNION ALL query for performance
-    var sb strings.Builder
-    for i, t := range tables {
-        if i > 0 {
-            sb.WriteString(" UNION ALL ")
-        }
-        // SELECT 'schema.table', COUNT(*) FROM schema.table
-        tbl := fmt.Sprintf("%s.%s", pqQuoteIdent(t[0]), pqQuoteIdent(t[1]))
-        label := fmt.Sprintf("%s.%s", t[0], t[1])
-        sb.WriteString(fmt.Sprintf("SELECT '%s', COUNT(*)::bigint FROM %s", label, tbl))
-    }
-    sb.WriteString(" ORDER BY 1;")
-    out, err := runPsql(container, user, pass, db, sb.String())
-    if err != nil {
-        return nil, err
-    }
-    counts := map[string]int64{}
-    scanner := bufio.NewScanner(strings.NewReader(out))
-    for scanner.Scan() {
-        line := scanner.Text()
-        parts := strings.Split(line, ",")
-        if len(parts) != 2 {
-            continue
-        }
-        key := parts[0]
-        valStr := parts[1]
-        n, _ := strconv.ParseInt(strings.TrimSpace(valStr), 10, 64)
-        counts[key] = n
-    }
-    return counts, nil
-}
-
-func runPsql(container, user, pass, db, sql string) (string, error) {
-    args := []string{"exec", "-e", "PGPASSWORD=" + pass, container, "psql", "-U", user, "-d", db, "-t", "-A", "-F", ",", "-c", sql}
-    cmd := exec.Command("docker", args...)
-    var out bytes.Buffer
-    var errBuf bytes.Buffer
-    cmd.Stdout = &out
-    cmd.Stderr = &errBuf
-    if err := cmd.Run(); err != nil {
-        return "", fmt.Errorf("%v - %s", err, errBuf.String())
-    }
-    return out.String(), nil
+	lines := strings.Split(s, "\n")
+	var kept []string
+	for _, l := range lines {
+		// drop comments and blank lines
+		if strings.HasPrefix(strings.TrimSpace(l), "--") || strings.TrimSpace(l) == "" {
+			continue
+		}
+		// normalize OWNER TO differences
+		if strings.Contains(l, " OWNER TO ") {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	return strings.Join(kept, "\n")
+}
+
+func verifyRowCountsEqual(ctx context.Context, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, db string, opts countOptions) error {
+	tables, err := listUserTables(ctx, srcContainer, srcUser, srcPass, db)
+	if err != nil {
+		return fmt.Errorf("listing tables failed: %w", err)
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	if opts.Estimate {
+		return verifyRowEstimatesEqual(ctx, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, db, tables)
+	}
+	logf("Counting rows in %d tables (%d parallel per container)...\n", len(tables), opts.Workers)
+	srcCounts, srcFailed := fetchRowCounts(ctx, srcContainer, srcUser, srcPass, db, tables, opts)
+	dstCounts, dstFailed := fetchRowCounts(ctx, dstContainer, dstUser, dstPass, db, tables, opts)
+	var diffs []string
+	for _, t := range tables {
+		if err := srcFailed[t]; err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: source count failed: %v", tableName(t), err))
+			continue
+		}
+		if err := dstFailed[t]; err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: destination count failed: %v", tableName(t), err))
+			continue
+		}
+		if srcCounts[t] != dstCounts[t] {
+			diffs = append(diffs, fmt.Sprintf("%s: src=%d dst=%d", tableName(t), srcCounts[t], dstCounts[t]))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("row count differences detected:\n%s", strings.Join(diffs, "\n"))
+	}
+	return nil
+}
+
+// verifyRowEstimatesEqual compares planner row estimates, which is fast even on
+// very large tables but only detects gross differences.
+func verifyRowEstimatesEqual(ctx context.Context, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, db string, tables [][2]string) error {
+	srcEst, err := fetchRowEstimates(ctx, srcContainer, srcUser, srcPass, db)
+	if err != nil {
+		return fmt.Errorf("source estimates failed: %w", err)
+	}
+	dstEst, err := fetchRowEstimates(ctx, dstContainer, dstUser, dstPass, db)
+	if err != nil {
+		return fmt.Errorf("destination estimates failed: %w", err)
+	}
+	var diffs []string
+	for _, t := range tables {
+		s, d := srcEst[t], dstEst[t]
+		limit := float64(max(s, d)) * estimateTolerance
+		if float64(abs64(s-d)) > limit {
+			diffs = append(diffs, fmt.Sprintf("%s: src~%d dst~%d", tableName(t), s, d))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("row estimate differences above %.0f%% detected:\n%s", estimateTolerance*100, strings.Join(diffs, "\n"))
+	}
+	return nil
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// tableName returns the quoted, schema-qualified name of a table for messages
+// and queries.
+func tableName(t [2]string) string {
+	return pqQuoteIdent(t[0]) + "." + pqQuoteIdent(t[1])
+}
+
+func listUserTables(ctx context.Context, container containerRef, user, pass, db string) ([][2]string, error) {
+	// Only plain tables (relkind 'r'): partitioned parents ('p') hold no rows
+	// themselves, their leaf partitions are counted individually
+	sql := `SELECT n.nspname AS schema, c.relname AS name
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r'
+  AND n.nspname NOT IN ('pg_catalog','information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+ORDER BY 1, 2`
+	var rows []struct {
+		Schema string `json:"schema"`
+		Name   string `json:"name"`
+	}
+	if err := queryJSON(ctx, container, user, pass, db, sql, &rows); err != nil {
+		return nil, err
+	}
+	var tables [][2]string
+	for _, r := range rows {
+		tables = append(tables, [2]string{r.Schema, r.Name})
+	}
+	return tables, nil
+}
+
+// fetchRowCounts runs one COUNT(*) per table, at most opts.Workers at a time.
+// Tables whose count fails (e.g. by hitting opts.TableTimeout) are returned
+// in the second map instead of aborting the whole run.
+func fetchRowCounts(ctx context.Context, container containerRef, user, pass, db string, tables [][2]string, opts countOptions) (map[[2]string]int64, map[[2]string]error) {
+	counts := map[[2]string]int64{}
+	failed := map[[2]string]error{}
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for _, t := range tables {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			sql := "SELECT COUNT(*)::bigint AS n FROM " + tableName(t)
+			var rows []struct {
+				N int64 `json:"n"`
+			}
+			err := queryJSONWithTimeout(ctx, container, user, pass, db, sql, opts.TableTimeout, &rows)
+			if err == nil && len(rows) != 1 {
+				err = fmt.Errorf("unexpected result with %d rows", len(rows))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[t] = err
+				return
+			}
+			counts[t] = rows[0].N
+		}()
+	}
+	wg.Wait()
+	return counts, failed
+}
+
+// fetchRowEstimates runs ANALYZE and returns pg_class.reltuples per table.
+func fetchRowEstimates(ctx context.Context, container containerRef, user, pass, db string) (map[[2]string]int64, error) {
+	logf("Running ANALYZE on container '%s'...\n", container)
+	if _, err := runPsql(ctx, container, user, pass, db, "ANALYZE;"); err != nil {
+		return nil, err
+	}
+	sql := `SELECT n.nspname AS schema, c.relname AS name, GREATEST(c.reltuples, 0)::bigint AS estimate
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r'
+  AND n.nspname NOT IN ('pg_catalog','information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'`
+	var rows []struct {
+		Schema   string `json:"schema"`
+		Name     string `json:"name"`
+		Estimate int64  `json:"estimate"`
+	}
+	if err := queryJSON(ctx, container, user, pass, db, sql, &rows); err != nil {
+		return nil, err
+	}
+	estimates := map[[2]string]int64{}
+	for _, r := range rows {
+		estimates[[2]string{r.Schema, r.Name}] = r.Estimate
+	}
+	return estimates, nil
+}
+
+// runPsql executes sql and returns psql's unaligned, tuples-only output.
+// Use queryJSON when the result needs to be parsed.
+func runPsql(ctx context.Context, container containerRef, user, pass, db, sql string) (string, error) {
+	return runPsqlWithTimeout(ctx, container, user, pass, db, sql, 0)
+}
+
+// runPsqlWithTimeout is runPsql with a server-side statement_timeout (0 = none).
+func runPsqlWithTimeout(ctx context.Context, container containerRef, user, pass, db, sql string, timeout time.Duration) (string, error) {
+	var env []string
+	if timeout > 0 {
+		env = append(env, fmt.Sprintf("PGOPTIONS=-c statement_timeout=%d", timeout.Milliseconds()))
+	}
+	cmd := pgExecEnv(container, pass, env, false, "psql", "-X", "-U", user, "-d", db, "-t", "-A", "-c", sql).command(ctx)
+	var out bytes.Buffer
+	var errBuf bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v - %s", err, errBuf.String())
+	}
+	return out.String(), nil
+}
+
+// queryJSON runs a SELECT and decodes its rows into dest (a pointer to a slice
+// of structs tagged with the column names). The server aggregates the result
+// with json_agg, so names containing commas or newlines survive intact.
+func queryJSON(ctx context.Context, container containerRef, user, pass, db, sql string, dest any) error {
+	return queryJSONWithTimeout(ctx, container, user, pass, db, sql, 0, dest)
+}
+
+func queryJSONWithTimeout(ctx context.Context, container containerRef, user, pass, db, sql string, timeout time.Duration, dest any) error {
+	query := fmt.Sprintf("SELECT COALESCE(json_agg(q), '[]'::json) FROM (%s) q", strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	out, err := runPsqlWithTimeout(ctx, container, user, pass, db, query, timeout)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(out)), dest); err != nil {
+		return fmt.Errorf("decoding psql result failed: %w", err)
+	}
+	return nil
 }
 
 func pqQuoteIdent(ident string) string {
-    // double quote and escape quotes
-    return "\"" + strings.ReplaceAll(ident, "\"", "\"\"") + "\""
+	// double quote and escape quotes
+	return "\"" + strings.ReplaceAll(ident, "\"", "\"\"") + "\""
+}
+
+func pqQuoteLiteral(s string) string {
+	// single quote and escape quotes
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDocker puts a shell script named docker first in PATH. The script finds
+// its directory in $FAKE_DOCKER_DIR; the arguments of the last call are
+// recorded NUL-separated in its file "args".
+func fakeDocker(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake docker is a shell script")
+	}
+	dir := t.TempDir()
+	body := "#!/bin/sh\nfor a; do printf '%s\\0' \"$a\"; done > \"$FAKE_DOCKER_DIR/args\"\n" + script
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_DOCKER_DIR", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+// fakeDockerArgs returns the arguments of the last call of the fake docker.
+func fakeDockerArgs(t *testing.T, dir string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+func TestReadCountOptions(t *testing.T) {
+	def := defaultCountOptions()
+	tests := []struct {
+		name  string
+		input string
+		want  countOptions
+	}{
+		{"defaults", "\n\n", def},
+		{"both set", "8\n10m\n", countOptions{Workers: 8, TableTimeout: 10 * time.Minute}},
+		{"no timeout", "2\n0\n", countOptions{Workers: 2}},
+		{"invalid workers", "zero\n1h\n", countOptions{Workers: def.Workers, TableTimeout: time.Hour}},
+		{"workers must be positive", "0\n\n", def},
+		{"negative timeout", "\n-5s\n", def},
+		{"invalid timeout", "3\nsoon\n", countOptions{Workers: 3, TableTimeout: def.TableTimeout}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := readCountOptions(bufio.NewReader(strings.NewReader(tt.input)), def)
+			if got != tt.want {
+				t.Errorf("readCountOptions(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryJSON(t *testing.T) {
+	dir := fakeDocker(t, `cat "$FAKE_DOCKER_DIR/out"`)
+	type table struct {
+		Schema string `json:"schema"`
+		Name   string `json:"name"`
+	}
+	tests := []struct {
+		name      string
+		out       string
+		timeout   time.Duration
+		want      []table
+		wantQuery string
+		wantErr   string
+	}{
+		{
+			name:      "names with separators",
+			out:       `[{"schema":"sales, eu","name":"line\nbreak"},{"schema":"public","name":"a|b"}]` + "\n",
+			want:      []table{{"sales, eu", "line\nbreak"}, {"public", "a|b"}},
+			wantQuery: "SELECT COALESCE(json_agg(q), '[]'::json) FROM (SELECT schema, name FROM t) q",
+		},
+		{
+			name:      "no rows",
+			out:       "[]\n",
+			timeout:   1500 * time.Millisecond,
+			want:      []table{},
+			wantQuery: "SELECT COALESCE(json_agg(q), '[]'::json) FROM (SELECT schema, name FROM t) q",
+		},
+		{
+			name:    "not JSON",
+			out:     "sales,orders\n",
+			wantErr: "decoding psql result failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dir, "out"), []byte(tt.out), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rows := []table{}
+			err := queryJSONWithTimeout(context.Background(), onEngine("pg", dockerEngine{}), "postgres", "secret", "app", "SELECT schema, name FROM t;\n", tt.timeout, &rows)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(rows, tt.want) {
+				t.Errorf("rows = %q, want %q", rows, tt.want)
+			}
+			args := fakeDockerArgs(t, dir)
+			if got := args[len(args)-1]; got != tt.wantQuery {
+				t.Errorf("query = %q, want %q", got, tt.wantQuery)
+			}
+			hasTimeout := slices.Contains(args, "PGOPTIONS=-c statement_timeout=1500")
+			if hasTimeout != (tt.timeout > 0) {
+				t.Errorf("statement_timeout in %q: %v, want %v", args, hasTimeout, tt.timeout > 0)
+			}
+		})
+	}
+}
+
+func TestStreamGlobals(t *testing.T) {
+	dir := fakeDocker(t, `case "$*" in
+*pg_dumpall*) printf 'CREATE ROLE app;\nALTER ROLE app WITH NOSUPERUSER LOGIN;\nALTER ROLE postgres WITH SUPERUSER PASSWORD \047secret\047;\n' ;;
+*psql*) cat > "$FAKE_DOCKER_DIR/restored"; echo "ERROR:  must be superuser to alter superuser roles or change superuser attribute" >&2 ;;
+esac`)
+	var warnings []string
+	warningObserver = func(line string) { warnings = append(warnings, line) }
+	defer func() { warningObserver = nil }()
+
+	if err := streamGlobals(context.Background(), containerRef{Name: "old"}, "postgres", "a", containerRef{Name: "new"}, "postgres", "b", map[string]string{"app": "app_v2"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "restored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DO $pgupgrade$BEGIN CREATE ROLE \"app_v2\"; EXCEPTION WHEN duplicate_object THEN NULL; END$pgupgrade$;\n" +
+		"ALTER ROLE \"app_v2\" WITH NOSUPERUSER LOGIN;\n"
+	if string(data) != want {
+		t.Errorf("restored %q, want %q", data, want)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "must be superuser") {
+		t.Errorf("warnings = %q, want the psql error", warnings)
+	}
+}
+
+func TestFetchRowCounts(t *testing.T) {
+	fakeDocker(t, `case "$*" in
+*'"a.b"."c"'*) echo '[{"n":1}]' ;;
+*'"a"."b.c"'*) echo '[{"n":2}]' ;;
+*) echo "relation does not exist" >&2; exit 1 ;;
+esac`)
+	tables := [][2]string{{"a.b", "c"}, {"a", "b.c"}, {"a", "missing"}}
+	counts, failed := fetchRowCounts(context.Background(), containerRef{Name: "pg"}, "postgres", "secret", "app", tables, countOptions{Workers: 2})
+	if counts[tables[0]] != 1 || counts[tables[1]] != 2 || len(counts) != 2 {
+		t.Errorf("counts = %v, want 1 and 2 for the tables with dots", counts)
+	}
+	if len(failed) != 1 || failed[tables[2]] == nil {
+		t.Errorf("failed = %v, want only %s", failed, tableName(tables[2]))
+	}
+}
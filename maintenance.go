@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ===== Maintenance mode =====
+
+// Maintenance modes keep applications from changing the source database
+// while it is dumped, so the destination does not start out stale.
+const (
+	// maintenanceReadOnly lets applications connect but makes every new
+	// transaction read-only.
+	maintenanceReadOnly = "read_only"
+	// maintenanceBlock refuses new connections of all non-superusers.
+	// ALLOW_CONNECTIONS false would also refuse pg_dump, so the connection
+	// limit is set to 0 instead, which superusers bypass.
+	maintenanceBlock = "block"
+)
+
+// defaultDrainGrace is how long sessions may finish before they are terminated.
+const defaultDrainGrace = 30 * time.Second
+
+// maintenance is an active maintenance mode on one source database, with the
+// settings it replaced.
+type maintenance struct {
+	container            containerRef
+	user, pass, db, mode string
+
+	connLimit int    // previous datconnlimit
+	readOnly  string // previous default_transaction_read_only of the database, "" if unset
+	release   func()
+}
+
+// parseMaintenanceMode accepts none, read_only and block.
+func parseMaintenanceMode(s string) (string, error) {
+	switch s {
+	case "", "none":
+		return "", nil
+	case maintenanceReadOnly, maintenanceBlock:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown maintenance mode %q (none, read_only, block)", s)
+}
+
+// enterMaintenance puts db into mode, waits up to grace for the other client
+// sessions to end and terminates the rest. The previous settings come back
+// with lift, or on Ctrl-C.
+func enterMaintenance(ctx context.Context, container containerRef, user, pass, db, mode string, grace time.Duration) (*maintenance, error) {
+	var rows []struct {
+		ConnLimit int    `json:"conn_limit"`
+		ReadOnly  string `json:"read_only"`
+		Super     bool   `json:"super"`
+	}
+	sql := fmt.Sprintf(`SELECT d.datconnlimit AS conn_limit,
+       COALESCE((SELECT substr(c, length('default_transaction_read_only=') + 1)
+                 FROM pg_db_role_setting s, unnest(s.setconfig) c
+                 WHERE s.setdatabase = d.oid AND s.setrole = 0 AND c LIKE 'default_transaction_read_only=%%'), '') AS read_only,
+       (SELECT rolsuper FROM pg_roles WHERE rolname = current_user) AS super
+FROM pg_database d WHERE d.datname = %s`, pqQuoteLiteral(db))
+	if err := queryJSON(ctx, container, user, pass, "postgres", sql, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("database '%s' not found", db)
+	}
+	if mode == maintenanceBlock && !rows[0].Super {
+		return nil, fmt.Errorf("mode block needs a superuser, '%s' would lock itself out", user)
+	}
+	m := &maintenance{container: container, user: user, pass: pass, db: db, mode: mode,
+		connLimit: rows[0].ConnLimit, readOnly: rows[0].ReadOnly}
+
+	done := startPhase("maintenance")
+	if mode == maintenanceBlock {
+		logf("Blocking new connections to '%s' on '%s'...\n", db, container)
+		sql = fmt.Sprintf("ALTER DATABASE %s CONNECTION LIMIT 0;", pqQuoteIdent(db))
+	} else {
+		logf("Making '%s' on '%s' read-only...\n", db, container)
+		sql = fmt.Sprintf("ALTER DATABASE %s SET default_transaction_read_only = on;", pqQuoteIdent(db))
+	}
+	if err := runPsqlInput(ctx, container, user, pass, "postgres", sql); err != nil {
+		done(err)
+		return nil, err
+	}
+	m.release = onInterrupt(fmt.Sprintf("end maintenance mode of '%s'", db), func(ctx context.Context) {
+		m.restore(ctx)
+	})
+	err := drainSessions(ctx, container, user, pass, db, grace)
+	done(err)
+	if err != nil {
+		m.lift(context.WithoutCancel(ctx))
+		return nil, err
+	}
+	return m, nil
+}
+
+// lift restores the settings replaced by enterMaintenance.
+func (m *maintenance) lift(ctx context.Context) {
+	m.release()
+	m.restore(ctx)
+}
+
+func (m *maintenance) restore(ctx context.Context) {
+	var sql string
+	switch {
+	case m.mode == maintenanceBlock:
+		sql = fmt.Sprintf("ALTER DATABASE %s CONNECTION LIMIT %d;", pqQuoteIdent(m.db), m.connLimit)
+	case m.readOnly != "":
+		sql = fmt.Sprintf("ALTER DATABASE %s SET default_transaction_read_only = %s;", pqQuoteIdent(m.db), pqQuoteLiteral(m.readOnly))
+	default:
+		sql = fmt.Sprintf("ALTER DATABASE %s RESET default_transaction_read_only;", pqQuoteIdent(m.db))
+	}
+	if err := runPsqlInput(ctx, m.container, m.user, m.pass, "postgres", sql); err != nil {
+		logf("Ending maintenance mode of '%s' failed; run '%s' manually: %v\n", m.db, sql, err)
+		return
+	}
+	logf("Maintenance mode of '%s' on '%s' ended.\n", m.db, m.container)
+}
+
+// drainSessions waits up to grace for the client sessions on db (other than
+// the tool's own) to end and then terminates the remaining ones.
+func drainSessions(ctx context.Context, container containerRef, user, pass, db string, grace time.Duration) error {
+	sql := fmt.Sprintf(`SELECT count(*) AS n FROM pg_stat_activity
+WHERE datname = %s AND backend_type = 'client backend' AND pid <> pg_backend_pid() AND application_name <> '%s'`,
+		pqQuoteLiteral(db), sessionAppName)
+	deadline := time.Now().Add(grace)
+	for {
+		var rows []struct {
+			N int `json:"n"`
+		}
+		if err := queryJSON(ctx, container, user, pass, "postgres", sql, &rows); err != nil {
+			return err
+		}
+		if len(rows) != 1 || rows[0].N == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			logf("Terminating %d remaining session(s) on '%s'...\n", rows[0].N, db)
+			return terminateClients(ctx, container, user, pass, db)
+		}
+		logf("Waiting for %d session(s) on '%s' to finish (%s left)...\n", rows[0].N, db, time.Until(deadline).Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(5*time.Second, time.Until(deadline))):
+		}
+	}
+}
+
+// terminateClients ends the client sessions on db except the tool's own.
+// Sessions opened before a maintenance setting took effect are not affected
+// by it otherwise.
+func terminateClients(ctx context.Context, container containerRef, user, pass, db string) error {
+	sql := fmt.Sprintf(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+WHERE datname = %s AND backend_type = 'client backend' AND pid <> pg_backend_pid() AND application_name <> '%s';`,
+		pqQuoteLiteral(db), sessionAppName)
+	return runPsqlInput(ctx, container, user, pass, "postgres", sql)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"none", "", false},
+		{"read_only", maintenanceReadOnly, false},
+		{"block", maintenanceBlock, false},
+		{"readonly", "", true},
+		{"Block", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseMaintenanceMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseMaintenanceMode(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMaintenanceRestore(t *testing.T) {
+	dir := fakeDocker(t, `cat > "$FAKE_DOCKER_DIR/stdin"`)
+	tests := []struct {
+		name string
+		m    maintenance
+		want string
+	}{
+		{
+			name: "block",
+			m:    maintenance{mode: maintenanceBlock, connLimit: -1},
+			want: `ALTER DATABASE "my app" CONNECTION LIMIT -1;`,
+		},
+		{
+			name: "read-only with a previous setting",
+			m:    maintenance{mode: maintenanceReadOnly, readOnly: "off"},
+			want: `ALTER DATABASE "my app" SET default_transaction_read_only = 'off';`,
+		},
+		{
+			name: "read-only without a previous setting",
+			m:    maintenance{mode: maintenanceReadOnly},
+			want: `ALTER DATABASE "my app" RESET default_transaction_read_only;`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			m.container, m.user, m.pass, m.db = onEngine("old", dockerEngine{}), "postgres", "pw", "my app"
+			m.restore(context.Background())
+			got, err := os.ReadFile(filepath.Join(dir, "stdin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("restore ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ===== Migration run =====
+
+// migrationPlan holds every answer needed to run a migration without
+// prompting. It is stored in the state file (without passwords) so that
+// "resume" can continue an interrupted run.
+type migrationPlan struct {
+	SrcContainer      containerRef      `json:"src_container"`
+	SrcUser           string            `json:"src_user"`
+	SrcPassword       string            `json:"-"`
+	DstContainer      containerRef      `json:"dst_container"`
+	DstUser           string            `json:"dst_user"`
+	DstPassword       string            `json:"-"`
+	Databases         []string          `json:"databases"`
+	Stream            bool              `json:"stream"`
+	MigrateGlobals    bool              `json:"migrate_globals"`
+	PreserveOwnership bool              `json:"preserve_ownership"`
+	RoleMap           map[string]string `json:"role_map,omitempty"`
+	VerifyMode        string            `json:"verify_mode"`
+	CountOptions      countOptions      `json:"count_options"`
+	SmokeFile         string            `json:"smoke_file,omitempty"`
+	BackupDir         string            `json:"backup_dir,omitempty"` // keep a custom-format archive per database
+	Retention         retentionPolicy   `json:"retention"`
+	BackupUpload      string            `json:"backup_upload,omitempty"`   // s3://bucket/prefix for copies of the archives
+	Compression       compression       `json:"compression"`               // dump files and stream
+	StopContainers    []string          `json:"stop_containers,omitempty"` // application containers on the source engine stopped during the run
+	Maintenance       string            `json:"maintenance,omitempty"`     // "read_only" or "block" while a database is migrated
+	DrainGrace        time.Duration     `json:"drain_grace,omitempty"`     // wait before terminating other sessions
+	Compose           *composeService   `json:"compose,omitempty"`         // service that takes over the destination's volume
+	Hooks             hookSet           `json:"hooks,omitempty"`           // commands run at migration events
+}
+
+// verifies reports whether the plan includes a verification step.
+func (p *migrationPlan) verifies() bool {
+	return p.VerifyMode != "none" || p.SmokeFile != ""
+}
+
+// runMigration executes plan, skipping every phase state already records as
+// completed and recording each phase as it finishes.
+func runMigration(ctx context.Context, plan *migrationPlan, state *runState) (err error) {
+	defer func() {
+		// After Ctrl-C the process exits from the interrupt handler
+		if err != nil && ctx.Err() == nil {
+			env := planHookEnv(plan, state)
+			env.Outcome, env.Error = "failure", err.Error()
+			runHooks(ctx, plan.Hooks, hookOnFailure, env)
+		}
+	}()
+	if err := runHooks(ctx, plan.Hooks, hookPreCheck, planHookEnv(plan, state)); err != nil {
+		failf(errHook, "%v\n", err)
+		return err
+	}
+	if len(plan.StopContainers) > 0 {
+		done := startPhase("stop_apps")
+		start, err := stopApplications(ctx, plan.SrcContainer.Engine, plan.StopContainers)
+		done(err)
+		if err != nil {
+			failf(errStopApps, "Error stopping application containers: %v\n", err)
+			return err
+		}
+		defer start(context.WithoutCancel(ctx))
+	}
+	if plan.MigrateGlobals {
+		if state.done("", "globals") {
+			logf("Global objects already migrated; skipping.\n")
+		} else {
+			done := startPhase("globals")
+			err := streamGlobals(ctx, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, plan.DstContainer, plan.DstUser, plan.DstPassword, plan.RoleMap)
+			done(err)
+			if err != nil {
+				failf(errGlobals, "Error migrating global objects: %v\n", err)
+				return err
+			}
+			state.complete("", "globals", phaseRecord{})
+		}
+	}
+
+	var unverified []string
+	for i, db := range plan.Databases {
+		logf("=== Database '%s' (%d of %d) ===\n", db, i+1, len(plan.Databases))
+		if state.done(db, "restore") && (!plan.verifies() || state.done(db, "verify")) {
+			logf("Database '%s' is already migrated; skipping.\n", db)
+			continue
+		}
+		verified, err := migrateAndVerify(ctx, plan, state, db)
+		if err != nil {
+			return err
+		}
+		if !verified {
+			unverified = append(unverified, db)
+		}
+	}
+	logf("Database migration completed successfully.\n")
+	if len(unverified) > 0 {
+		return fmt.Errorf("verification failed for: %s", strings.Join(unverified, ", "))
+	}
+	// The applications are started again only after the service switched
+	if plan.Compose != nil && !state.done("", "compose_switch") {
+		if err := switchComposeService(ctx, plan, state); err != nil {
+			return err
+		}
+	}
+	env := planHookEnv(plan, state)
+	env.Outcome = "success"
+	runHooks(ctx, plan.Hooks, hookPostCutover, env)
+	return nil
+}
+
+// switchComposeService recreates the compose service of the source on the
+// volume of the migrated destination.
+func switchComposeService(ctx context.Context, plan *migrationPlan, state *runState) error {
+	s := plan.Compose
+	done := startPhase("compose_switch")
+	container, err := s.switchTo(ctx, plan.DstContainer, plan.SrcUser, plan.SrcPassword, plan.Databases[0])
+	done(err)
+	if err != nil {
+		failf(errCompose, "Switching service '%s' to the new data failed: %v\n"+
+			"The original volume is unchanged; without '%s' in the compose files, 'docker compose up -d %s' brings back the previous setup.\n",
+			s.Service, err, composeOverrideFile, s.Service)
+		return err
+	}
+	state.complete("", "compose_switch", phaseRecord{})
+	logf("Service '%s' now runs '%s' as '%s'. The old data volume is kept untouched.\n", s.Service, s.NewImage, container.Name)
+	logf("Include '%s' in future compose commands, e.g.:\n  %s\n", s.overridePath(), s.composeUsage())
+	return nil
+}
+
+// migrateAndVerify runs the backup, migration and verification phases of one
+// database, with the source in maintenance mode if the plan asks for it. It
+// reports whether the verification passed.
+func migrateAndVerify(ctx context.Context, plan *migrationPlan, state *runState, db string) (bool, error) {
+	env := planHookEnv(plan, state)
+	env.Database = db
+	if !state.done(db, "restore") {
+		if err := runHooks(ctx, plan.Hooks, hookPreDump, env); err != nil {
+			failf(errHook, "%v\n", err)
+			return false, err
+		}
+	}
+	if plan.Maintenance != "" {
+		m, err := enterMaintenance(ctx, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, db, plan.Maintenance, plan.DrainGrace)
+		if err != nil {
+			failf(errMaintenance, "Error entering maintenance mode: %v\n", err)
+			return false, err
+		}
+		defer m.lift(context.WithoutCancel(ctx))
+	}
+	if plan.BackupDir != "" && !state.done(db, "backup") {
+		done := startPhase("backup")
+		m, err := createBackup(ctx, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, db, plan.BackupDir, plan.Compression)
+		if err == nil && plan.BackupUpload != "" {
+			err = uploadBackup(ctx, plan.BackupDir, m, plan.BackupUpload)
+		}
+		if err == nil {
+			err = applyRetention(plan.BackupDir, plan.SrcContainer, db, plan.Retention)
+		}
+		done(err)
+		if err != nil {
+			failf(errBackup, "Error creating the backup archive: %v\n", err)
+			return false, err
+		}
+		state.complete(db, "backup", phaseRecord{Checksum: m.SHA256, Bytes: m.Size})
+	}
+	if !state.done(db, "restore") {
+		if err := migrateDatabase(ctx, plan, state, db); err != nil {
+			return false, err
+		}
+		env.Outcome = "success"
+		runHooks(ctx, plan.Hooks, hookPostRestore, env)
+	}
+	if !plan.verifies() {
+		return true, nil
+	}
+	done := startPhase("verify")
+	results := runVerification(ctx, plan.VerifyMode, plan.CountOptions, plan.SmokeFile, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, plan.DstContainer, plan.DstUser, plan.DstPassword, db)
+	if !printVerificationSummary(results) {
+		done(fmt.Errorf("verification failed"))
+		env.Outcome = "verification_failed"
+		runHooks(ctx, plan.Hooks, hookPostVerify, env)
+		return false, nil
+	}
+	done(nil)
+	state.complete(db, "verify", phaseRecord{})
+	env.Outcome = "success"
+	runHooks(ctx, plan.Hooks, hookPostVerify, env)
+	return true, nil
+}
+
+// migrateDatabase copies one database, by streaming or via a dump file.
+func migrateDatabase(ctx context.Context, plan *migrationPlan, state *runState, db string) error {
+	if err := ensureDatabase(ctx, plan.DstContainer, plan.DstUser, plan.DstPassword, db); err != nil {
+		failf(errRestore, "Error creating database '%s' on the new container: %v\n", db, err)
+		return err
+	}
+	if plan.PreserveOwnership {
+		done := startPhase("role_check")
+		err := checkRolesExist(ctx, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, plan.DstContainer, plan.DstUser, plan.DstPassword, db, plan.RoleMap)
+		done(err)
+		if err != nil {
+			failf(errRoleCheck, "Role pre-check failed: %v\n", err)
+			return err
+		}
+	}
+	if plan.Stream {
+		releasePartial := warnPartialRestore(plan.DstContainer, db)
+		done := startPhase("dump_restore")
+		sum, n, err := streamDumpRestore(ctx, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, plan.DstContainer, plan.DstUser, plan.DstPassword, db, plan.PreserveOwnership, plan.RoleMap, plan.Compression)
+		done(err)
+		if err != nil {
+			failf(errMigration, "Error migrating database: %v\n", err)
+			return err
+		}
+		releasePartial()
+		rec := phaseRecord{Checksum: sum, Bytes: n}
+		state.complete(db, "dump", rec)
+		state.complete(db, "restore", rec)
+		return nil
+	}
+	return migrateDatabaseFile(ctx, plan, state, db)
+}
+
+// migrateDatabaseFile is the file-based fallback: a plain SQL dump streamed
+// into a file on the host, then fed from there into the destination.
+func migrateDatabaseFile(ctx context.Context, plan *migrationPlan, state *runState, db string) error {
+	localDumpPath := "./" + plainDumpName(db, plan.Compression)
+
+	// A completed dump is reused only if the local file is unchanged
+	dumpRec, dumpDone := state.record(db, "dump")
+	if dumpDone {
+		if sum, err := fileSHA256(localDumpPath); err != nil || sum != dumpRec.Checksum {
+			logf("Local dump file '%s' is missing or changed; dumping again.\n", localDumpPath)
+			dumpDone = false
+			state.invalidate(db, "dump")
+		} else {
+			logf("Reusing dump file '%s' (sha256 %s).\n", localDumpPath, sum[:12])
+		}
+	}
+	if !dumpDone {
+		logf("Dumping database '%s' from the original container '%s' to '%s'...\n", db, plan.SrcContainer, localDumpPath)
+		done := startPhase("dump")
+		// --clean makes a repeated restore (after resume) replace what is already there
+		size, sum, err := dumpToFile(ctx, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, db, localDumpPath, plan.Compression, "-Fp", "--clean", "--if-exists")
+		done(err)
+		if err != nil {
+			failf(errDump, "Failed to dump the database: %v\n", err)
+			return err
+		}
+		reportBytes("dump", size)
+		state.complete(db, "dump", phaseRecord{Checksum: sum, Bytes: size})
+	}
+
+	// Restore the dump into the new database
+	logf("Restoring the dump file into the new database on container '%s'...\n", plan.DstContainer)
+	releasePartial := warnPartialRestore(plan.DstContainer, db)
+	done := startPhase("restore")
+	_, err := restoreFromFile(ctx, plan.DstContainer, plan.DstUser, plan.DstPassword, db, localDumpPath, formatPlain)
+	done(err)
+	if err != nil {
+		failf(errRestore, "Error restoring the database: %v\n", err)
+		return err
+	}
+	releasePartial()
+	rec, _ := state.record(db, "dump")
+	state.complete(db, "restore", rec)
+
+	// Cleanup: delete the dump file from the script directory
+	logf("Cleaning up...\n")
+	done = startPhase("cleanup")
+	os.Remove(localDumpPath)
+	done(nil)
+	return nil
+}
+
+// ensureDatabase creates db on the destination if it does not exist yet.
+func ensureDatabase(ctx context.Context, container containerRef, user, pass, db string) error {
+	var rows []struct {
+		Exists bool `json:"exists"`
+	}
+	sql := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = %s) AS exists", pqQuoteLiteral(db))
+	if err := queryJSON(ctx, container, user, pass, "postgres", sql, &rows); err != nil {
+		return err
+	}
+	if len(rows) == 1 && rows[0].Exists {
+		return nil
+	}
+	logf("Creating database '%s' on container '%s'...\n", db, container)
+	_, err := runPsql(ctx, container, user, pass, "postgres", "CREATE DATABASE "+pqQuoteIdent(db))
+	return err
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// splitList splits a comma separated answer into its non-empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
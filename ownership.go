@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ===== Ownership / privilege preservation =====
+
+// parseRoleMap parses a role rename mapping of the form "old=new,old2=new2".
+// An empty string yields an empty mapping.
+func parseRoleMap(s string) (map[string]string, error) {
+	roleMap := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid role mapping %q (expected old=new)", pair)
+		}
+		oldRole := strings.TrimSpace(kv[0])
+		if _, dup := roleMap[oldRole]; dup {
+			return nil, fmt.Errorf("role %q is mapped more than once", oldRole)
+		}
+		roleMap[oldRole] = strings.TrimSpace(kv[1])
+	}
+	return roleMap, nil
+}
+
+// mapRole returns the destination name of a source role.
+func mapRole(roleMap map[string]string, role string) string {
+	if mapped, ok := roleMap[role]; ok {
+		return mapped
+	}
+	return role
+}
+
+// referencedRoles lists every role the dump can name in a role position: the
+// owners of objects in the database, the grantees in their ACLs (including
+// default privileges), and the roles of policies and user mappings. These
+// are the roles roleRewriter renames. pg_shdepend covers all object types
+// but leaves out the bootstrap superuser, hence the catalog lookups.
+func referencedRoles(ctx context.Context, container containerRef, user, pass, db string) ([]string, error) {
+	sql := `WITH ns AS (
+  SELECT oid FROM pg_namespace
+  WHERE nspname NOT IN ('pg_catalog','information_schema')
+    AND nspname NOT LIKE 'pg_toast%' AND nspname NOT LIKE 'pg_temp%'
+), refs AS (
+  SELECT datdba AS role FROM pg_database WHERE datname = current_database()
+  UNION SELECT nspowner FROM pg_namespace WHERE oid IN (SELECT oid FROM ns)
+  UNION SELECT (aclexplode(nspacl)).grantee FROM pg_namespace WHERE oid IN (SELECT oid FROM ns) AND nspacl IS NOT NULL
+  UNION SELECT relowner FROM pg_class WHERE relnamespace IN (SELECT oid FROM ns)
+  UNION SELECT (aclexplode(relacl)).grantee FROM pg_class WHERE relnamespace IN (SELECT oid FROM ns) AND relacl IS NOT NULL
+  UNION SELECT proowner FROM pg_proc WHERE pronamespace IN (SELECT oid FROM ns)
+  UNION SELECT (aclexplode(proacl)).grantee FROM pg_proc WHERE pronamespace IN (SELECT oid FROM ns) AND proacl IS NOT NULL
+  UNION SELECT typowner FROM pg_type WHERE typnamespace IN (SELECT oid FROM ns)
+  UNION SELECT defaclrole FROM pg_default_acl
+  UNION SELECT (aclexplode(defaclacl)).grantee FROM pg_default_acl
+  UNION SELECT refobjid FROM pg_shdepend
+  WHERE refclassid = 'pg_authid'::regclass
+    AND dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+)
+SELECT DISTINCT r.rolname AS role FROM refs JOIN pg_roles r ON r.oid = refs.role ORDER BY 1`
+	return queryRoleNames(ctx, container, user, pass, db, sql)
+}
+
+// listRoles returns all role names known to the server.
+func listRoles(ctx context.Context, container containerRef, user, pass, db string) ([]string, error) {
+	return queryRoleNames(ctx, container, user, pass, db, "SELECT rolname AS role FROM pg_roles ORDER BY 1")
+}
+
+func queryRoleNames(ctx context.Context, container containerRef, user, pass, db, sql string) ([]string, error) {
+	var rows []struct {
+		Role string `json:"role"`
+	}
+	if err := queryJSON(ctx, container, user, pass, db, sql, &rows); err != nil {
+		return nil, err
+	}
+	roles := make([]string, 0, len(rows))
+	for _, r := range rows {
+		roles = append(roles, r.Role)
+	}
+	return roles, nil
+}
+
+// checkRolesExist verifies that every role referenced by the source database
+// (after applying roleMap) exists on the destination server.
+func checkRolesExist(ctx context.Context, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, dbName string, roleMap map[string]string) error {
+	logf("Checking that all referenced roles exist on the destination...\n")
+	needed, err := referencedRoles(ctx, srcContainer, srcUser, srcPass, dbName)
+	if err != nil {
+		return fmt.Errorf("listing referenced roles failed: %w", err)
+	}
+	existing, err := listRoles(ctx, dstContainer, dstUser, dstPass, dbName)
+	if err != nil {
+		return fmt.Errorf("listing destination roles failed: %w", err)
+	}
+	have := map[string]bool{}
+	for _, r := range existing {
+		have[r] = true
+	}
+	var missing []string
+	for _, r := range needed {
+		target := mapRole(roleMap, r)
+		if have[target] {
+			continue
+		}
+		if target != r {
+			missing = append(missing, fmt.Sprintf("%s (mapped from %s)", target, r))
+		} else {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("roles missing on destination: %s", strings.Join(missing, ", "))
+	}
+	logf("All %d referenced roles exist on the destination.\n", len(needed))
+	return nil
+}
+
+// roleRewriter renames roles in plain SQL produced by pg_dump/pg_dumpall.
+// Lines are collected into complete statements; only statements that can
+// name roles are rewritten, and only in the grammar positions that hold
+// role names. Other statements and COPY data blocks pass through unchanged.
+type roleRewriter struct {
+	roleMap map[string]string
+	// globals makes CREATE ROLE skip existing roles (such as the bootstrap
+	// superuser) instead of reporting an error for each
+	globals bool
+	// keepRole is the destination login role; in globals mode its ALTER ROLE
+	// ... WITH statement is dropped so its attributes and password stay
+	keepRole string
+
+	inCopy  bool
+	inStmt  bool            // inside a statement that started on an earlier line
+	collect bool            // the current statement may name roles and is buffered
+	stmt    strings.Builder // the buffered statement
+	quote   string          // the open quote (', E', " or a dollar tag), "" outside quotes
+}
+
+// rolePrefixes are the statement starts (as emitted by pg_dump) that may name roles.
+var rolePrefixes = []string{
+	"ALTER ", "GRANT ", "REVOKE ", "CREATE ROLE ", "CREATE USER ", "CREATE GROUP ",
+	"CREATE TABLESPACE ", "CREATE SCHEMA ", "CREATE POLICY ", "COMMENT ON ROLE ",
+	"SET SESSION AUTHORIZATION ",
+}
+
+// rewriteLine takes the next line of the dump and returns the text to pass
+// on: nothing while a statement that may name roles is incomplete, and the
+// whole rewritten statement with its last line.
+func (rw *roleRewriter) rewriteLine(line string) string {
+	if len(rw.roleMap) == 0 && !rw.globals {
+		return line
+	}
+	trimmed := strings.TrimRight(line, "\r\n")
+	if rw.inCopy {
+		if trimmed == `\.` {
+			rw.inCopy = false
+		}
+		return line
+	}
+	if !rw.inStmt {
+		start := strings.TrimSpace(trimmed)
+		if start == "" || strings.HasPrefix(start, "--") {
+			return line
+		}
+		if strings.HasPrefix(start, "COPY ") && strings.HasSuffix(start, "FROM stdin;") {
+			rw.inCopy = true
+			return line
+		}
+		rw.inStmt = true
+		rw.collect = false
+		for _, p := range rolePrefixes {
+			if strings.HasPrefix(start, p) {
+				rw.collect = true
+				break
+			}
+		}
+	}
+	ended := rw.scanLine(trimmed)
+	if !rw.collect {
+		rw.inStmt = !ended
+		return line
+	}
+	rw.stmt.WriteString(line)
+	if !ended {
+		return ""
+	}
+	return rw.flush()
+}
+
+// flush returns the buffered statement, rewritten. At the end of the dump it
+// passes on a statement that was never terminated.
+func (rw *roleRewriter) flush() string {
+	stmt := rw.stmt.String()
+	rw.stmt.Reset()
+	rw.inStmt = false
+	if stmt == "" {
+		return ""
+	}
+	body := strings.TrimRight(stmt, " \t\r\n")
+	tail := stmt[len(body):]
+	body = rw.rewriteStatement(body)
+	if rw.globals {
+		if rw.altersKeptRole(body) {
+			return ""
+		}
+		if strings.HasPrefix(body, "CREATE ROLE ") {
+			body = "DO $pgupgrade$BEGIN " + body + " EXCEPTION WHEN duplicate_object THEN NULL; END$pgupgrade$;"
+		}
+	}
+	return body + tail
+}
+
+// scanLine follows the quotes through one line of a statement and reports
+// whether the line ends it, with a semicolon at its end outside quotes.
+func (rw *roleRewriter) scanLine(line string) bool {
+	end := len(line)
+scan:
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case rw.quote == "":
+			switch {
+			case strings.HasPrefix(line[i:], "--"):
+				end = i
+				break scan
+			case c == '\'':
+				rw.quote = "'"
+				if i > 0 && (line[i-1] == 'E' || line[i-1] == 'e') && (i == 1 || !isIdentChar(line[i-2])) {
+					rw.quote = "E'"
+				}
+			case c == '"':
+				rw.quote = `"`
+			case c == '$' && (i == 0 || !isIdentChar(line[i-1])):
+				if tag := dollarTag(line[i:]); tag != "" {
+					rw.quote = tag
+					i += len(tag) - 1
+				}
+			}
+		case rw.quote == "E'":
+			if c == '\\' {
+				i++
+			} else if c == '\'' {
+				rw.quote = ""
+			}
+		case strings.HasPrefix(line[i:], rw.quote):
+			// a doubled quote closes and reopens, which comes out the same
+			i += len(rw.quote) - 1
+			rw.quote = ""
+		}
+	}
+	return rw.quote == "" && strings.HasSuffix(strings.TrimSpace(line[:end]), ";")
+}
+
+// dollarTag returns the dollar quote ($$ or $tag$) s starts with, if any.
+func dollarTag(s string) string {
+	j := 1
+	for j < len(s) && s[j] != '$' && isIdentChar(s[j]) {
+		j++
+	}
+	if j < len(s) && s[j] == '$' && (j == 1 || s[1] < '0' || s[1] > '9') {
+		return s[:j+1]
+	}
+	return ""
+}
+
+// altersKeptRole reports whether stmt is "ALTER ROLE keepRole WITH ...", the
+// statement pg_dumpall uses for role attributes and the password.
+func (rw *roleRewriter) altersKeptRole(stmt string) bool {
+	words := sqlWords(tokenizeSQL(stmt))
+	return rw.keepRole != "" && len(words) > 3 && words[0].keyword() == "ALTER" && words[1].keyword() == "ROLE" &&
+		unquoteIdent(words[2].text) == rw.keepRole && words[3].keyword() == "WITH"
+}
+
+// sqlToken is a lexical piece of a statement. Whitespace and punctuation are
+// kept as tokens so the statement can be reassembled verbatim.
+type sqlToken struct {
+	text  string
+	ident bool // bare word or quoted identifier
+	pos   int  // index in the token list, set by sqlWords
+}
+
+// keyword returns a bare word in upper case, and "" for anything else.
+func (t sqlToken) keyword() string {
+	if !t.ident || strings.HasPrefix(t.text, `"`) {
+		return ""
+	}
+	return strings.ToUpper(t.text)
+}
+
+func tokenizeSQL(s string) []sqlToken {
+	var toks []sqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\'':
+			escapes := c == '\'' && i > 0 && (s[i-1] == 'E' || s[i-1] == 'e') && (i == 1 || !isIdentChar(s[i-2]))
+			j := i + 1
+			for j < len(s) {
+				if escapes && s[j] == '\\' {
+					j += 2
+					continue
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			j = min(j+1, len(s))
+			toks = append(toks, sqlToken{text: s[i:j], ident: c == '"'})
+			i = j
+		case c == '$' && (i == 0 || !isIdentChar(s[i-1])) && dollarTag(s[i:]) != "":
+			tag := dollarTag(s[i:])
+			j := len(s)
+			if k := strings.Index(s[i+len(tag):], tag); k >= 0 {
+				j = i + len(tag) + k + len(tag)
+			}
+			toks = append(toks, sqlToken{text: s[i:j]})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			toks = append(toks, sqlToken{text: s[i:j], ident: true})
+			i = j
+		default:
+			toks = append(toks, sqlToken{text: s[i : i+1]})
+			i++
+		}
+	}
+	return toks
+}
+
+// sqlWords returns the tokens that are not whitespace, each with its index in
+// toks.
+func sqlWords(toks []sqlToken) []sqlToken {
+	var words []sqlToken
+	for i, t := range toks {
+		if strings.TrimSpace(t.text) != "" {
+			t.pos = i
+			words = append(words, t)
+		}
+	}
+	return words
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// unquoteIdent returns the role name an identifier token refers to.
+func unquoteIdent(tok string) string {
+	if strings.HasPrefix(tok, `"`) {
+		return strings.ReplaceAll(strings.Trim(tok, `"`), `""`, `"`)
+	}
+	return strings.ToLower(tok)
+}
+
+// rewriteStatement renames the roles of one complete statement.
+func (rw *roleRewriter) rewriteStatement(stmt string) string {
+	toks := tokenizeSQL(stmt)
+	words := sqlWords(toks)
+	for _, i := range rolePositions(words) {
+		if mapped, ok := rw.roleMap[unquoteIdent(words[i].text)]; ok {
+			toks[words[i].pos].text = pqQuoteIdent(mapped)
+		}
+	}
+	var sb strings.Builder
+	for _, t := range toks {
+		sb.WriteString(t.text)
+	}
+	return sb.String()
+}
+
+// rolePositions returns the indexes of the words that hold role names: the
+// targets of OWNER TO, GRANT ... TO, REVOKE ... FROM, FOR ROLE and
+// AUTHORIZATION, the granted roles of a membership GRANT or REVOKE, the roles
+// of CREATE POLICY ... TO, CREATE USER MAPPING FOR and CREATE TABLESPACE ...
+// OWNER, and the role a role statement (CREATE/ALTER/COMMENT ON ROLE) is
+// about. GRANTED BY and the command of FOR SELECT are not role positions.
+func rolePositions(words []sqlToken) []int {
+	kw := func(i int) string {
+		if i >= len(words) {
+			return ""
+		}
+		return words[i].keyword()
+	}
+	var pos []int
+	// roleList collects a comma-separated list of role names starting at i and
+	// returns the index after it
+	roleList := func(i int) int {
+		for i < len(words) && words[i].ident && (i+1 == len(words) || words[i+1].text != ".") {
+			pos = append(pos, i)
+			if i+1 < len(words) && words[i+1].text == "," {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		return i
+	}
+	start := 0
+	switch {
+	case kw(0) == "ALTER" && kw(1) == "DEFAULT" && kw(2) == "PRIVILEGES":
+		i := 3
+		if kw(i) == "FOR" && (kw(i+1) == "ROLE" || kw(i+1) == "USER") {
+			i = roleList(i + 2)
+		}
+		for i < len(words) && kw(i) != "GRANT" && kw(i) != "REVOKE" {
+			i++
+		}
+		start = i
+	case kw(0) == "CREATE" && kw(1) == "USER" && kw(2) == "MAPPING":
+		if kw(3) == "FOR" {
+			roleList(4)
+		}
+		return pos
+	case (kw(0) == "CREATE" || kw(0) == "ALTER") && (kw(1) == "ROLE" || kw(1) == "USER" || kw(1) == "GROUP"):
+		roleList(2)
+		return pos
+	case kw(0) == "COMMENT" && kw(1) == "ON" && kw(2) == "ROLE":
+		roleList(3)
+		return pos
+	case kw(0) == "CREATE" && kw(1) == "POLICY":
+		for i := 2; i < len(words); i++ {
+			if kw(i) == "TO" {
+				roleList(i + 1)
+				break
+			}
+		}
+		return pos
+	case kw(0) == "CREATE" && kw(1) == "TABLESPACE":
+		for i := 2; i < len(words); i++ {
+			if kw(i) == "OWNER" {
+				roleList(i + 1)
+				break
+			}
+		}
+		return pos
+	}
+	switch kw(start) {
+	case "GRANT", "REVOKE":
+		target := "TO"
+		i := start + 1
+		if kw(start) == "REVOKE" {
+			target = "FROM"
+			// REVOKE GRANT/ADMIN/INHERIT/SET OPTION FOR ...
+			if kw(i+1) == "OPTION" && kw(i+2) == "FOR" {
+				i += 3
+			}
+		}
+		j, onObject := i, false
+		for ; j < len(words) && kw(j) != target; j++ {
+			onObject = onObject || kw(j) == "ON"
+		}
+		if !onObject {
+			// membership: GRANT role, ... TO role, ...
+			roleList(i)
+		}
+		if j < len(words) {
+			roleList(j + 1)
+		}
+		return pos
+	}
+	for i := start; i < len(words); i++ {
+		switch {
+		case kw(i) == "OWNER" && kw(i+1) == "TO":
+			roleList(i + 2)
+		case kw(i) == "AUTHORIZATION":
+			roleList(i + 1)
+		}
+	}
+	return pos
+}
+
+// streamWithRoleRewrite runs srcCall and dstCall as docker commands and pipes
+// the plain SQL output of the first into the second, rewritten by rw on the
+// way. progress (optional) receives a copy of the rewritten stream. A gzip
+// compressed dump is decompressed first. It returns the bytes received from
+// the source.
+func streamWithRoleRewrite(ctx context.Context, srcCall, dstCall dockerCall, rw *roleRewriter, progress io.Writer) (int64, error) {
+	if len(rw.roleMap) > 0 {
+		logf("Streaming with role mapping: %s\n", formatRoleMap(rw.roleMap))
+	}
+	received := &byteCounter{}
+	_, err := pipeDocker(ctx, srcCall, dstCall, func(w io.Writer, r io.Reader) (int64, error) {
+		if progress != nil {
+			w = io.MultiWriter(w, progress)
+		}
+		// the dump may be compressed with pg_dump -Z
+		plain, err := maybeGunzip(io.TeeReader(r, received))
+		if err != nil {
+			return 0, err
+		}
+		br := bufio.NewReader(plain)
+		var written int64
+		for {
+			line, err := br.ReadString('\n')
+			if len(line) > 0 {
+				n, werr := io.WriteString(w, rw.rewriteLine(line))
+				written += int64(n)
+				if werr != nil {
+					return written, werr
+				}
+			}
+			if err == io.EOF {
+				n, werr := io.WriteString(w, rw.flush())
+				return written + int64(n), werr
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+	})
+	return received.n, err
+}
+
+func formatRoleMap(roleMap map[string]string) string {
+	var pairs []string
+	for k, v := range roleMap {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
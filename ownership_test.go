@@ -0,0 +1,180 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseRoleMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]string
+		wantErr string
+	}{
+		{"empty", "", map[string]string{}, ""},
+		{"one pair", "app=app_v2", map[string]string{"app": "app_v2"}, ""},
+		{"spaces and empty entries", " app = app_v2 , ,report=reader ", map[string]string{"app": "app_v2", "report": "reader"}, ""},
+		{"value with equals sign", "a=b=c", map[string]string{"a": "b=c"}, ""},
+		{"mixed case kept", "App=NewApp", map[string]string{"App": "NewApp"}, ""},
+		{"missing new name", "app=", nil, "expected old=new"},
+		{"missing old name", "=app", nil, "expected old=new"},
+		{"no equals sign", "app", nil, "expected old=new"},
+		{"duplicate", "app=a,app=b", nil, "mapped more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRoleMap(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRoleMap(%q) err = %v, want %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("parseRoleMap(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteStatement(t *testing.T) {
+	rw := &roleRewriter{roleMap: map[string]string{"app": "app_v2", "report": "reader", "Mixed Case": "mixed", "select": "chosen"}}
+	tests := []struct {
+		in, want string
+	}{
+		{`ALTER TABLE public.orders OWNER TO app;`, `ALTER TABLE public.orders OWNER TO "app_v2";`},
+		{`GRANT SELECT ON TABLE public.orders TO report;`, `GRANT SELECT ON TABLE public.orders TO "reader";`},
+		{`GRANT SELECT ON TABLE public.orders TO app, report;`, `GRANT SELECT ON TABLE public.orders TO "app_v2", "reader";`},
+		{`REVOKE ALL ON SCHEMA public FROM app;`, `REVOKE ALL ON SCHEMA public FROM "app_v2";`},
+		{`GRANT app TO report;`, `GRANT "app_v2" TO "reader";`},
+		{`GRANT app TO report GRANTED BY postgres;`, `GRANT "app_v2" TO "reader" GRANTED BY postgres;`},
+		{`ALTER DEFAULT PRIVILEGES FOR ROLE app IN SCHEMA public GRANT SELECT ON TABLES TO report;`, `ALTER DEFAULT PRIVILEGES FOR ROLE "app_v2" IN SCHEMA public GRANT SELECT ON TABLES TO "reader";`},
+		{`ALTER SCHEMA sales OWNER TO "Mixed Case";`, `ALTER SCHEMA sales OWNER TO "mixed";`},
+		{`ALTER ROLE app WITH LOGIN;`, `ALTER ROLE "app_v2" WITH LOGIN;`},
+		{`CREATE ROLE report;`, `CREATE ROLE "reader";`},
+		{`SET SESSION AUTHORIZATION app;`, `SET SESSION AUTHORIZATION "app_v2";`},
+		{`CREATE POLICY p ON public.orders FOR SELECT TO app USING (true);`, `CREATE POLICY p ON public.orders FOR SELECT TO "app_v2" USING (true);`},
+		// schema-qualified names and unmapped roles stay as they are
+		{`ALTER TABLE app.orders OWNER TO postgres;`, `ALTER TABLE app.orders OWNER TO postgres;`},
+		{`ALTER FUNCTION public.f() OWNER TO "App";`, `ALTER FUNCTION public.f() OWNER TO "App";`},
+		{`COMMENT ON ROLE app IS 'to app';`, `COMMENT ON ROLE "app_v2" IS 'to app';`},
+		// only role positions are renamed
+		{`GRANT SELECT ON TABLE public.app TO app WITH GRANT OPTION;`, `GRANT SELECT ON TABLE public.app TO "app_v2" WITH GRANT OPTION;`},
+		{`ALTER TABLE app OWNER TO app;`, `ALTER TABLE app OWNER TO "app_v2";`},
+		{`GRANT report TO app WITH ADMIN OPTION GRANTED BY report;`, `GRANT "reader" TO "app_v2" WITH ADMIN OPTION GRANTED BY report;`},
+		{`REVOKE ADMIN OPTION FOR app FROM report;`, `REVOKE ADMIN OPTION FOR "app_v2" FROM "reader";`},
+		{`REVOKE GRANT OPTION FOR SELECT ON TABLE public.t FROM app;`, `REVOKE GRANT OPTION FOR SELECT ON TABLE public.t FROM "app_v2";`},
+		{`CREATE POLICY select ON public.t FOR SELECT TO report, app USING (true);`, `CREATE POLICY select ON public.t FOR SELECT TO "reader", "app_v2" USING (true);`},
+		{`CREATE SCHEMA app AUTHORIZATION app;`, `CREATE SCHEMA app AUTHORIZATION "app_v2";`},
+		{`CREATE USER MAPPING FOR app SERVER app OPTIONS (user 'app');`, `CREATE USER MAPPING FOR "app_v2" SERVER app OPTIONS (user 'app');`},
+		{`CREATE TABLESPACE fast OWNER app LOCATION '/fast';`, `CREATE TABLESPACE fast OWNER "app_v2" LOCATION '/fast';`},
+		{`ALTER DEFAULT PRIVILEGES FOR ROLE app, report REVOKE ALL ON FUNCTIONS FROM PUBLIC;`, `ALTER DEFAULT PRIVILEGES FOR ROLE "app_v2", "reader" REVOKE ALL ON FUNCTIONS FROM PUBLIC;`},
+		{`ALTER TABLE public.t ALTER COLUMN app SET DEFAULT 'OWNER TO app';`, `ALTER TABLE public.t ALTER COLUMN app SET DEFAULT 'OWNER TO app';`},
+		{"ALTER TABLE public.t\n    OWNER TO app;", "ALTER TABLE public.t\n    OWNER TO \"app_v2\";"},
+	}
+	for _, tt := range tests {
+		if got := rw.rewriteStatement(tt.in); got != tt.want {
+			t.Errorf("rewriteStatement(%s)\n  got  %s\n  want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		globals bool
+		lines   []string
+		want    []string
+		flushed string
+	}{
+		{
+			"COPY data is untouched",
+			false,
+			[]string{"COPY public.t (owner) FROM stdin;\n", "ALTER TABLE x OWNER TO app;\n", "\\.\n", "ALTER TABLE x OWNER TO app;\n"},
+			[]string{"COPY public.t (owner) FROM stdin;\n", "ALTER TABLE x OWNER TO app;\n", "\\.\n", "ALTER TABLE x OWNER TO \"app_v2\";\n"},
+			"",
+		},
+		{
+			"other statements pass",
+			false,
+			[]string{"SELECT 'TO app';\n", "CREATE TABLE app (id int);\r\n"},
+			[]string{"SELECT 'TO app';\n", "CREATE TABLE app (id int);\r\n"},
+			"",
+		},
+		{
+			"globals skip existing roles",
+			true,
+			[]string{"CREATE ROLE app;\n", "ALTER ROLE app WITH LOGIN;\n", "CREATE ROLE postgres;\n"},
+			[]string{
+				"DO $pgupgrade$BEGIN CREATE ROLE \"app_v2\"; EXCEPTION WHEN duplicate_object THEN NULL; END$pgupgrade$;\n",
+				"ALTER ROLE \"app_v2\" WITH LOGIN;\n",
+				"DO $pgupgrade$BEGIN CREATE ROLE postgres; EXCEPTION WHEN duplicate_object THEN NULL; END$pgupgrade$;\n",
+			},
+			"",
+		},
+		{
+			"globals keep the destination login role",
+			true,
+			[]string{
+				"ALTER ROLE postgres WITH SUPERUSER LOGIN PASSWORD 'SCRAM-SHA-256$4096:abc';\n",
+				"ALTER ROLE postgres SET search_path TO public;\n",
+				"ALTER ROLE \"Postgres\" WITH LOGIN;\n",
+			},
+			[]string{"", "ALTER ROLE postgres SET search_path TO public;\n", "ALTER ROLE \"Postgres\" WITH LOGIN;\n"},
+			"",
+		},
+		{
+			"multi-line statement",
+			false,
+			[]string{"CREATE POLICY p ON public.orders\n", "    FOR SELECT TO app\n", "    USING ((note <> 'x;'));\n"},
+			[]string{"", "", "CREATE POLICY p ON public.orders\n    FOR SELECT TO \"app_v2\"\n    USING ((note <> 'x;'));\n"},
+			"",
+		},
+		{
+			"semicolons inside strings",
+			false,
+			[]string{"COMMENT ON ROLE app IS 'first;\n", "GRANT x TO app;';\n", "COMMENT ON ROLE app IS E'it\\'s;\n", "done';\n"},
+			[]string{"", "COMMENT ON ROLE \"app_v2\" IS 'first;\nGRANT x TO app;';\n", "", "COMMENT ON ROLE \"app_v2\" IS E'it\\'s;\ndone';\n"},
+			"",
+		},
+		{
+			"function bodies pass",
+			false,
+			[]string{"CREATE FUNCTION f() RETURNS void AS $_$\n", "GRANT SELECT ON t TO app;\n", "$_$ LANGUAGE sql;\n", "ALTER FUNCTION f() OWNER TO app;\n"},
+			[]string{"CREATE FUNCTION f() RETURNS void AS $_$\n", "GRANT SELECT ON t TO app;\n", "$_$ LANGUAGE sql;\n", "ALTER FUNCTION f() OWNER TO \"app_v2\";\n"},
+			"",
+		},
+		{
+			"globals role settings keep their values",
+			true,
+			[]string{"ALTER ROLE app SET search_path TO app, public;\n"},
+			[]string{"ALTER ROLE \"app_v2\" SET search_path TO app, public;\n"},
+			"",
+		},
+		{
+			"unterminated statement is flushed",
+			false,
+			[]string{"ALTER TABLE x OWNER TO app\n"},
+			[]string{""},
+			"ALTER TABLE x OWNER TO \"app_v2\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &roleRewriter{roleMap: map[string]string{"app": "app_v2"}, globals: tt.globals, keepRole: "postgres"}
+			for i, line := range tt.lines {
+				if got := rw.rewriteLine(line); got != tt.want[i] {
+					t.Errorf("line %d: got %q, want %q", i+1, got, tt.want[i])
+				}
+			}
+			if got := rw.flush(); got != tt.flushed {
+				t.Errorf("flush: got %q, want %q", got, tt.flushed)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Rehearsal into a throwaway clone =====
+
+// rehearsal collects what happens during a rehearsal for the report.
+type rehearsal struct {
+	mu       sync.Mutex
+	db       string // database currently migrated, "" for cluster-wide phases
+	phases   []phaseTiming
+	warnings []string
+	results  map[string]error // per database; nil = migrated and verified
+}
+
+type phaseTiming struct {
+	Database string
+	Phase    string
+	Duration time.Duration
+	Err      error
+}
+
+// runRehearseCommand implements "rehearse": migrate the source into a
+// disposable container with a random name, verify it, remove everything
+// again and print a report with the timings and warnings. The source is only
+// read; maintenance mode, stopping applications and hooks are not used.
+func runRehearseCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("rehearse", flag.ExitOnError)
+	src := addConnFlags(fs, "src", "source")
+	dbs := fs.String("db", "", "databases to migrate, comma separated (default: POSTGRES_DB of the source or postgres)")
+	image := fs.String("image", "postgres:latest", "image of the throwaway destination")
+	dstDocker := fs.String("dst-docker", "", "Docker engine for the throwaway destination (default: the source engine)")
+	globals := fs.Bool("globals", false, "also migrate global objects (roles)")
+	preserve := fs.Bool("preserve-ownership", false, "keep owners and GRANTs (migrates roles first)")
+	fileBased := fs.Bool("file", false, "rehearse the file-based migration instead of streaming")
+	mode := fs.String("verify", "quick", "verification mode: quick, estimate, full or none")
+	smokeFile := fs.String("smoke", "", "JSON file with smoke-test queries")
+	reportPath := fs.String("report", "", "also write the report to this file")
+	fs.Parse(args)
+
+	srcContainer, srcUser, srcPass, err := src.resolve(ctx)
+	if err != nil {
+		failf(errInvalidInput, "rehearse: %v\n", err)
+		return 2
+	}
+	switch *mode {
+	case "quick", "estimate", "full", "none":
+	default:
+		failf(errInvalidInput, "rehearse: unknown verification mode %q\n", *mode)
+		return 2
+	}
+	srcEngine := srcContainer.Engine
+	dstEngine := srcEngine
+	if *dstDocker != "" {
+		if dstEngine, err = parseEngine(*dstDocker); err != nil {
+			failf(errInvalidInput, "rehearse: -dst-docker: %v\n", err)
+			return 2
+		}
+	}
+	databases := splitList(*dbs)
+	if len(databases) == 0 {
+		databases = []string{defaultDatabase(ctx, srcContainer, "")}
+	}
+	if !checkPgConnection(ctx, srcContainer, srcUser, srcPass, databases[0]) {
+		failf(errConnection, "rehearse: cannot connect to '%s'\n", srcContainer)
+		return 2
+	}
+	watchSessions(srcContainer, srcUser, srcPass)
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := "pgupgrade-rehearsal-" + hex.EncodeToString(suffix)
+	r := &rehearsal{results: map[string]error{}}
+	phaseObserver, warningObserver = r.phase, r.warning
+	start := time.Now()
+
+	logf("Starting throwaway destination '%s' from '%s'...\n", name, *image)
+	dstContainer, releases, err := createPostgresContainer(ctx, dstEngine, *image, name, "", name, imageDataDir(ctx, dstEngine, *image),
+		srcUser, srcPass, databases[0])
+	teardown := func(ctx context.Context) {
+		for _, release := range releases {
+			release()
+		}
+		logf("Removing throwaway container and volume '%s'...\n", name)
+		engineCommand(ctx, dstEngine, "rm", "-f", "-v", name).Run()
+		engineCommand(ctx, dstEngine, "volume", "rm", name).Run()
+	}
+	if err != nil {
+		failf(errContainerCreate, "rehearse: %v\n", err)
+		teardown(context.WithoutCancel(ctx))
+		return 1
+	}
+	watchSessions(dstContainer, srcUser, srcPass)
+
+	stateFile := filepath.Join(os.TempDir(), name+"-state.json")
+	plan := &migrationPlan{
+		SrcContainer: srcContainer, SrcUser: srcUser, SrcPassword: srcPass,
+		DstContainer: dstContainer, DstUser: srcUser, DstPassword: srcPass,
+		Stream: !*fileBased, MigrateGlobals: *globals || *preserve, PreserveOwnership: *preserve,
+		VerifyMode: *mode, CountOptions: defaultCountOptions(), SmokeFile: *smokeFile,
+		Compression: defaultCompression,
+	}
+	state := newRunState(stateFile, plan)
+	releaseState := onInterrupt("remove rehearsal state", func(ctx context.Context) {
+		os.Remove(stateFile)
+	})
+	for _, db := range databases {
+		// one database at a time, so phases can be attributed
+		r.mu.Lock()
+		r.db = db
+		r.mu.Unlock()
+		p := *plan
+		p.Databases = []string{db}
+		state.Plan = &p
+		r.results[db] = runMigration(ctx, &p, state)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	phaseObserver, warningObserver = nil, nil
+	versions := map[string]string{}
+	for label, c := range map[string]containerRef{"src": srcContainer, "dst": dstContainer} {
+		if v, err := serverVersion(ctx, c, srcUser, srcPass); err == nil {
+			versions[label] = v
+		}
+	}
+	sizes := map[string]int64{}
+	for _, db := range databases {
+		if n, err := databaseSize(ctx, srcContainer, srcUser, srcPass, db); err == nil {
+			sizes[db] = n
+		}
+	}
+	teardown(context.WithoutCancel(ctx))
+	releaseState()
+	os.Remove(stateFile)
+	if ctx.Err() != nil {
+		return 1
+	}
+
+	report := r.report(srcContainer, *image, versions, databases, sizes, time.Since(start))
+	fmt.Fprint(humanOut(), report)
+	if *reportPath != "" {
+		if err := os.WriteFile(*reportPath, []byte(report), 0o644); err != nil {
+			logf("Writing the report to '%s' failed: %v\n", *reportPath, err)
+		} else {
+			logf("Report written to '%s'.\n", *reportPath)
+		}
+	}
+	for _, db := range databases {
+		if r.results[db] != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (r *rehearsal) phase(name string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	db := r.db
+	if name == "globals" {
+		db = ""
+	}
+	r.phases = append(r.phases, phaseTiming{Database: db, Phase: name, Duration: d, Err: err})
+}
+
+func (r *rehearsal) warning(message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warnings = append(r.warnings, message)
+}
+
+// serverVersion returns the server_version setting, e.g. "16.4".
+func serverVersion(ctx context.Context, container containerRef, user, pass string) (string, error) {
+	var rows []struct {
+		Version string `json:"version"`
+	}
+	if err := queryJSON(ctx, container, user, pass, "postgres", "SELECT current_setting('server_version') AS version", &rows); err != nil {
+		return "", err
+	}
+	if len(rows) != 1 {
+		return "", fmt.Errorf("unexpected result with %d rows", len(rows))
+	}
+	return rows[0].Version, nil
+}
+
+// report renders the rehearsal as Markdown, to be attached to a change
+// request.
+func (r *rehearsal) report(source containerRef, image string, versions map[string]string, databases []string, sizes map[string]int64, total time.Duration) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\n# Migration rehearsal\n\n")
+	fmt.Fprintf(&b, "- Date: %s\n", time.Now().Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(&b, "- Source: %s (PostgreSQL %s)\n", source.Name, orUnknown(versions["src"]))
+	fmt.Fprintf(&b, "- Target image: %s (PostgreSQL %s)\n", image, orUnknown(versions["dst"]))
+	fmt.Fprintf(&b, "- Total duration: %s\n\n", total.Round(time.Second))
+
+	fmt.Fprintf(&b, "## Databases\n\n| Database | Size | Result |\n|---|---|---|\n")
+	for _, db := range databases {
+		size := "?"
+		if n, ok := sizes[db]; ok {
+			size = formatBytes(n)
+		}
+		result := "ok"
+		if err, ran := r.results[db]; !ran {
+			result = "not run"
+		} else if err != nil {
+			result = "FAILED: " + markdownCell(err.Error())
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", db, size, result)
+	}
+
+	fmt.Fprintf(&b, "\n## Phases\n\n| Database | Phase | Duration | Status |\n|---|---|---|---|\n")
+	for _, p := range r.phases {
+		status := "ok"
+		if p.Err != nil {
+			status = "failed: " + markdownCell(p.Err.Error())
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", p.Database, p.Phase, p.Duration.Round(time.Millisecond), status)
+	}
+
+	fmt.Fprintf(&b, "\n## Restore warnings (%d)\n\n", len(r.warnings))
+	if len(r.warnings) == 0 {
+		fmt.Fprintf(&b, "None.\n")
+	} else {
+		fmt.Fprintf(&b, "```\n%s\n```\n", strings.Join(r.warnings, "\n"))
+	}
+	return b.String()
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// markdownCell keeps a message on one table row.
+func markdownCell(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.ReplaceAll(s, "|", "\\|")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRehearsalReport(t *testing.T) {
+	r := &rehearsal{results: map[string]error{}}
+	r.phase("globals", 1200*time.Millisecond, nil)
+	r.db = "app"
+	r.phase("dump_restore", 90*time.Second, nil)
+	r.phase("verify", 3*time.Second, nil)
+	r.results["app"] = nil
+	r.db = "shop"
+	r.phase("dump_restore", 5*time.Second, errors.New("restore failed: exit status 1 - ERROR:  extension \"timescaledb\" is not available\n| detail"))
+	r.results["shop"] = errors.New("restore failed: exit status 1")
+	r.warning(`pg_restore: warning: errors ignored on restore: 1`)
+
+	sizes := map[string]int64{"app": 3 << 20, "shop": 512}
+	got := r.report(onEngine("old", dockerEngine{}), "postgres:17", map[string]string{"src": "13.16"},
+		[]string{"app", "shop", "wiki"}, sizes, 99*time.Second+400*time.Millisecond)
+
+	var lines []string
+	for _, line := range strings.Split(got, "\n") {
+		if !strings.HasPrefix(line, "- Date: ") {
+			lines = append(lines, line)
+		}
+	}
+	want := `
+# Migration rehearsal
+
+- Source: old (PostgreSQL 13.16)
+- Target image: postgres:17 (PostgreSQL unknown)
+- Total duration: 1m39s
+
+## Databases
+
+| Database | Size | Result |
+|---|---|---|
+| app | 3.0 MiB | ok |
+| shop | 512 B | FAILED: restore failed: exit status 1 |
+| wiki | ? | not run |
+
+## Phases
+
+| Database | Phase | Duration | Status |
+|---|---|---|---|
+|  | globals | 1.2s | ok |
+| app | dump_restore | 1m30s | ok |
+| app | verify | 3s | ok |
+| shop | dump_restore | 5s | failed: restore failed: exit status 1 - ERROR: extension "timescaledb" is not available \| detail |
+
+## Restore warnings (1)
+
+` + "```\npg_restore: warning: errors ignored on restore: 1\n```\n"
+	if s := strings.Join(lines, "\n"); s != want {
+		t.Errorf("report =\n%s\nwant\n%s", s, want)
+	}
+}
+
+func TestWarningObserver(t *testing.T) {
+	var seen []string
+	warningObserver = func(line string) { seen = append(seen, line) }
+	defer func() { warningObserver = nil }()
+	reportWarnings("pg_restore: warning: a\n\n  pg_restore: warning: b  \n", true)
+	if want := []string{"pg_restore: warning: a", "pg_restore: warning: b"}; !slices.Equal(seen, want) {
+		t.Errorf("observed %q, want %q", seen, want)
+	}
+}
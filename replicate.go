@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ===== Logical replication =====
+
+// replicationName names the publication, the subscription and (implicitly)
+// the replication slot.
+const replicationName = "pgupgrade_replication"
+
+// replication is a publication on the source database subscribed to by the
+// destination. The network fields record what has to be undone afterwards.
+type replication struct {
+	srcContainer     containerRef
+	srcUser, srcPass string
+	dstContainer     containerRef
+	dstUser, dstPass string
+	db               string
+
+	engine         dockerEngine
+	network        string
+	createdNetwork bool
+	connected      []containerRef // containers connected to network by the tool
+	readOnly       bool           // default_transaction_read_only was set on the source
+}
+
+// runReplicateCommand implements "replicate": copy the schema, replicate the
+// data with a publication/subscription pair and switch over on request.
+// Exit code 0 means the cutover completed, 1 a failure and 2 a usage or
+// connection error.
+func runReplicateCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("replicate", flag.ExitOnError)
+	src := addConnFlags(fs, "src", "source")
+	dst := addConnFlags(fs, "dst", "destination")
+	db := fs.String("db", "", "database name (default: POSTGRES_DB of the source or postgres)")
+	network := fs.String("network", "", "Docker network shared by both containers (default: a common network, else a temporary one)")
+	srcPort := fs.Int("src-port", 5432, "PostgreSQL port of the source inside the network")
+	cutoverTimeout := fs.Duration("cutover-timeout", 5*time.Minute, "how long the cutover waits for the lag to reach zero")
+	fs.Parse(args)
+
+	srcContainer, srcUser, srcPass, err := src.resolve(ctx)
+	if err != nil {
+		failf(errInvalidInput, "replicate: %v\n", err)
+		return 2
+	}
+	dstContainer, dstUser, dstPass, err := dst.resolve(ctx)
+	if err != nil {
+		failf(errInvalidInput, "replicate: %v\n", err)
+		return 2
+	}
+	engine := srcContainer.Engine
+	if engine != dstContainer.Engine {
+		failf(errInvalidInput, "replicate: both containers must run on the same Docker engine to share a network\n")
+		return 2
+	}
+	dbName := defaultDatabase(ctx, srcContainer, *db)
+	if !checkPgConnection(ctx, srcContainer, srcUser, srcPass, dbName) || !checkPgConnection(ctx, dstContainer, dstUser, dstPass, "postgres") {
+		failf(errConnection, "replicate: cannot connect to both containers\n")
+		return 2
+	}
+	watchSessions(srcContainer, srcUser, srcPass)
+	watchSessions(dstContainer, dstUser, dstPass)
+
+	rep := &replication{
+		srcContainer: srcContainer, srcUser: srcUser, srcPass: srcPass,
+		dstContainer: dstContainer, dstUser: dstUser, dstPass: dstPass,
+		db: dbName, engine: engine,
+	}
+	env := hookEnv{
+		SrcContainer: srcContainer, DstContainer: dstContainer,
+		Databases: []string{dbName}, Database: dbName,
+	}
+	onFailure := func(err string) {
+		env.Outcome, env.Error = "failure", err
+		runHooks(ctx, globalHooks, hookOnFailure, env)
+	}
+	if err := runHooks(ctx, globalHooks, hookPreCheck, env); err != nil {
+		failf(errHook, "replicate: %v\n", err)
+		onFailure(err.Error())
+		return 1
+	}
+	if problems := rep.checkPrerequisites(ctx); len(problems) > 0 {
+		failf(errReplication, "replicate: prerequisites not met:\n  %s\n", strings.Join(problems, "\n  "))
+		onFailure("prerequisites not met")
+		return 1
+	}
+	if err := ensureDatabase(ctx, dstContainer, dstUser, dstPass, dbName); err != nil {
+		failf(errRestore, "replicate: creating database '%s' failed: %v\n", dbName, err)
+		onFailure(err.Error())
+		return 1
+	}
+	done := startPhase("schema")
+	err = rep.copySchema(ctx)
+	done(err)
+	if err != nil {
+		failf(errRestore, "replicate: restoring the schema failed: %v\n", err)
+		onFailure(err.Error())
+		return 1
+	}
+
+	// From here on the source holds a replication slot that retains WAL, so
+	// every way out removes it again
+	releaseCleanup := onInterrupt("remove replication", rep.cleanup)
+	fail := func(code, format string, args ...any) int {
+		if ctx.Err() != nil {
+			return 1 // the interrupt cleanup removes it
+		}
+		releaseCleanup()
+		failf(code, format, args...)
+		rep.cleanup(context.Background())
+		onFailure(strings.TrimSpace(fmt.Sprintf(format, args...)))
+		return 1
+	}
+	done = startPhase("subscribe")
+	srcHost, err := rep.joinNetwork(ctx, *network)
+	if err == nil {
+		err = rep.subscribe(ctx, srcHost, *srcPort)
+	}
+	done(err)
+	if err != nil {
+		return fail(errReplication, "replicate: setting up replication failed: %v\n", err)
+	}
+	done = startPhase("initial_sync")
+	err = rep.waitInitialSync(ctx)
+	done(err)
+	if err != nil {
+		return fail(errReplication, "replicate: initial sync failed: %v\n", err)
+	}
+	if err := rep.followLag(ctx); err != nil {
+		return fail(errReplication, "replicate: %v\n", err)
+	}
+	done = startPhase("cutover")
+	err = rep.cutover(ctx, *cutoverTimeout)
+	done(err)
+	if err != nil {
+		return fail(errReplication, "replicate: cutover failed: %v\n", err)
+	}
+	releaseCleanup()
+	rep.leaveNetwork(context.Background())
+	logf("Cutover complete: '%s' on '%s' is read-only, '%s' holds the data. Point the applications to '%s'.\n",
+		dbName, srcContainer, dstContainer, dstContainer)
+	logf("To make the source writable again: ALTER DATABASE %s RESET default_transaction_read_only;\n", pqQuoteIdent(dbName))
+	env.Outcome = "success"
+	runHooks(ctx, globalHooks, hookPostCutover, env)
+	return 0
+}
+
+// checkPrerequisites lists what prevents logical replication of the database.
+func (r *replication) checkPrerequisites(ctx context.Context) []string {
+	logf("Checking logical replication prerequisites...\n")
+	var problems []string
+	for _, side := range []struct {
+		desc           string
+		container      containerRef
+		user, pass, db string
+	}{
+		{"source", r.srcContainer, r.srcUser, r.srcPass, r.db},
+		{"destination", r.dstContainer, r.dstUser, r.dstPass, "postgres"},
+	} {
+		var rows []struct {
+			Version int  `json:"version"`
+			Super   bool `json:"super"`
+		}
+		sql := "SELECT current_setting('server_version_num')::int AS version, rolsuper AS super FROM pg_roles WHERE rolname = current_user"
+		if err := queryJSON(ctx, side.container, side.user, side.pass, side.db, sql, &rows); err != nil || len(rows) != 1 {
+			problems = append(problems, fmt.Sprintf("%s: cannot read server settings: %v", side.desc, err))
+			continue
+		}
+		if rows[0].Version < 100000 {
+			problems = append(problems, fmt.Sprintf("%s: PostgreSQL 10 or newer is required", side.desc))
+		}
+		if !rows[0].Super {
+			problems = append(problems, fmt.Sprintf("%s: user '%s' must be a superuser", side.desc, side.user))
+		}
+	}
+
+	var settings []struct {
+		WalLevel string `json:"wal_level"`
+		Slots    int    `json:"slots"`
+		Senders  int    `json:"senders"`
+	}
+	sql := `SELECT current_setting('wal_level') AS wal_level,
+       current_setting('max_replication_slots')::int - (SELECT count(*) FROM pg_replication_slots) AS slots,
+       current_setting('max_wal_senders')::int - (SELECT count(*) FROM pg_stat_replication) AS senders`
+	if err := queryJSON(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, sql, &settings); err == nil && len(settings) == 1 {
+		s := settings[0]
+		if s.WalLevel != "logical" {
+			problems = append(problems, fmt.Sprintf("source: wal_level is '%s'; set wal_level=logical (e.g. 'postgres -c wal_level=logical') and restart", s.WalLevel))
+		}
+		if s.Slots < 1 {
+			problems = append(problems, "source: no free replication slot (max_replication_slots)")
+		}
+		if s.Senders < 1 {
+			problems = append(problems, "source: no free WAL sender (max_wal_senders)")
+		}
+	}
+
+	// UPDATE and DELETE on a published table need a replica identity
+	var tables []struct {
+		Name string `json:"name"`
+	}
+	sql = `SELECT n.nspname || '.' || c.relname AS name
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r'
+  AND n.nspname NOT IN ('pg_catalog','information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND (c.relreplident = 'n'
+       OR (c.relreplident = 'd' AND NOT EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisprimary)))
+ORDER BY 1`
+	if err := queryJSON(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, sql, &tables); err != nil {
+		problems = append(problems, fmt.Sprintf("source: listing tables failed: %v", err))
+	}
+	for _, t := range tables {
+		problems = append(problems, fmt.Sprintf("source: table %s has no primary key (add one or set REPLICA IDENTITY FULL)", t.Name))
+	}
+	if len(problems) == 0 {
+		logf("All prerequisites are met.\n")
+	}
+	return problems
+}
+
+// copySchema restores the schema of the source database on the destination.
+func (r *replication) copySchema(ctx context.Context) error {
+	logf("Copying the schema of '%s' from '%s' to '%s'...\n", r.db, r.srcContainer, r.dstContainer)
+	srcCall := pgExec(r.srcContainer, r.srcPass, false, "pg_dump", "-U", r.srcUser, "-d", r.db, "-s",
+		"--no-owner", "--no-privileges", "--no-publications", "--no-subscriptions")
+	dstCall := pgExec(r.dstContainer, r.dstPass, true, "psql", "-X", "-q", "-v", "ON_ERROR_STOP=1", "-U", r.dstUser, "-d", r.db)
+	_, err := pipeDocker(ctx, srcCall, dstCall, plainCopy(nil))
+	return err
+}
+
+// joinNetwork finds (or provides) a Docker network both containers are
+// attached to and returns the address of the source on it.
+func (r *replication) joinNetwork(ctx context.Context, network string) (string, error) {
+	srcNets, err := containerNetworks(ctx, r.srcContainer)
+	if err != nil {
+		return "", err
+	}
+	dstNets, err := containerNetworks(ctx, r.dstContainer)
+	if err != nil {
+		return "", err
+	}
+	if network == "" {
+		for name := range srcNets {
+			if _, ok := dstNets[name]; ok && name != "host" && name != "none" {
+				network = name
+				break
+			}
+		}
+	}
+	if network == "" {
+		network = fmt.Sprintf("%s-%d", appname, os.Getpid())
+		logf("Creating Docker network '%s'...\n", network)
+		if out, err := engineCommand(ctx, r.engine, "network", "create", network).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("creating network '%s' failed: %v - %s", network, err, out)
+		}
+		r.createdNetwork = true
+	}
+	r.network = network
+	for _, c := range []struct {
+		container containerRef
+		nets      map[string]string
+	}{{r.srcContainer, srcNets}, {r.dstContainer, dstNets}} {
+		if _, ok := c.nets[network]; ok {
+			continue
+		}
+		logf("Connecting '%s' to network '%s'...\n", c.container, network)
+		if out, err := engineCommand(ctx, c.container.Engine, "network", "connect", network, c.container.Name).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("connecting '%s' to '%s' failed: %v - %s", c.container, network, err, out)
+		}
+		r.connected = append(r.connected, c.container)
+	}
+	srcNets, err = containerNetworks(ctx, r.srcContainer)
+	if err != nil {
+		return "", err
+	}
+	if srcNets[network] == "" {
+		return "", fmt.Errorf("'%s' has no address on network '%s'", r.srcContainer, network)
+	}
+	logf("The destination reaches the source at %s on network '%s'.\n", srcNets[network], network)
+	return srcNets[network], nil
+}
+
+// leaveNetwork undoes what joinNetwork changed.
+func (r *replication) leaveNetwork(ctx context.Context) {
+	for _, c := range r.connected {
+		engineCommand(ctx, c.Engine, "network", "disconnect", r.network, c.Name).Run()
+	}
+	r.connected = nil
+	if r.createdNetwork {
+		engineCommand(ctx, r.engine, "network", "rm", r.network).Run()
+		r.createdNetwork = false
+	}
+}
+
+// containerNetworks maps the networks of container to its address on them.
+func containerNetworks(ctx context.Context, container containerRef) (map[string]string, error) {
+	format := "{{range $name, $net := .NetworkSettings.Networks}}{{$name}}={{$net.IPAddress}}{{println}}{{end}}"
+	out, err := engineCommand(ctx, container.Engine, "inspect", "--format", format, container.Name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("inspecting '%s' failed: %v", container, err)
+	}
+	nets := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, ip, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			nets[name] = ip
+		}
+	}
+	return nets, nil
+}
+
+// subscribe publishes all tables of the source and subscribes the
+// destination to them. The initial copy starts right away.
+func (r *replication) subscribe(ctx context.Context, srcHost string, srcPort int) error {
+	logf("Creating publication '%s' on '%s'...\n", replicationName, r.srcContainer)
+	if err := runPsqlInput(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db,
+		"CREATE PUBLICATION "+replicationName+" FOR ALL TABLES;"); err != nil {
+		return err
+	}
+	conninfo := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s",
+		connInfoValue(srcHost), srcPort, connInfoValue(r.db), connInfoValue(r.srcUser), connInfoValue(r.srcPass))
+	logf("Creating subscription '%s' on '%s'...\n", replicationName, r.dstContainer)
+	// passed on stdin so the password stays out of the process list
+	return runPsqlInput(ctx, r.dstContainer, r.dstUser, r.dstPass, r.db, fmt.Sprintf(
+		"CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s;", replicationName, pqQuoteLiteral(conninfo), replicationName))
+}
+
+// waitInitialSync waits until every table of the subscription is ready.
+func (r *replication) waitInitialSync(ctx context.Context) error {
+	logf("Waiting for the initial table copy...\n")
+	start := time.Now()
+	last := time.Time{}
+	sql := `SELECT count(*) AS total, count(*) FILTER (WHERE r.srsubstate <> 'r') AS pending
+FROM pg_subscription_rel r JOIN pg_subscription s ON s.oid = r.srsubid
+WHERE s.subname = '` + replicationName + `'`
+	for {
+		var rows []struct {
+			Total   int `json:"total"`
+			Pending int `json:"pending"`
+		}
+		if err := queryJSON(ctx, r.dstContainer, r.dstUser, r.dstPass, r.db, sql, &rows); err != nil {
+			return err
+		}
+		if len(rows) == 1 && rows[0].Pending == 0 {
+			logf("Initial copy of %d tables finished in %s.\n", rows[0].Total, time.Since(start).Round(time.Second))
+			return nil
+		}
+		if len(rows) == 1 && time.Since(last) >= progressInterval {
+			last = time.Now()
+			ev := event{Type: "progress", Phase: "initial_sync", DurationMs: time.Since(start).Milliseconds(),
+				Details: []string{fmt.Sprintf("%d of %d tables copied", rows[0].Total-rows[0].Pending, rows[0].Total)}}
+			emitOrLog(ev, fmt.Sprintf("Initial copy: %d of %d tables done after %s.", rows[0].Total-rows[0].Pending, rows[0].Total, time.Since(start).Round(time.Second)))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// lag returns how many bytes of WAL the subscription has not confirmed yet.
+func (r *replication) lag(ctx context.Context) (int64, error) {
+	var rows []struct {
+		Lag int64 `json:"lag"`
+	}
+	sql := `SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), COALESCE(confirmed_flush_lsn, '0/0'))::bigint AS lag
+FROM pg_replication_slots WHERE slot_name = '` + replicationName + `'`
+	if err := queryJSON(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, sql, &rows); err != nil {
+		return 0, err
+	}
+	if len(rows) != 1 {
+		return 0, fmt.Errorf("replication slot '%s' not found on the source", replicationName)
+	}
+	return rows[0].Lag, nil
+}
+
+func reportLag(lag int64) {
+	emitOrLog(event{Type: "lag", Phase: "replication", LagBytes: &lag}, fmt.Sprintf("Replication lag: %s.", formatBytes(lag)))
+}
+
+// followLag reports the replication lag until the user asks for the cutover.
+func (r *replication) followLag(ctx context.Context) error {
+	input := make(chan string)
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(input)
+				return
+			}
+			input <- strings.TrimSpace(strings.ToLower(line))
+		}
+	}()
+	promptf("Replication is running. Type 'cutover' and press Enter to stop writes on the source and switch over.\n")
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		lag, err := r.lag(ctx)
+		if err != nil {
+			return err
+		}
+		reportLag(lag)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case line, ok := <-input:
+			if !ok {
+				return fmt.Errorf("input closed before the cutover was requested")
+			}
+			if line == "cutover" {
+				return nil
+			}
+			promptf("Type 'cutover' to switch over (Ctrl-C aborts and removes the replication).\n")
+		case <-ticker.C:
+		}
+	}
+}
+
+// cutover makes the source read-only, waits until the destination has
+// applied everything, copies the sequence values and removes the
+// subscription and publication.
+func (r *replication) cutover(ctx context.Context, timeout time.Duration) error {
+	logf("Stopping writes on '%s'...\n", r.srcContainer)
+	sql := fmt.Sprintf("ALTER DATABASE %s SET default_transaction_read_only = on;", pqQuoteIdent(r.db))
+	if err := runPsqlInput(ctx, r.srcContainer, r.srcUser, r.srcPass, "postgres", sql); err != nil {
+		return err
+	}
+	r.readOnly = true
+	// sessions opened before the ALTER keep writing; end them
+	if err := terminateClients(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db); err != nil {
+		return err
+	}
+
+	logf("Waiting for the replication lag to reach zero...\n")
+	var target []struct {
+		LSN string `json:"lsn"`
+	}
+	if err := queryJSON(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, "SELECT pg_current_wal_lsn()::text AS lsn", &target); err != nil || len(target) != 1 {
+		return fmt.Errorf("reading the WAL position failed: %v", err)
+	}
+	deadline := time.Now().Add(timeout)
+	sql = fmt.Sprintf(`SELECT GREATEST(pg_wal_lsn_diff(%s::pg_lsn, COALESCE(confirmed_flush_lsn, '0/0')), 0)::bigint AS lag
+FROM pg_replication_slots WHERE slot_name = '%s'`, pqQuoteLiteral(target[0].LSN), replicationName)
+	for {
+		var rows []struct {
+			Lag int64 `json:"lag"`
+		}
+		if err := queryJSON(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, sql, &rows); err != nil {
+			return err
+		}
+		if len(rows) != 1 {
+			return fmt.Errorf("replication slot '%s' not found on the source", replicationName)
+		}
+		if rows[0].Lag == 0 {
+			reportLag(0)
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("lag still %s after %s", formatBytes(rows[0].Lag), timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	if err := r.syncSequences(ctx); err != nil {
+		return fmt.Errorf("syncing sequences failed: %w", err)
+	}
+	logf("Removing subscription and publication...\n")
+	if err := runPsqlInput(ctx, r.dstContainer, r.dstUser, r.dstPass, r.db, "DROP SUBSCRIPTION "+replicationName+";"); err != nil {
+		return err
+	}
+	return runPsqlInput(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, "DROP PUBLICATION "+replicationName+";")
+}
+
+// syncSequences sets every sequence on the destination to its source value;
+// logical replication does not carry sequences.
+func (r *replication) syncSequences(ctx context.Context) error {
+	var seqs []struct {
+		Schema string `json:"schema"`
+		Name   string `json:"name"`
+		Value  int64  `json:"value"`
+	}
+	sql := "SELECT schemaname AS schema, sequencename AS name, last_value AS value FROM pg_sequences WHERE last_value IS NOT NULL"
+	if err := queryJSON(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, sql, &seqs); err != nil {
+		return err
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, s := range seqs {
+		fmt.Fprintf(&b, "SELECT setval(%s, %d, true);\n", pqQuoteLiteral(pqQuoteIdent(s.Schema)+"."+pqQuoteIdent(s.Name)), s.Value)
+	}
+	logf("Copying %d sequence values...\n", len(seqs))
+	return runPsqlInput(ctx, r.dstContainer, r.dstUser, r.dstPass, r.db, b.String())
+}
+
+// cleanup removes the subscription, the replication slot, the publication
+// and the network changes, and makes the source writable again. It is used
+// when the run fails or is interrupted before the cutover completed.
+func (r *replication) cleanup(ctx context.Context) {
+	logf("Removing the replication setup...\n")
+	if err := runPsqlInput(ctx, r.dstContainer, r.dstUser, r.dstPass, r.db, "DROP SUBSCRIPTION IF EXISTS "+replicationName+";"); err != nil {
+		logf("Dropping subscription on '%s' failed: %v\n", r.dstContainer, err)
+	}
+	sql := fmt.Sprintf(`SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = '%s' AND NOT active;
+DROP PUBLICATION IF EXISTS %s;`, replicationName, replicationName)
+	if err := runPsqlInput(ctx, r.srcContainer, r.srcUser, r.srcPass, r.db, sql); err != nil {
+		logf("Removing publication on '%s' failed: %v\n", r.srcContainer, err)
+	}
+	if r.readOnly {
+		sql = fmt.Sprintf("ALTER DATABASE %s RESET default_transaction_read_only;", pqQuoteIdent(r.db))
+		if err := runPsqlInput(ctx, r.srcContainer, r.srcUser, r.srcPass, "postgres", sql); err != nil {
+			logf("Making '%s' writable again failed: %v\n", r.srcContainer, err)
+		}
+	}
+	r.leaveNetwork(ctx)
+}
+
+// runPsqlInput executes the SQL script sql, passed on stdin, and stops at
+// the first error.
+func runPsqlInput(ctx context.Context, container containerRef, user, pass, db, sql string) error {
+	cmd := pgExec(container, pass, true, "psql", "-X", "-q", "-v", "ON_ERROR_STOP=1", "-U", user, "-d", db).command(ctx)
+	cmd.Stdin = strings.NewReader(sql)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v - %s", err, errBuf.String())
+	}
+	return nil
+}
+
+// connInfoValue quotes a libpq connection string value.
+func connInfoValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return "'" + strings.ReplaceAll(v, "'", `\'`) + "'"
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConnInfoValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"app", `'app'`},
+		{"", `''`},
+		{"with space", `'with space'`},
+		{"it's", `'it\'s'`},
+		{`back\slash`, `'back\\slash'`},
+		{`\'`, `'\\\''`},
+	}
+	for _, tt := range tests {
+		if got := connInfoValue(tt.in); got != tt.want {
+			t.Errorf("connInfoValue(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestContainerNetworks(t *testing.T) {
+	dir := fakeDocker(t, `printf 'app_default=172.18.0.3\nbridge=172.17.0.2\n\n'`)
+	container := onEngine("pg", dockerEngine{Context: "prod"})
+	got, err := containerNetworks(context.Background(), container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app_default": "172.18.0.3", "bridge": "172.17.0.2"}
+	if !maps.Equal(got, want) {
+		t.Errorf("networks = %v, want %v", got, want)
+	}
+	if args := fakeDockerArgs(t, dir); !slices.Equal(args[:3], []string{"--context", "prod", "inspect"}) || args[len(args)-1] != "pg" {
+		t.Errorf("docker called with %q", args)
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	dir := fakeDocker(t, `cat "$FAKE_DOCKER_DIR/out"`)
+	tests := []struct {
+		name    string
+		out     string
+		want    int64
+		wantErr string
+	}{
+		{name: "behind", out: `[{"lag":4096}]`, want: 4096},
+		{name: "caught up", out: `[{"lag":0}]`, want: 0},
+		{name: "no slot", out: `[]`, wantErr: "replication slot 'pgupgrade_replication' not found"},
+	}
+	r := &replication{srcContainer: onEngine("old", dockerEngine{}), srcUser: "postgres", srcPass: "pw", db: "app"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dir, "out"), []byte(tt.out+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.lag(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("lag = %d, %v; want %d", got, err, tt.want)
+			}
+			args := fakeDockerArgs(t, dir)
+			if !strings.Contains(args[len(args)-1], "slot_name = '"+replicationName+"'") {
+				t.Errorf("query = %q", args[len(args)-1])
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+)
+
+// runResumeCommand implements "resume": continue the migration recorded in a
+// state file, skipping the phases that already completed. Passwords are not
+// stored; they come from $PGUPGRADE_SRC_PASSWORD / $PGUPGRADE_DST_PASSWORD,
+// the container environment or a prompt.
+func runResumeCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	statePath := fs.String("state", defaultStateFile, "state file written by the interrupted run")
+	fs.Parse(args)
+
+	state, err := loadRunState(*statePath)
+	if err != nil {
+		failf(errInvalidInput, "resume: %v\n", err)
+		return 2
+	}
+	plan := state.Plan
+	// --hook replaces the hooks of the interrupted run
+	if len(globalHooks) > 0 {
+		plan.Hooks = globalHooks
+	}
+	plan.SrcPassword = resumePassword(ctx, "PGUPGRADE_SRC_PASSWORD", plan.SrcContainer, "original")
+	plan.DstPassword = resumePassword(ctx, "PGUPGRADE_DST_PASSWORD", plan.DstContainer, "new")
+	logf("Resuming migration from '%s' to '%s' (state file '%s', last update %s).\n",
+		plan.SrcContainer, plan.DstContainer, *statePath, state.UpdatedAt.Format("2006-01-02 15:04:05"))
+
+	if !checkPgConnection(ctx, plan.SrcContainer, plan.SrcUser, plan.SrcPassword, "postgres") ||
+		!checkPgConnection(ctx, plan.DstContainer, plan.DstUser, plan.DstPassword, "postgres") {
+		failf(errConnection, "resume: cannot connect to both containers\n")
+		return 2
+	}
+	watchSessions(plan.SrcContainer, plan.SrcUser, plan.SrcPassword)
+	watchSessions(plan.DstContainer, plan.DstUser, plan.DstPassword)
+	if err := runMigration(ctx, plan, state); err != nil {
+		return 1
+	}
+	// Nothing left to resume
+	os.Remove(*statePath)
+	return 0
+}
+
+// resumePassword looks up a password that is not kept in the state file.
+func resumePassword(ctx context.Context, envName string, container containerRef, desc string) string {
+	if pass := os.Getenv(envName); pass != "" {
+		return pass
+	}
+	def := getContainerEnv(ctx, container)["POSTGRES_PASSWORD"]
+	return readPasswordWithDefault("Enter the password for the "+desc+" DB", def)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== S3-compatible object storage =====
+
+// s3PartSize is the smallest size of a multipart upload part. Parts are
+// buffered in memory; S3 requires at least 5 MiB for all but the last part.
+const s3PartSize = 16 << 20
+
+// s3MaxParts is the S3 limit of parts per upload.
+const s3MaxParts = 10000
+
+// s3PartSizeFor returns the part size for an object of about size bytes (0 if
+// unknown): s3PartSize, or larger so twice the estimate fits into s3MaxParts
+// parts. Without an estimate uploads end at about 156 GiB.
+func s3PartSizeFor(size int64) int {
+	part := int64(s3PartSize)
+	if need := (2*size + s3MaxParts - 1) / s3MaxParts; need > part {
+		part = (need + 1<<20 - 1) &^ (1<<20 - 1) // whole MiB
+	}
+	return int(part)
+}
+
+// s3Client talks to AWS S3 or a compatible service (MinIO, Ceph, ...) using
+// path-style URLs and Signature Version 4.
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+	now          func() time.Time
+}
+
+// newS3ClientFromEnv configures a client from the usual AWS variables plus
+// PGUPGRADE_S3_ENDPOINT for non-AWS services (e.g. http://localhost:9000).
+func newS3ClientFromEnv() (*s3Client, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("PGUPGRADE_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	c := &s3Client{
+		endpoint:     u,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		http:         http.DefaultClient,
+		now:          time.Now,
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for S3 access")
+	}
+	return c, nil
+}
+
+// isObjectURL reports whether s names an object (s3://, http:// or https://)
+// instead of a local path.
+func isObjectURL(s string) bool {
+	return strings.HasPrefix(s, "s3://") || strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// parseS3URL splits s3://bucket/key.
+func parseS3URL(s string) (bucket, key string, err error) {
+	rest, ok := strings.CutPrefix(s, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an s3:// URL", s)
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("%q must have the form s3://bucket/key", s)
+	}
+	return bucket, key, nil
+}
+
+// s3Escape percent-encodes s as SigV4 requires: everything except the
+// unreserved characters, and '/' unless keepSlash is false.
+func s3Escape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// do sends a signed request for bucket/key. body may be nil.
+func (c *s3Client) do(ctx context.Context, method, bucket, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := strings.TrimSuffix(c.endpoint.Path, "/") + "/" + s3Escape(bucket, false)
+	if key != "" {
+		path += "/" + s3Escape(key, true)
+	}
+	u := *c.endpoint
+	u.RawQuery = canonicalQuery(query)
+	raw := u.Scheme + "://" + u.Host + path
+	if u.RawQuery != "" {
+		raw += "?" + u.RawQuery
+	}
+	reqURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, path, u.RawQuery, body)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("S3 %s %s/%s: %s - %s", method, bucket, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sign adds the SigV4 headers. path and query must be the canonical
+// (already escaped) forms that are sent.
+func (c *s3Client) sign(req *http.Request, path, query string, body []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, query, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// get streams an object. The caller closes the returned body.
+func (c *s3Client) get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3Upload is a multipart upload fed through Write. Close completes it;
+// Abort discards the uploaded parts.
+type s3Upload struct {
+	ctx         context.Context
+	c           *s3Client
+	bucket, key string
+	uploadID    string
+	partSize    int
+	buf         []byte
+	etags       []string
+}
+
+// newUpload starts a multipart upload of an object of about size bytes (0 if
+// unknown), which sets the part size.
+func (c *s3Client) newUpload(ctx context.Context, bucket, key string, size int64) (*s3Upload, error) {
+	resp, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return nil, fmt.Errorf("S3 did not return an upload id: %v", err)
+	}
+	partSize := s3PartSizeFor(size)
+	return &s3Upload{ctx: ctx, c: c, bucket: bucket, key: key, uploadID: result.UploadID, partSize: partSize}, nil
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	u.buf = append(u.buf, p...)
+	for len(u.buf) >= u.partSize {
+		if err := u.uploadPart(u.buf[:u.partSize]); err != nil {
+			return 0, err
+		}
+		u.buf = append(u.buf[:0], u.buf[u.partSize:]...)
+	}
+	return len(p), nil
+}
+
+func (u *s3Upload) uploadPart(part []byte) error {
+	if len(u.etags) == s3MaxParts {
+		return fmt.Errorf("object is larger than %d parts of %s (%s); the size estimate was too low",
+			s3MaxParts, formatBytes(int64(u.partSize)), formatBytes(int64(s3MaxParts)*int64(u.partSize)))
+	}
+	q := url.Values{"partNumber": {strconv.Itoa(len(u.etags) + 1)}, "uploadId": {u.uploadID}}
+	resp, err := u.c.do(u.ctx, http.MethodPut, u.bucket, u.key, q, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	u.etags = append(u.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+func (u *s3Upload) Close() error {
+	if len(u.buf) > 0 || len(u.etags) == 0 {
+		if err := u.uploadPart(u.buf); err != nil {
+			return err
+		}
+		u.buf = nil
+	}
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range u.etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := u.c.do(u.ctx, http.MethodPost, u.bucket, u.key, url.Values{"uploadId": {u.uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 may report an error inside a 200 response
+	data, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(data, []byte("<Error>")) {
+		return fmt.Errorf("completing upload failed: %s", strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// Abort removes the parts uploaded so far; it uses its own context so it
+// also works after an interrupt.
+func (u *s3Upload) Abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if resp, err := u.c.do(ctx, http.MethodDelete, u.bucket, u.key, url.Values{"uploadId": {u.uploadID}}, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// uploadObject streams r, about size bytes (0 if unknown), to the s3:// URL
+// dest and returns the bytes sent.
+func uploadObject(ctx context.Context, dest string, r io.Reader, size int64) (int64, error) {
+	c, err := newS3ClientFromEnv()
+	if err != nil {
+		return 0, err
+	}
+	bucket, key, err := parseS3URL(dest)
+	if err != nil {
+		return 0, err
+	}
+	up, err := c.newUpload(ctx, bucket, key, size)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(up, r)
+	if err == nil {
+		err = up.Close()
+	}
+	if err != nil {
+		up.Abort()
+		return n, fmt.Errorf("uploading %s failed: %w", dest, err)
+	}
+	return n, nil
+}
+
+// uploadFile uploads the file at path to dest.
+func uploadFile(ctx context.Context, path, dest string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	logf("Uploading '%s' to %s...\n", path, dest)
+	return uploadObject(ctx, dest, f, fi.Size())
+}
+
+// openObject streams an object: s3:// URLs are signed with the configured
+// credentials, http(s) URLs (public or presigned) are fetched as they are.
+func openObject(ctx context.Context, src string) (io.ReadCloser, error) {
+	if strings.HasPrefix(src, "s3://") {
+		c, err := newS3ClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		bucket, key, err := parseS3URL(src)
+		if err != nil {
+			return nil, err
+		}
+		return c.get(ctx, bucket, key)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", src, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// joinObjectURL appends name to a s3://bucket/prefix URL.
+func joinObjectURL(prefix, name string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + name
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ===== User-defined smoke-test queries =====
+
+// smokeCheck is one named query from the smoke-test file. Every rule that is
+// set must hold; a check without any rule defaults to Equal.
+//
+// Example file:
+//
+//	[
+//	  {"name": "active users", "sql": "SELECT count(*) FROM users WHERE active", "equal": true},
+//	  {"name": "has products", "sql": "SELECT id FROM products LIMIT 1", "non_empty": true},
+//	  {"name": "top customers", "sql": "SELECT id FROM customers ORDER BY revenue DESC, id LIMIT 2", "expected": [{"id": 7}, {"id": 3}]},
+//	  {"name": "dashboard", "sql": "SELECT * FROM dashboard_view", "max_ms": 250},
+//	  {"name": "schema version", "sql": "SELECT max(version) AS v FROM schema_migrations", "expected": [{"v": 42}]}
+//	]
+type smokeCheck struct {
+	Name     string          `json:"name"`
+	SQL      string          `json:"sql"`
+	Equal    bool            `json:"equal"`     // same rows on both sides, in any order
+	NonEmpty bool            `json:"non_empty"` // at least one row on both sides
+	MaxMs    float64         `json:"max_ms"`    // round-trip time limit on both sides
+	Expected json.RawMessage `json:"expected"`  // rows both sides must return, in this order
+}
+
+func loadSmokeChecks(path string) ([]smokeCheck, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var checks []smokeCheck
+	if err := json.Unmarshal(data, &checks); err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %w", path, err)
+	}
+	for i, c := range checks {
+		if strings.TrimSpace(c.Name) == "" || strings.TrimSpace(c.SQL) == "" {
+			return nil, fmt.Errorf("check #%d in %s needs a name and sql", i+1, path)
+		}
+		if !c.Equal && !c.NonEmpty && c.MaxMs <= 0 && len(c.Expected) == 0 {
+			checks[i].Equal = true
+		}
+	}
+	return checks, nil
+}
+
+// smokeRun is the result of one check on one side.
+type smokeRun struct {
+	Rows []any
+	Ms   float64
+}
+
+func runSmokeChecks(ctx context.Context, checks []smokeCheck, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, dbName string) []verifyResult {
+	logf("Running %d smoke-test queries...\n", len(checks))
+	var results []verifyResult
+	for _, c := range checks {
+		err := runSmokeCheck(ctx, c, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName)
+		if err != nil {
+			logf("Smoke test '%s' failed: %v\n", c.Name, err)
+		} else {
+			logf("Smoke test '%s' passed.\n", c.Name)
+		}
+		results = append(results, verifyResult{Name: "smoke: " + c.Name, Err: err})
+	}
+	return results
+}
+
+func runSmokeCheck(ctx context.Context, c smokeCheck, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, dbName string) error {
+	src, err := runTimedQuery(ctx, srcContainer, srcUser, srcPass, dbName, c.SQL)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	dst, err := runTimedQuery(ctx, dstContainer, dstUser, dstPass, dbName, c.SQL)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	var problems []string
+	if c.Equal && !sameRows(src.Rows, dst.Rows) {
+		problems = append(problems, fmt.Sprintf("results differ (src %d rows, dst %d rows)", len(src.Rows), len(dst.Rows)))
+	}
+	if c.NonEmpty {
+		if len(src.Rows) == 0 {
+			problems = append(problems, "source returned no rows")
+		}
+		if len(dst.Rows) == 0 {
+			problems = append(problems, "destination returned no rows")
+		}
+	}
+	if c.MaxMs > 0 {
+		if src.Ms > c.MaxMs {
+			problems = append(problems, fmt.Sprintf("source took %.1f ms (limit %.0f ms)", src.Ms, c.MaxMs))
+		}
+		if dst.Ms > c.MaxMs {
+			problems = append(problems, fmt.Sprintf("destination took %.1f ms (limit %.0f ms)", dst.Ms, c.MaxMs))
+		}
+	}
+	if len(c.Expected) > 0 {
+		expected, err := decodeRows(c.Expected)
+		if err != nil {
+			return fmt.Errorf("invalid expected value: %w", err)
+		}
+		if !reflect.DeepEqual(src.Rows, expected) {
+			problems = append(problems, "source result does not match expected")
+		}
+		if !reflect.DeepEqual(dst.Rows, expected) {
+			problems = append(problems, "destination result does not match expected")
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// runTimedQuery runs sql with psql's \timing enabled and returns the rows (as
+// decoded JSON) together with the time psql measured. That is the round trip
+// as seen from inside the container: planning, execution, aggregating the
+// rows to JSON and transferring them, not the bare execution time.
+func runTimedQuery(ctx context.Context, container containerRef, user, pass, db, sql string) (smokeRun, error) {
+	query := fmt.Sprintf("SELECT COALESCE(json_agg(q), '[]'::json) FROM (%s) q", strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	call := pgExec(container, pass, false, "psql", "-X", "-q", "-U", user, "-d", db, "-t", "-A", "-c", `\timing on`, "-c", query)
+	cmd := call.command(ctx)
+	var out bytes.Buffer
+	var errBuf bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return smokeRun{}, fmt.Errorf("%v - %s", err, errBuf.String())
+	}
+	// Output is the JSON result followed by "Time: 1.234 ms"
+	var jsonPart strings.Builder
+	run := smokeRun{Ms: -1}
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Time: ") {
+			fields := strings.Fields(strings.TrimPrefix(line, "Time: "))
+			if len(fields) > 0 {
+				run.Ms, _ = strconv.ParseFloat(fields[0], 64)
+			}
+			continue
+		}
+		jsonPart.WriteString(line)
+		jsonPart.WriteString("\n")
+	}
+	rows, err := decodeRows([]byte(jsonPart.String()))
+	if err != nil {
+		return smokeRun{}, fmt.Errorf("decoding result failed: %w", err)
+	}
+	run.Rows = rows
+	return run, nil
+}
+
+// sameRows reports whether a and b hold the same rows regardless of order.
+// Without ORDER BY the order depends on the plan, which may differ between
+// major versions.
+func sameRows(a, b []any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	canonical := func(rows []any) []string {
+		keys := make([]string, len(rows))
+		for i, row := range rows {
+			data, _ := json.Marshal(row) // object keys come out sorted
+			keys[i] = string(data)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	return slices.Equal(canonical(a), canonical(b))
+}
+
+// decodeRows decodes a JSON array of rows, keeping numbers exact so bigint
+// values compare correctly.
+func decodeRows(data []byte) ([]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var rows []any
+	if err := dec.Decode(&rows); err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		rows = []any{}
+	}
+	return rows, nil
+}
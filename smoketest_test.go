@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadSmokeChecks(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    []smokeCheck
+		wantErr string
+	}{
+		{
+			name: "equal is the default",
+			file: `[{"name": "users", "sql": "SELECT count(*) FROM users"}]`,
+			want: []smokeCheck{{Name: "users", SQL: "SELECT count(*) FROM users", Equal: true}},
+		},
+		{
+			name: "explicit checks",
+			file: `[{"name": "fast", "sql": "SELECT 1", "max_ms": 250},
+				{"name": "rows", "sql": "SELECT id FROM t LIMIT 1", "non_empty": true},
+				{"name": "version", "sql": "SELECT 42 AS v", "expected": [{"v": 42}]}]`,
+			want: []smokeCheck{
+				{Name: "fast", SQL: "SELECT 1", MaxMs: 250},
+				{Name: "rows", SQL: "SELECT id FROM t LIMIT 1", NonEmpty: true},
+				{Name: "version", SQL: "SELECT 42 AS v", Expected: json.RawMessage(`[{"v": 42}]`)},
+			},
+		},
+		{name: "empty list", file: `[]`, want: []smokeCheck{}},
+		{name: "missing sql", file: `[{"name": "x"}]`, wantErr: "check #1"},
+		{name: "blank name", file: `[{"name": "ok", "sql": "SELECT 1"}, {"name": " ", "sql": "SELECT 1"}]`, wantErr: "check #2"},
+		{name: "not a list", file: `{"name": "x", "sql": "SELECT 1"}`, wantErr: "parsing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "smoke.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadSmokeChecks(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadSmokeChecks = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []any
+		wantErr bool
+	}{
+		{"empty array", `[]`, []any{}, false},
+		{"null", `null`, []any{}, false},
+		{"bigint stays exact", `[{"id": 9007199254740993}]`, []any{map[string]any{"id": json.Number("9007199254740993")}}, false},
+		{"numeric text", `[{"n": 1.50}]`, []any{map[string]any{"n": json.Number("1.50")}}, false},
+		{"nested and null", `[{"a": [1, null], "b": {"c": "x"}}]`, []any{map[string]any{"a": []any{json.Number("1"), nil}, "b": map[string]any{"c": "x"}}}, false},
+		{"trailing newline", "[{\"v\": true}]\n", []any{map[string]any{"v": true}}, false},
+		{"not an array", `{"a": 1}`, nil, true},
+		{"truncated", `[{"a": 1}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeRows([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeRows(%s) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeRows(%s) = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameRows(t *testing.T) {
+	rows := func(s string) []any {
+		r, err := decodeRows([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"equal", `[{"id": 1}, {"id": 2}]`, `[{"id": 1}, {"id": 2}]`, true},
+		{"other order", `[{"id": 1}, {"id": 2}]`, `[{"id": 2}, {"id": 1}]`, true},
+		{"key order", `[{"a": 1, "b": 2}]`, `[{"b": 2, "a": 1}]`, true},
+		{"duplicates count", `[{"id": 1}, {"id": 1}, {"id": 2}]`, `[{"id": 1}, {"id": 2}, {"id": 2}]`, false},
+		{"bigints differ in last digit", `[{"id": 9007199254740993}]`, `[{"id": 9007199254740992}]`, false},
+		{"different length", `[{"id": 1}]`, `[]`, false},
+		{"both empty", `[]`, `[]`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameRows(rows(tt.a), rows(tt.b)); got != tt.want {
+				t.Errorf("sameRows(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
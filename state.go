@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ===== Run state =====
+
+// defaultStateFile is where the interactive run records its progress.
+const defaultStateFile = "pgupgrade-state.json"
+
+// phaseRecord describes a completed phase. Checksum and Bytes identify the
+// dump the phase worked on so a later run can tell whether it is still valid.
+type phaseRecord struct {
+	CompletedAt time.Time `json:"completed_at"`
+	Checksum    string    `json:"sha256,omitempty"`
+	Bytes       int64     `json:"bytes,omitempty"`
+}
+
+// runState is persisted after every completed phase, so an interrupted
+// migration can be continued with "resume" instead of starting over.
+type runState struct {
+	path string
+
+	Plan      *migrationPlan                    `json:"plan"`
+	Phases    map[string]phaseRecord            `json:"phases"`    // cluster-wide phases (globals)
+	Databases map[string]map[string]phaseRecord `json:"databases"` // per database: dump, backup, restore, verify
+	StartedAt time.Time                         `json:"started_at"`
+	UpdatedAt time.Time                         `json:"updated_at"`
+}
+
+func newRunState(path string, plan *migrationPlan) *runState {
+	return &runState{
+		path:      path,
+		Plan:      plan,
+		Phases:    map[string]phaseRecord{},
+		Databases: map[string]map[string]phaseRecord{},
+		StartedAt: time.Now(),
+	}
+}
+
+func loadRunState(path string) (*runState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &runState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %w", path, err)
+	}
+	if s.Plan == nil {
+		return nil, fmt.Errorf("%s contains no migration plan", path)
+	}
+	s.path = path
+	if s.Phases == nil {
+		s.Phases = map[string]phaseRecord{}
+	}
+	if s.Databases == nil {
+		s.Databases = map[string]map[string]phaseRecord{}
+	}
+	return s, nil
+}
+
+// phases returns the phase map for db ("" for cluster-wide phases).
+func (s *runState) phases(db string) map[string]phaseRecord {
+	if db == "" {
+		return s.Phases
+	}
+	if s.Databases[db] == nil {
+		s.Databases[db] = map[string]phaseRecord{}
+	}
+	return s.Databases[db]
+}
+
+func (s *runState) record(db, phase string) (phaseRecord, bool) {
+	rec, ok := s.phases(db)[phase]
+	return rec, ok
+}
+
+func (s *runState) done(db, phase string) bool {
+	_, ok := s.record(db, phase)
+	return ok
+}
+
+// complete marks phase as done and saves the state. A failed save is only
+// logged: the migration itself is not affected, just a later resume.
+func (s *runState) complete(db, phase string, rec phaseRecord) {
+	rec.CompletedAt = time.Now()
+	s.phases(db)[phase] = rec
+	if err := s.save(); err != nil {
+		logf("Saving run state to '%s' failed: %v\n", s.path, err)
+	}
+}
+
+// invalidate forgets the given phases, e.g. after the dump they were based on
+// had to be redone.
+func (s *runState) invalidate(db string, phases ...string) {
+	m := s.phases(db)
+	for _, p := range phases {
+		delete(m, p)
+	}
+	if err := s.save(); err != nil {
+		logf("Saving run state to '%s' failed: %v\n", s.path, err)
+	}
+}
+
+// save writes the state atomically (temp file + rename), so an interrupt
+// never leaves a truncated file behind.
+func (s *runState) save() error {
+	s.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".pgupgrade-state-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
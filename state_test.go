@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunStateSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, defaultStateFile)
+	plan := &migrationPlan{
+		SrcUser:        "postgres",
+		Databases:      []string{"app", "shop"},
+		MigrateGlobals: true,
+		RoleMap:        map[string]string{"old": "new"},
+		VerifyMode:     "counts",
+	}
+	s := newRunState(path, plan)
+	s.complete("", "globals", phaseRecord{})
+	s.complete("app", "dump", phaseRecord{Checksum: "abc", Bytes: 3})
+	s.complete("app", "restore", phaseRecord{})
+	s.invalidate("app", "restore")
+
+	loaded, err := loadRunState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Plan, plan) {
+		t.Errorf("plan = %+v, want %+v", loaded.Plan, plan)
+	}
+	tests := []struct {
+		db, phase string
+		want      bool
+	}{
+		{"", "globals", true},
+		{"app", "dump", true},
+		{"app", "restore", false},
+		{"shop", "dump", false},
+		{"app", "globals", false},
+	}
+	for _, tt := range tests {
+		if got := loaded.done(tt.db, tt.phase); got != tt.want {
+			t.Errorf("done(%q, %q) = %v, want %v", tt.db, tt.phase, got, tt.want)
+		}
+	}
+	if rec, _ := loaded.record("app", "dump"); rec.Checksum != "abc" || rec.Bytes != 3 || rec.CompletedAt.IsZero() {
+		t.Errorf("dump record = %+v", rec)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("state directory holds %d files, want only the state file", len(entries))
+	}
+}
+
+func TestLoadRunStateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"not JSON", "plan: x", "parsing"},
+		{"no plan", `{"phases": {}}`, "contains no migration plan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadRunState(path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := loadRunState(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: err = %v", err)
+	}
+}
+
+func TestPlanVerifies(t *testing.T) {
+	tests := []struct {
+		mode, smoke string
+		want        bool
+	}{
+		{"none", "", false},
+		{"none", "checks.json", true},
+		{"counts", "", true},
+	}
+	for _, tt := range tests {
+		p := &migrationPlan{VerifyMode: tt.mode, SmokeFile: tt.smoke}
+		if got := p.verifies(); got != tt.want {
+			t.Errorf("verifies(%q, %q) = %v, want %v", tt.mode, tt.smoke, got, tt.want)
+		}
+	}
+}
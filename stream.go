@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Streaming through the Go process =====
+
+// pipeDocker runs the docker calls srcCall and dstCall and feeds the
+// stdout of the first into the stdin of the second via copyFn, which returns
+// the number of bytes it wrote. If the two run on different engines, both
+// ends count the bytes and the counts are checked.
+func pipeDocker(ctx context.Context, srcCall, dstCall dockerCall, copyFn func(w io.Writer, r io.Reader) (int64, error)) (int64, error) {
+	reportCommand(srcCall.String() + " | " + dstCall.String())
+	checkCounts := false
+	if srcCall.Engine != dstCall.Engine {
+		var srcOK, dstOK bool
+		srcCall.Args, srcOK = wrapCounting(srcCall.Args, countingSourceScript)
+		dstCall.Args, dstOK = wrapCounting(dstCall.Args, countingSinkScript)
+		checkCounts = srcOK && dstOK
+	}
+	src := srcCall.command(ctx)
+	dst := dstCall.command(ctx)
+	var srcErr, dstErr bytes.Buffer
+	src.Stderr = &srcErr
+	dst.Stderr = &dstErr
+	dst.Stdout = humanOut()
+	srcOut, err := src.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	dstIn, err := dst.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := dst.Start(); err != nil {
+		return 0, fmt.Errorf("starting restore failed: %v", err)
+	}
+	if err := src.Start(); err != nil {
+		dstIn.Close()
+		dst.Wait()
+		return 0, fmt.Errorf("starting dump failed: %v", err)
+	}
+	received, sent := &byteCounter{}, &byteCounter{}
+	transferred, copyErr := copyFn(io.MultiWriter(dstIn, sent), io.TeeReader(srcOut, received))
+	if copyErr != nil {
+		// drain so the dump process can exit
+		io.Copy(io.Discard, srcOut)
+	}
+	dstIn.Close()
+	srcWaitErr := src.Wait()
+	dstWaitErr := dst.Wait()
+	srcStderr, dstStderr := srcErr.String(), dstErr.String()
+	if checkCounts {
+		srcStderr, dstStderr = withoutDDStatus(srcStderr), withoutDDStatus(dstStderr)
+	}
+	if srcWaitErr != nil {
+		return transferred, fmt.Errorf("dump failed: %v - %s", srcWaitErr, srcStderr)
+	}
+	if dstWaitErr != nil {
+		return transferred, fmt.Errorf("restore failed: %v - %s", dstWaitErr, dstStderr)
+	}
+	if copyErr != nil {
+		return transferred, fmt.Errorf("stream failed: %v", copyErr)
+	}
+	reportWarnings(dstStderr, false)
+	if checkCounts {
+		return transferred, checkByteCounts(srcErr.String(), dstErr.String(), received.n, sent.n)
+	}
+	return transferred, nil
+}
+
+// plainCopy copies the stream unchanged, also writing it to progress if set.
+func plainCopy(progress io.Writer) func(w io.Writer, r io.Reader) (int64, error) {
+	return func(w io.Writer, r io.Reader) (int64, error) {
+		if progress != nil {
+			w = io.MultiWriter(w, progress)
+		}
+		return io.Copy(w, r)
+	}
+}
+
+// ===== Progress reporting =====
+
+// progressInterval is how often streamProgress reports while data flows.
+const progressInterval = 10 * time.Second
+
+// streamProgress counts the bytes flowing through the pipe and periodically
+// reports throughput, an ETA derived from the database sizes and, on PG14+
+// destinations, the COPY / CREATE INDEX running on the destination.
+type streamProgress struct {
+	bytes atomic.Int64
+	start time.Time
+	ctx   context.Context
+
+	dstContainer             containerRef
+	dstUser, dstPass, dbName string
+	srcSize                  int64 // pg_database_size of the source, 0 if unknown
+	dstBase                  int64 // destination size before the restore
+	pg14                     bool  // destination has pg_stat_progress_copy
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newStreamProgress(ctx context.Context, srcContainer containerRef, srcUser, srcPass string, dstContainer containerRef, dstUser, dstPass, dbName string) *streamProgress {
+	p := &streamProgress{
+		ctx:          ctx,
+		dstContainer: dstContainer, dstUser: dstUser, dstPass: dstPass, dbName: dbName,
+	}
+	if size, err := databaseSize(ctx, srcContainer, srcUser, srcPass, dbName); err == nil {
+		p.srcSize = size
+		logf("Source database size: %s\n", formatBytes(size))
+	}
+	if size, err := databaseSize(ctx, dstContainer, dstUser, dstPass, dbName); err == nil {
+		p.dstBase = size
+	}
+	if v, err := serverVersionNum(ctx, dstContainer, dstUser, dstPass, dbName); err == nil {
+		p.pg14 = v >= 140000
+	}
+	return p
+}
+
+func (p *streamProgress) Write(b []byte) (int, error) {
+	p.bytes.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// begin starts the periodic reporting; finish stops it and prints a final line.
+func (p *streamProgress) begin() {
+	p.start = time.Now()
+	p.stop = make(chan struct{})
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.report(false)
+			}
+		}
+	}()
+}
+
+func (p *streamProgress) finish() {
+	close(p.stop)
+	p.done.Wait()
+	p.report(true)
+}
+
+func (p *streamProgress) report(final bool) {
+	elapsed := time.Since(p.start)
+	n := p.bytes.Load()
+	rate := float64(n) / elapsed.Seconds()
+	ev := event{Type: "progress", Phase: "dump_restore", Bytes: n, DurationMs: elapsed.Milliseconds(), BytesPerSec: int64(rate)}
+	if final {
+		ev.Type = "bytes"
+		emitOrLog(ev, fmt.Sprintf("Transferred %s in %s (%s/s).", formatBytes(n), elapsed.Round(time.Second), formatBytes(int64(rate))))
+		return
+	}
+	line := fmt.Sprintf("Streamed %s in %s (%s/s)", formatBytes(n), elapsed.Round(time.Second), formatBytes(int64(rate)))
+	if p.srcSize > 0 {
+		if size, err := databaseSize(p.ctx, p.dstContainer, p.dstUser, p.dstPass, p.dbName); err == nil {
+			restored := size - p.dstBase
+			line += fmt.Sprintf(", destination %s of ~%s", formatBytes(size), formatBytes(p.srcSize))
+			if restored > 0 && size < p.srcSize {
+				eta := time.Duration(float64(elapsed) * float64(p.srcSize-size) / float64(restored))
+				ev.EtaMs = eta.Milliseconds()
+				line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+			}
+		}
+	}
+	if p.pg14 {
+		ev.Details = destinationActivity(p.ctx, p.dstContainer, p.dstUser, p.dstPass, p.dbName)
+		for _, d := range ev.Details {
+			line += "\n  " + d
+		}
+	}
+	emitOrLog(ev, line)
+}
+
+// emitOrLog emits ev in JSON mode and prints text otherwise.
+func emitOrLog(ev event, text string) {
+	if outputJSON {
+		emit(ev)
+		return
+	}
+	logf("%s\n", text)
+}
+
+func databaseSize(ctx context.Context, container containerRef, user, pass, db string) (int64, error) {
+	var rows []struct {
+		Size int64 `json:"size"`
+	}
+	if err := queryJSON(ctx, container, user, pass, db, "SELECT pg_database_size(current_database()) AS size", &rows); err != nil {
+		return 0, err
+	}
+	if len(rows) != 1 {
+		return 0, fmt.Errorf("unexpected result with %d rows", len(rows))
+	}
+	return rows[0].Size, nil
+}
+
+func serverVersionNum(ctx context.Context, container containerRef, user, pass, db string) (int, error) {
+	var rows []struct {
+		Version int `json:"version"`
+	}
+	if err := queryJSON(ctx, container, user, pass, db, "SELECT current_setting('server_version_num')::int AS version", &rows); err != nil {
+		return 0, err
+	}
+	if len(rows) != 1 {
+		return 0, fmt.Errorf("unexpected result with %d rows", len(rows))
+	}
+	return rows[0].Version, nil
+}
+
+// destinationActivity describes running COPY and CREATE INDEX commands (PG14+).
+func destinationActivity(ctx context.Context, container containerRef, user, pass, db string) []string {
+	sql := `SELECT 'COPY ' || COALESCE(c.relid::regclass::text, '?') AS what,
+       pg_size_pretty(c.bytes_processed) || ', ' || c.tuples_processed || ' rows' AS detail
+FROM pg_stat_progress_copy c WHERE c.datname = current_database()
+UNION ALL
+SELECT 'CREATE INDEX ' || COALESCE(i.index_relid::regclass::text, '?') || ' ON ' || i.relid::regclass::text,
+       i.phase || CASE WHEN i.blocks_total > 0
+                       THEN ' ' || round(100.0 * i.blocks_done / i.blocks_total) || '%'
+                       ELSE '' END
+FROM pg_stat_progress_create_index i WHERE i.datname = current_database()`
+	var rows []struct {
+		What   string `json:"what"`
+		Detail string `json:"detail"`
+	}
+	if err := queryJSON(ctx, container, user, pass, db, sql, &rows); err != nil {
+		return nil
+	}
+	var details []string
+	for _, r := range rows {
+		details = append(details, r.What+": "+r.Detail)
+	}
+	return details
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPipeDocker(t *testing.T) {
+	dir := fakeDocker(t, `case "$1" in
+dump) printf 'CREATE TABLE t ();\n' ;;
+faildump) echo "no such database" >&2; exit 1 ;;
+restore) cat > "$FAKE_DOCKER_DIR/restored" ;;
+failrestore) cat > /dev/null; echo "role missing" >&2; exit 3 ;;
+esac`)
+	tests := []struct {
+		name     string
+		src, dst string
+		wantErr  string
+	}{
+		{name: "ok", src: "dump", dst: "restore"},
+		{name: "dump fails", src: "faildump", dst: "restore", wantErr: "dump failed: exit status 1 - no such database"},
+		{name: "restore fails", src: "dump", dst: "failrestore", wantErr: "restore failed: exit status 3 - role missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			progress := &streamProgress{}
+			n, err := pipeDocker(context.Background(), dockerCall{Args: []string{tt.src}}, dockerCall{Args: []string{tt.dst}}, plainCopy(progress))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			const want = "CREATE TABLE t ();\n"
+			if n != int64(len(want)) || progress.bytes.Load() != n {
+				t.Errorf("transferred %d, progress %d, want %d", n, progress.bytes.Load(), len(want))
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "restored"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != want {
+				t.Errorf("restored %q, want %q", data, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Dump files on the host =====
+
+// Archive formats understood by export and import.
+const (
+	formatCustom    = "custom"
+	formatDirectory = "directory"
+	formatPlain     = "plain"
+)
+
+// dumpToFile streams the output of pg_dump (with dumpArgs, e.g. "-Fc") into
+// path on the host. The data is written to path.partial and renamed once
+// pg_dump succeeded. It returns the size and sha256 of the file as stored.
+func dumpToFile(ctx context.Context, container containerRef, user, pass, db, path string, comp compression, dumpArgs ...string) (int64, string, error) {
+	partial := path + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, "", err
+	}
+	release := onInterrupt(fmt.Sprintf("remove partial file '%s'", partial), func(ctx context.Context) {
+		os.Remove(partial)
+	})
+	defer release()
+
+	size, sum, err := dumpToWriter(ctx, container, user, pass, db, f, comp, dumpArgs...)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return 0, "", err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return 0, "", err
+	}
+	return size, sum, nil
+}
+
+// plainDumpName returns the host file name for a plain-format dump of db as
+// dumpToFile writes it.
+func plainDumpName(db string, comp compression) string {
+	return unsafeFileChars.ReplaceAllString(db, "_") + "_dump.sql" + dumpFileSuffix(formatPlain, comp)
+}
+
+// dumpFileSuffix returns what dumpToFile's compression and encryption add to
+// the name of a dump file: ".gz" when it holds gzip data (a plain dump
+// compressed by gzip or pg_dump -Z, any dump compressed by gzip) and ".enc"
+// when it is encrypted with the artifact key.
+func dumpFileSuffix(format string, comp compression) string {
+	var suffix string
+	if comp.Method == "gzip" || (comp.Method != "" && format == formatPlain) {
+		suffix += ".gz"
+	}
+	if artifactKey != nil {
+		suffix += ".enc"
+	}
+	return suffix
+}
+
+// dumpToObject streams the output of pg_dump into a multipart upload to the
+// s3:// URL dest. A failed dump aborts the upload. The size of the database
+// serves as the size estimate; dumps are rarely larger.
+func dumpToObject(ctx context.Context, container containerRef, user, pass, db, dest string, comp compression, dumpArgs ...string) (int64, string, error) {
+	estimate, err := databaseSize(ctx, container, user, pass, db)
+	if err != nil {
+		logf("Size of database '%s' unknown (%v); the upload is limited to %s.\n", db, err, formatBytes(int64(s3MaxParts)*s3PartSize))
+	}
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := uploadObject(ctx, dest, pr, estimate)
+		// unblock pg_dump if the upload stopped early
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+	size, sum, err := dumpToWriter(ctx, container, user, pass, db, pw, comp, dumpArgs...)
+	if err != nil {
+		pw.CloseWithError(err)
+		<-uploaded
+		return 0, "", err
+	}
+	pw.Close()
+	if err := <-uploaded; err != nil {
+		return 0, "", err
+	}
+	return size, sum, nil
+}
+
+// dumpToWriter runs pg_dump and writes its output to w, compressed with comp
+// and encrypted if a key is configured. It returns the number and sha256 of
+// the bytes written to w.
+func dumpToWriter(ctx context.Context, container containerRef, user, pass, db string, w io.Writer, comp compression, dumpArgs ...string) (int64, string, error) {
+	tool := append([]string{"pg_dump", "-U", user, "-d", db}, dumpArgs...)
+	call := pgExec(container, pass, false, append(tool, comp.pgDumpArgs()...)...)
+	reportCommand(call.String())
+	cmd := call.command(ctx)
+	start := time.Now()
+	hash := sha256.New()
+	counter := &byteCounter{}
+	out, finish, err := createArtifact(io.MultiWriter(w, hash, counter))
+	if err != nil {
+		return 0, "", err
+	}
+	compressed := &byteCounter{}
+	zw, zclose, err := comp.gzipWriter(io.MultiWriter(out, compressed))
+	if err != nil {
+		return 0, "", err
+	}
+	raw := &byteCounter{}
+	cmd.Stdout = io.MultiWriter(zw, raw)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		err = zclose()
+	}
+	if err == nil {
+		err = finish()
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("pg_dump failed: %v - %s", err, stderr.String())
+	}
+	switch comp.Method {
+	case "gzip":
+		reportCompression("dump", comp, raw.n, compressed.n, false, time.Since(start))
+	case "pg_dump":
+		if size, err := databaseSize(ctx, container, user, pass, db); err == nil {
+			reportCompression("dump", comp, size, raw.n, true, time.Since(start))
+		}
+	}
+	return counter.n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// containerTempDir is a per-process scratch directory inside a container,
+// used for directory-format archives which pg_dump cannot write to stdout.
+func containerTempDir(db string) string {
+	return fmt.Sprintf("/tmp/%s-%s", sessionAppName, unsafeFileChars.ReplaceAllString(db, "_"))
+}
+
+// dumpToDirectory runs pg_dump -Fd with jobs workers inside container and
+// streams the resulting directory as tar into dir on the host. pg_dump
+// compresses the files itself, so any method in comp maps to -Z.
+func dumpToDirectory(ctx context.Context, container containerRef, user, pass, db, dir string, jobs int, comp compression) (int64, error) {
+	tmp := containerTempDir(db)
+	release := onInterrupt(fmt.Sprintf("remove '%s' in '%s'", tmp, container), func(ctx context.Context) {
+		engineCommand(ctx, container.Engine, "exec", container.Name, "rm", "-rf", tmp).Run()
+	})
+	defer release()
+	defer engineCommand(context.Background(), container.Engine, "exec", container.Name, "rm", "-rf", tmp).Run()
+
+	tool := append([]string{"pg_dump", "-U", user, "-d", db, "-Fd", "-j", strconv.Itoa(jobs), "-f", tmp}, comp.streamArgs()...)
+	call := pgExec(container, pass, false, tool...)
+	reportCommand(call.String())
+	start := time.Now()
+	cmd := call.command(ctx)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("pg_dump failed: %v - %s", err, stderr.String())
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return 0, err
+	}
+	cmd = engineCommand(ctx, container.Engine, "exec", container.Name, "tar", "-C", tmp, "-cf", "-", ".")
+	stderr.Reset()
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	n, extractErr := extractTar(out, dir)
+	if extractErr != nil {
+		io.Copy(io.Discard, out)
+	}
+	if err := cmd.Wait(); err != nil {
+		return n, fmt.Errorf("reading archive directory failed: %v - %s", err, stderr.String())
+	}
+	if extractErr == nil && comp.Method != "" {
+		if size, err := databaseSize(ctx, container, user, pass, db); err == nil {
+			reportCompression("dump", comp, size, n, true, time.Since(start))
+		}
+	}
+	return n, extractErr
+}
+
+// extractTar writes the regular files and directories of a tar stream below
+// dir (each file encrypted if a key is configured) and returns the number of
+// file bytes received.
+func extractTar(r io.Reader, dir string) (int64, error) {
+	tr := tar.NewReader(r)
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		name := filepath.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return total, fmt.Errorf("unexpected path %q in archive", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o700); err != nil {
+				return total, err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+			if err != nil {
+				return total, err
+			}
+			w, finish, err := createArtifact(f)
+			if err != nil {
+				f.Close()
+				return total, err
+			}
+			n, err := io.Copy(w, tr)
+			total += n
+			if err == nil {
+				err = finish()
+			}
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+}
+
+// restoreFromFile feeds the custom-format or plain SQL file at path into
+// pg_restore or psql in container, decrypting and decompressing it if
+// necessary. restoreArgs are passed to pg_restore.
+func restoreFromFile(ctx context.Context, container containerRef, user, pass, db, path, format string, restoreArgs ...string) (int64, error) {
+	f, err := openDump(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return restoreFromReader(ctx, container, user, pass, db, f, path, format, restoreArgs...)
+}
+
+// restoreFromReader feeds an already decoded dump stream (named source in
+// messages) into pg_restore or psql in container.
+func restoreFromReader(ctx context.Context, container containerRef, user, pass, db string, r io.Reader, source, format string, restoreArgs ...string) (int64, error) {
+	var tool []string
+	switch format {
+	case formatCustom:
+		tool = append([]string{"pg_restore", "-U", user, "-d", db}, restoreArgs...)
+	case formatPlain:
+		tool = []string{"psql", "-X", "-v", "ON_ERROR_STOP=1", "-U", user, "-d", db}
+	default:
+		return 0, fmt.Errorf("format %q cannot be restored from a stream", format)
+	}
+	call := pgExec(container, pass, true, tool...)
+	reportCommand(call.String() + " < " + source)
+	cmd := call.command(ctx)
+	counter := &byteCounter{}
+	cmd.Stdin = io.TeeReader(r, counter)
+	cmd.Stdout = humanOut()
+	var stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := cmd.Run(); err != nil {
+		return counter.n, fmt.Errorf("%s failed: %v - %s", tool[0], err, stderr.String())
+	}
+	reportWarnings(stderr.String(), true)
+	return counter.n, nil
+}
+
+// restoreFromDirectory streams the directory-format archive at dir into
+// container as tar and restores it with jobs parallel pg_restore workers.
+func restoreFromDirectory(ctx context.Context, container containerRef, user, pass, db, dir string, jobs int, restoreArgs ...string) (int64, error) {
+	tmp := containerTempDir(db)
+	release := onInterrupt(fmt.Sprintf("remove '%s' in '%s'", tmp, container), func(ctx context.Context) {
+		engineCommand(ctx, container.Engine, "exec", container.Name, "rm", "-rf", tmp).Run()
+	})
+	defer release()
+	defer engineCommand(context.Background(), container.Engine, "exec", container.Name, "rm", "-rf", tmp).Run()
+
+	if out, err := engineCommand(ctx, container.Engine, "exec", container.Name, "mkdir", "-p", tmp).CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("creating '%s' failed: %v - %s", tmp, err, out)
+	}
+	cmd := engineCommand(ctx, container.Engine, "exec", "-i", container.Name, "tar", "-C", tmp, "-xf", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	n, tarErr := writeTar(in, dir)
+	in.Close()
+	if err := cmd.Wait(); err != nil {
+		return n, fmt.Errorf("copying archive directory failed: %v - %s", err, stderr.String())
+	}
+	if tarErr != nil {
+		return n, tarErr
+	}
+
+	tool := append([]string{"pg_restore", "-U", user, "-d", db, "-Fd", "-j", strconv.Itoa(jobs)}, restoreArgs...)
+	call := pgExec(container, pass, false, append(tool, tmp)...)
+	reportCommand(call.String())
+	cmd = call.command(ctx)
+	cmd.Stdout = humanOut()
+	stderr.Reset()
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := cmd.Run(); err != nil {
+		return n, fmt.Errorf("pg_restore failed: %v - %s", err, stderr.String())
+	}
+	reportWarnings(stderr.String(), true)
+	return n, nil
+}
+
+// openDump opens a dump file for reading, decrypting and gunzipping it as
+// needed.
+func openDump(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decodeDump(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{r, f}, nil
+}
+
+// decodeDump decrypts and gunzips a dump stream as needed. name is used in
+// error messages.
+func decodeDump(r io.Reader, name string) (io.Reader, error) {
+	plain, err := decryptIfNeeded(r, name)
+	if err != nil {
+		return nil, err
+	}
+	unzipped, err := maybeGunzip(plain)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return unzipped, nil
+}
+
+// streamFormat tells custom-format archives from plain SQL by peeking at the
+// start of a decoded dump stream.
+func streamFormat(br *bufio.Reader) string {
+	if magic, _ := br.Peek(5); string(magic) == "PGDMP" {
+		return formatCustom
+	}
+	return formatPlain
+}
+
+// writeTar writes the regular files below dir as a tar stream, decrypting
+// encrypted files.
+func writeTar(w io.Writer, dir string) (int64, error) {
+	tw := tar.NewWriter(w)
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		size := int64(0)
+		if !info.IsDir() {
+			if size, err = artifactSize(path); err != nil {
+				return err
+			}
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		hdr.Size = size
+		// the files must be readable by the postgres user in the container
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		hdr.Mode = 0o644
+		if info.IsDir() {
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := openArtifact(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(tw, f)
+		total += n
+		return err
+	})
+	if err != nil {
+		return total, err
+	}
+	return total, tw.Close()
+}
+
+// detectFormat tells the archive format of path (looking through encryption
+// and gzip): a directory with toc.dat, a custom-format file (starting with
+// "PGDMP") or plain SQL.
+func detectFormat(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, "toc.dat")); err != nil {
+			return "", fmt.Errorf("%s is not a directory-format archive (no toc.dat)", path)
+		}
+		return formatDirectory, nil
+	}
+	f, err := openDump(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return streamFormat(bufio.NewReader(f)), nil
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("app.dir/toc.dat", "PGDMP")
+	if err := os.Mkdir(filepath.Join(dir, "empty.dir"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "directory", path: filepath.Join(dir, "app.dir"), want: formatDirectory},
+		{name: "directory without toc.dat", path: filepath.Join(dir, "empty.dir"), wantErr: true},
+		{name: "custom", path: write("app.dump", "PGDMP\x01\x0e\x00"), want: formatCustom},
+		{name: "plain", path: write("app.sql", "--\n-- PostgreSQL database dump\n"), want: formatPlain},
+		{name: "short file", path: write("short", "PG"), want: formatPlain},
+		{name: "missing", path: filepath.Join(dir, "missing.dump"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectFormat(tt.path)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("detectFormat = %q, %v; want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"toc.dat":      "PGDMP toc",
+		"3001.dat.gz":  strings.Repeat("row\n", 100),
+		"blobs/1.dat":  "blob",
+		"blobs/no.dat": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	written, err := writeTar(&buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	read, err := extractTar(&buf, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != read {
+		t.Errorf("wrote %d bytes, extracted %d", written, read)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExtractTarRejectsEscapingPaths(t *testing.T) {
+	for _, name := range []string{"../evil", "/etc/passwd", "a/../../evil"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("x"))
+		tw.Close()
+		if _, err := extractTar(&buf, t.TempDir()); err == nil {
+			t.Errorf("extractTar accepted %q", name)
+		}
+	}
+}
+
+func TestDumpFileSuffix(t *testing.T) {
+	defer func() { artifactKey = nil }()
+	gz := compression{Method: "gzip", Level: 6}
+	pgz := compression{Method: "pg_dump", Level: 6}
+	tests := []struct {
+		format    string
+		comp      compression
+		encrypted bool
+		want      string
+	}{
+		{formatPlain, compression{}, false, ""},
+		{formatPlain, gz, false, ".gz"},
+		{formatPlain, pgz, false, ".gz"},
+		{formatPlain, pgz, true, ".gz.enc"},
+		{formatCustom, gz, false, ".gz"},
+		// pg_dump -Z compresses inside the custom archive
+		{formatCustom, pgz, false, ""},
+		{formatCustom, compression{}, true, ".enc"},
+	}
+	for _, tt := range tests {
+		artifactKey = nil
+		if tt.encrypted {
+			artifactKey = make([]byte, 32)
+		}
+		if got := dumpFileSuffix(tt.format, tt.comp); got != tt.want {
+			t.Errorf("dumpFileSuffix(%s, %s, encrypted=%v) = %q, want %q", tt.format, tt.comp, tt.encrypted, got, tt.want)
+		}
+	}
+	artifactKey = make([]byte, 32)
+	if got, want := plainDumpName("my app", gz), "my_app_dump.sql.gz.enc"; got != want {
+		t.Errorf("plainDumpName = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+// runVerifyCommand implements "verify": compare two running containers without
+// migrating anything. Exit code 0 means every check passed, 1 a mismatch and
+// 2 a usage or connection error.
+func runVerifyCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	src := addConnFlags(fs, "src", "source")
+	dst := addConnFlags(fs, "dst", "destination")
+	db := fs.String("db", "", "database name (default: POSTGRES_DB of the source or postgres)")
+	mode := fs.String("mode", "quick", "verification mode: quick, estimate or full")
+	defaults := defaultCountOptions()
+	workers := fs.Int("workers", defaults.Workers, "parallel COUNT(*) queries per container (full mode)")
+	tableTimeout := fs.Duration("table-timeout", defaults.TableTimeout, "timeout per table count, 0 = none (full mode)")
+	smokeFile := fs.String("smoke", "", "JSON file with smoke-test queries")
+	fs.Parse(args)
+
+	srcContainer, srcUser, srcPass, err := src.resolve(ctx)
+	if err != nil {
+		failf(errInvalidInput, "verify: %v\n", err)
+		return 2
+	}
+	dstContainer, dstUser, dstPass, err := dst.resolve(ctx)
+	if err != nil {
+		failf(errInvalidInput, "verify: %v\n", err)
+		return 2
+	}
+	switch *mode {
+	case "quick", "estimate", "full":
+	default:
+		failf(errInvalidInput, "verify: unknown mode %q\n", *mode)
+		return 2
+	}
+	dbName := defaultDatabase(ctx, srcContainer, *db)
+
+	if !checkPgConnection(ctx, srcContainer, srcUser, srcPass, dbName) || !checkPgConnection(ctx, dstContainer, dstUser, dstPass, dbName) {
+		failf(errConnection, "verify: cannot connect to both containers\n")
+		return 2
+	}
+	// long COUNT(*) queries must not outlive a Ctrl-C
+	watchSessions(srcContainer, srcUser, srcPass)
+	watchSessions(dstContainer, dstUser, dstPass)
+	opts := countOptions{Workers: *workers, TableTimeout: *tableTimeout}
+	done := startPhase("verify")
+	results := runVerification(ctx, *mode, opts, *smokeFile, srcContainer, srcUser, srcPass, dstContainer, dstUser, dstPass, dbName)
+	if !printVerificationSummary(results) {
+		done(fmt.Errorf("verification failed"))
+		return 1
+	}
+	done(nil)
+	return 0
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunVerifyCommandUsage(t *testing.T) {
+	creds := []string{"-src-user", "u", "-src-password", "p", "-dst-user", "u", "-dst-password", "p"}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no source", append([]string{"-dst", "b"}, creds...)},
+		{"no destination", append([]string{"-src", "a"}, creds...)},
+		{"unknown mode", append([]string{"-src", "a", "-dst", "b", "-mode", "thorough"}, creds...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := runVerifyCommand(context.Background(), tt.args); code != 2 {
+				t.Errorf("runVerifyCommand(%q) = %d, want 2", tt.args, code)
+			}
+		})
+	}
+}